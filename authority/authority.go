@@ -162,10 +162,13 @@ func (a *Authority) init() error {
 
 		// Read intermediate and create X509 signer for default CAS.
 		if options.Is(casapi.SoftCAS) {
-			options.Issuer, err = pemutil.ReadCertificate(a.config.IntermediateCert)
+			// The crt can be a bundle with the issuer and its parents.
+			var chain []*x509.Certificate
+			chain, err = pemutil.ReadCertificateBundle(a.config.IntermediateCert)
 			if err != nil {
 				return err
 			}
+			options.Issuer, options.Intermediates = chain[0], chain[1:]
 			options.Signer, err = a.keyManager.CreateSigner(&kmsapi.CreateSignerRequest{
 				SigningKey: a.config.IntermediateKey,
 				Password:   []byte(a.config.Password),
@@ -305,4 +305,11 @@ func TestNewEmbedded_GetTLSCertificate(t *testing.T) {
 	assert.Equals(t, []string{"localhost"}, cert.Leaf.DNSNames)
 	assert.True(t, cert.Leaf.IPAddresses[0].Equal(net.ParseIP("127.0.0.1")))
 	assert.True(t, cert.Leaf.IPAddresses[1].Equal(net.ParseIP("::1")))
+	assert.Equals(t, "Step Online CA", cert.Leaf.Subject.CommonName)
+
+	// GetTLSCertificate with a common name
+	a.config.CommonName = "Test Online CA"
+	cert, err = a.GetTLSCertificate()
+	assert.FatalError(t, err)
+	assert.Equals(t, "Test Online CA", cert.Leaf.Subject.CommonName)
 }
@@ -408,7 +408,11 @@ func (a *Authority) GetTLSCertificate() (*tls.Certificate, error) {
 	}
 
 	// Create initial certificate request.
-	cr, err := x509util.CreateCertificateRequest("Step Online CA", a.config.DNSNames, signer)
+	commonName := a.config.CommonName
+	if commonName == "" {
+		commonName = defaultCommonName
+	}
+	cr, err := x509util.CreateCertificateRequest(commonName, a.config.DNSNames, signer)
 	if err != nil {
 		return fatal(err)
 	}
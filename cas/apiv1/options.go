@@ -3,7 +3,10 @@ package apiv1
 import (
 	"crypto"
 	"crypto/x509"
+	"strings"
+	"time"
 
+	gax "github.com/googleapis/gax-go/v2"
 	"github.com/pkg/errors"
 )
 
@@ -16,14 +19,67 @@ type Options struct {
 	// Path to the credentials file used in CloudCAS
 	CredentialsFile string `json:"credentialsFile"`
 
+	// Endpoint overrides the address of the remote service, it can be used to
+	// connect to an emulator or a private endpoint. It's currently used in
+	// CloudCAS.
+	Endpoint string `json:"endpoint,omitempty"`
+
+	// WithoutAuthentication disables the authentication with the remote
+	// service, it's useful when connecting to an emulator. It's currently used
+	// in CloudCAS.
+	WithoutAuthentication bool `json:"withoutAuthentication,omitempty"`
+
 	// CertificateAuthority reference. In CloudCAS the format is
 	// `projects/*/locations/*/certificateAuthorities/*`.
 	CertificateAuthority string `json:"certificateAuthority"`
 
+	// CheckState enables a check on startup that verifies that the certificate
+	// authority is enabled. It's currently used in CloudCAS.
+	CheckState bool `json:"checkState,omitempty"`
+
+	// KeyUsage and ExtKeyUsage restrict the key usages and extended key usages
+	// of the issued certificates, usages not in these lists are removed from
+	// the certificate templates. They use the same names as the certificate
+	// templates, and they are currently used in CloudCAS.
+	KeyUsage    []string `json:"keyUsage,omitempty"`
+	ExtKeyUsage []string `json:"extKeyUsage,omitempty"`
+
+	// ReusableConfig is the resource name of a reusable config used to create
+	// the certificates instead of the key usages and extensions in the
+	// certificate templates. In CloudCAS the format is
+	// `projects/*/locations/*/reusableConfigs/*`.
+	ReusableConfig string `json:"reusableConfig,omitempty"`
+
+	// CertificateIDPrefix is a prefix added to the generated ids of the
+	// certificates, it can be used to correlate the certificates with external
+	// systems. It's currently used in CloudCAS.
+	CertificateIDPrefix string `json:"certificateIDPrefix,omitempty"`
+
 	// Issuer and signer are the issuer certificate and signer used in SoftCAS.
 	// They are configured in ca.json crt and key properties.
 	Issuer *x509.Certificate `json:"-"`
 	Signer crypto.Signer     `json:"-"`
+
+	// Intermediates are the certificates between the issuer and the root, in
+	// order starting with the parent of the issuer. They're returned after the
+	// issuer in the certificate chain by SoftCAS.
+	Intermediates []*x509.Certificate `json:"-"`
+
+	// Metrics is an optional interface used to record the calls to remote
+	// services. It's currently used in CloudCAS.
+	Metrics Metrics `json:"-"`
+
+	// CallOptions are the options passed to every call to the remote service,
+	// they can be used to set custom retries or deadlines. They're currently
+	// used in CloudCAS.
+	CallOptions []gax.CallOption `json:"-"`
+}
+
+// Metrics is the interface used to record the calls that a CAS makes to a
+// remote service. The method is the name of the remote call, success indicates
+// if the call succeeded, and code is the status code returned by the service.
+type Metrics interface {
+	Observe(method string, success bool, code string, duration time.Duration)
 }
 
 // Validate checks the fields in Options.
@@ -48,3 +104,43 @@ func (o *Options) Is(t Type) bool {
 	}
 	return Type(o.Type).String() == t.String()
 }
+
+// Summary returns a human readable description of the options, useful to debug
+// the configuration of a CAS. It never includes secrets; for the credentials it
+// only shows if they are loaded from a file, from the environment, or not used.
+func (o *Options) Summary() string {
+	if o == nil {
+		return "type=" + SoftCAS
+	}
+
+	parts := []string{"type=" + Type(o.Type).String()}
+	if o.CertificateAuthority != "" {
+		// Google Cloud resource names have the format
+		// projects/*/locations/*/certificateAuthorities/*.
+		if s := strings.Split(o.CertificateAuthority, "/"); len(s) == 6 && s[0] == "projects" && s[2] == "locations" && s[4] == "certificateAuthorities" {
+			parts = append(parts, "project="+s[1], "location="+s[3], "certificateAuthority="+s[5])
+		} else {
+			parts = append(parts, "certificateAuthority="+o.CertificateAuthority)
+		}
+	}
+	if o.Endpoint != "" {
+		parts = append(parts, "endpoint="+o.Endpoint)
+	}
+	if !o.Is(SoftCAS) {
+		switch {
+		case o.WithoutAuthentication:
+			parts = append(parts, "credentials=none")
+		case o.CredentialsFile != "":
+			parts = append(parts, "credentials=file")
+		default:
+			parts = append(parts, "credentials=default")
+		}
+	}
+	if o.Issuer != nil {
+		parts = append(parts, "issuer="+o.Issuer.Subject.CommonName)
+	}
+	if o.Signer != nil {
+		parts = append(parts, "signer=set")
+	}
+	return strings.Join(parts, " ")
+}
@@ -3,7 +3,12 @@ package apiv1
 import (
 	"context"
 	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/x509"
+	"crypto/x509/pkix"
+	"strings"
 	"sync"
 	"testing"
 )
@@ -129,3 +134,36 @@ func TestOptions_Is(t *testing.T) {
 		})
 	}
 }
+
+func TestOptions_Summary(t *testing.T) {
+	issuer := &x509.Certificate{Subject: pkix.Name{CommonName: "Test Intermediate"}}
+	signer, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := "projects/test-project/locations/us-west1/certificateAuthorities/test-ca"
+	tests := []struct {
+		name string
+		opts *Options
+		want string
+	}{
+		{"nil", nil, "type=softcas"},
+		{"empty", &Options{}, "type=softcas"},
+		{"softcas", &Options{Type: "SoftCAS", Issuer: issuer, Signer: signer}, "type=softcas issuer=Test Intermediate signer=set"},
+		{"cloudcas", &Options{Type: CloudCAS, CertificateAuthority: ca}, "type=cloudcas project=test-project location=us-west1 certificateAuthority=test-ca credentials=default"},
+		{"cloudcas credentials", &Options{Type: CloudCAS, CertificateAuthority: ca, CredentialsFile: "/secret/credentials.json"}, "type=cloudcas project=test-project location=us-west1 certificateAuthority=test-ca credentials=file"},
+		{"cloudcas emulator", &Options{Type: CloudCAS, CertificateAuthority: ca, Endpoint: "localhost:8443", WithoutAuthentication: true, CredentialsFile: "/secret/credentials.json"}, "type=cloudcas project=test-project location=us-west1 certificateAuthority=test-ca endpoint=localhost:8443 credentials=none"},
+		{"cloudcas other name", &Options{Type: CloudCAS, CertificateAuthority: "test-ca"}, "type=cloudcas certificateAuthority=test-ca credentials=default"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.opts.Summary()
+			if got != tt.want {
+				t.Errorf("Options.Summary() = %q, want %q", got, tt.want)
+			}
+			if strings.Contains(got, "secret") {
+				t.Errorf("Options.Summary() = %q, contains the credentials file", got)
+			}
+		})
+	}
+}
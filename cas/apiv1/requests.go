@@ -11,6 +11,15 @@ type CreateCertificateRequest struct {
 	Lifetime  time.Duration
 	Backdate  time.Duration
 	RequestID string
+	// CertificateID is the id of the certificate in the CAS. It's currently
+	// used in CloudCAS, if empty a random one will be generated.
+	CertificateID string
+	// CSR is an optional certificate request. It's currently used in
+	// CloudCAS, if the Template is not set, the CSR is sent as it is unless
+	// a reusable config or key usages are configured, then the template is
+	// created from the CSR. If both are set, they must have the same public
+	// key.
+	CSR *x509.CertificateRequest
 }
 
 // CreateCertificateResponse is the response to a create certificate request.
@@ -33,12 +42,15 @@ type RenewCertificateResponse struct {
 	CertificateChain []*x509.Certificate
 }
 
-// RevokeCertificateRequest is the request used to revoke a certificate.
+// RevokeCertificateRequest is the request used to revoke a certificate. In
+// CloudCAS, the CertificateID can be used instead of the Certificate to revoke
+// a certificate by the id in the CAS.
 type RevokeCertificateRequest struct {
-	Certificate *x509.Certificate
-	Reason      string
-	ReasonCode  int
-	RequestID   string
+	Certificate   *x509.Certificate
+	CertificateID string
+	Reason        string
+	ReasonCode    int
+	RequestID     string
 }
 
 // RevokeCertificateResponse is the response to a revoke certificate request.
@@ -51,10 +63,22 @@ type RevokeCertificateResponse struct {
 // certificate from a CAS.
 type GetCertificateAuthorityRequest struct {
 	Name string
+	// NoCache forces the CAS to fetch the certificate authority instead of
+	// using a cached response, if the CAS caches it.
+	NoCache bool
 }
 
 // GetCertificateAuthorityResponse is the response that contains
-// the root certificate.
+// the root certificate and the intermediate certificates, if any.
 type GetCertificateAuthorityResponse struct {
-	RootCertificate *x509.Certificate
+	RootCertificate  *x509.Certificate
+	CertificateChain []*x509.Certificate
+}
+
+// CertificateAuthorityInfo contains the name, state and tier of a certificate
+// authority in a CAS.
+type CertificateAuthorityInfo struct {
+	Name  string
+	State string
+	Tier  string
 }
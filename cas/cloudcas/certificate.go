@@ -7,9 +7,11 @@ import (
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/asn1"
+	"encoding/json"
 	"encoding/pem"
 
 	"github.com/pkg/errors"
+	"go.step.sm/crypto/x509util"
 	pb "google.golang.org/genproto/googleapis/cloud/security/privateca/v1beta1"
 	wrapperspb "google.golang.org/protobuf/types/known/wrapperspb"
 )
@@ -56,6 +58,55 @@ const (
 	nameTypeIP    = 7
 )
 
+var signatureAlgorithmMapping = map[pb.CertificateAuthority_SignHashAlgorithm]x509.SignatureAlgorithm{
+	pb.CertificateAuthority_RSA_PSS_2048_SHA_256: x509.SHA256WithRSAPSS,
+	pb.CertificateAuthority_RSA_PSS_3072_SHA_256: x509.SHA256WithRSAPSS,
+	pb.CertificateAuthority_RSA_PSS_4096_SHA_256: x509.SHA256WithRSAPSS,
+	pb.CertificateAuthority_EC_P256_SHA256:       x509.ECDSAWithSHA256,
+	pb.CertificateAuthority_EC_P384_SHA384:       x509.ECDSAWithSHA384,
+}
+
+// publicKeyAlgorithm returns the type of key that can sign using the given
+// signature algorithm.
+func publicKeyAlgorithm(sa x509.SignatureAlgorithm) x509.PublicKeyAlgorithm {
+	switch sa {
+	case x509.SHA256WithRSA, x509.SHA384WithRSA, x509.SHA512WithRSA,
+		x509.SHA256WithRSAPSS, x509.SHA384WithRSAPSS, x509.SHA512WithRSAPSS:
+		return x509.RSA
+	case x509.ECDSAWithSHA256, x509.ECDSAWithSHA384, x509.ECDSAWithSHA512:
+		return x509.ECDSA
+	case x509.PureEd25519:
+		return x509.Ed25519
+	default:
+		return x509.UnknownPublicKeyAlgorithm
+	}
+}
+
+// parseKeyUsages parses the given key usage and extended key usage names.
+func parseKeyUsages(keyUsage, extKeyUsage []string) (x509.KeyUsage, []x509.ExtKeyUsage, error) {
+	var ku x509util.KeyUsage
+	if len(keyUsage) > 0 {
+		b, err := json.Marshal(keyUsage)
+		if err != nil {
+			return 0, nil, errors.Wrap(err, "error marshaling keyUsage")
+		}
+		if err := ku.UnmarshalJSON(b); err != nil {
+			return 0, nil, errors.Wrap(err, "cloudCAS 'keyUsage' is not valid")
+		}
+	}
+	var eku x509util.ExtKeyUsage
+	if len(extKeyUsage) > 0 {
+		b, err := json.Marshal(extKeyUsage)
+		if err != nil {
+			return 0, nil, errors.Wrap(err, "error marshaling extKeyUsage")
+		}
+		if err := eku.UnmarshalJSON(b); err != nil {
+			return 0, nil, errors.Wrap(err, "cloudCAS 'extKeyUsage' is not valid")
+		}
+	}
+	return x509.KeyUsage(ku), []x509.ExtKeyUsage(eku), nil
+}
+
 func createCertificateConfig(tpl *x509.Certificate) (*pb.Certificate_Config, error) {
 	pk, err := createPublicKey(tpl.PublicKey)
 	if err != nil {
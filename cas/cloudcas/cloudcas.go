@@ -1,11 +1,17 @@
 package cloudcas
 
 import (
+	"bytes"
 	"context"
+	"crypto"
 	"crypto/rand"
 	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/asn1"
 	"encoding/pem"
+	"regexp"
+	"strings"
+	"sync"
 	"time"
 
 	privateca "cloud.google.com/go/security/privateca/apiv1beta1"
@@ -13,9 +19,13 @@ import (
 	gax "github.com/googleapis/gax-go/v2"
 	"github.com/pkg/errors"
 	"github.com/smallstep/certificates/cas/apiv1"
+	"go.step.sm/crypto/x509util"
 	"google.golang.org/api/option"
 	pb "google.golang.org/genproto/googleapis/cloud/security/privateca/v1beta1"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/status"
 	durationpb "google.golang.org/protobuf/types/known/durationpb"
+	fieldmaskpb "google.golang.org/protobuf/types/known/fieldmaskpb"
 )
 
 func init() {
@@ -30,8 +40,30 @@ type CertificateAuthorityClient interface {
 	CreateCertificate(ctx context.Context, req *pb.CreateCertificateRequest, opts ...gax.CallOption) (*pb.Certificate, error)
 	RevokeCertificate(ctx context.Context, req *pb.RevokeCertificateRequest, opts ...gax.CallOption) (*pb.Certificate, error)
 	GetCertificateAuthority(ctx context.Context, req *pb.GetCertificateAuthorityRequest, opts ...gax.CallOption) (*pb.CertificateAuthority, error)
+	FetchCertificateAuthorityCsr(ctx context.Context, req *pb.FetchCertificateAuthorityCsrRequest, opts ...gax.CallOption) (*pb.FetchCertificateAuthorityCsrResponse, error)
+	ListCertificateAuthorities(ctx context.Context, req *pb.ListCertificateAuthoritiesRequest, opts ...gax.CallOption) *privateca.CertificateAuthorityIterator
+	UpdateCertificateAuthority(ctx context.Context, req *pb.UpdateCertificateAuthorityRequest, opts ...gax.CallOption) (*privateca.UpdateCertificateAuthorityOperation, error)
+	ActivateCertificateAuthority(ctx context.Context, req *pb.ActivateCertificateAuthorityRequest, opts ...gax.CallOption) (*privateca.ActivateCertificateAuthorityOperation, error)
 }
 
+// certificateIDRegexp matches the ids allowed by Google CAS.
+var certificateIDRegexp = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,63}$`)
+
+// certificateIDPrefixRegexp matches the prefixes that can be added to a
+// generated id, the prefix and the 36 characters of a UUID cannot exceed the
+// 63 characters allowed in an id.
+var certificateIDPrefixRegexp = regexp.MustCompile(`^[a-zA-Z0-9_-]{0,27}$`)
+
+// labelKeyRegexp and labelValueRegexp match the label keys and values allowed
+// by Google Cloud.
+var (
+	labelKeyRegexp   = regexp.MustCompile(`^[a-z][a-z0-9_-]{0,62}$`)
+	labelValueRegexp = regexp.MustCompile(`^[a-z0-9_-]{0,63}$`)
+)
+
+// reusableConfigRegexp matches the resource name of a reusable config.
+var reusableConfigRegexp = regexp.MustCompile(`^projects/[^/]+/locations/[^/]+/reusableConfigs/[^/]+$`)
+
 // recocationCodeMap maps revocation reason codes from RFC 5280, to Google CAS
 // revocation reasons. Revocation reason 7 is not used, and revocation reason 8
 // (removeFromCRL) is not supported by Google CAS.
@@ -51,22 +83,70 @@ var revocationCodeMap = map[int]pb.RevocationReason{
 type CloudCAS struct {
 	client               CertificateAuthorityClient
 	certificateAuthority string
+	metrics              apiv1.Metrics
+	keyUsage             x509.KeyUsage
+	extKeyUsage          []x509.ExtKeyUsage
+	callOptions          []gax.CallOption
+	reusableConfig       string
+	certificateIDPrefix  string
+	caMutex              sync.Mutex
+	caCache              map[string]*cachedCertificateAuthority
+	caCalls              map[string]*certificateAuthorityCall
 }
 
+// cachedCertificateAuthority is a certificate authority fetched from Google
+// CAS, its parsed certificates, or the error parsing them, and the time it
+// expires. If the request failed, err is the error returned.
+type cachedCertificateAuthority struct {
+	ca       *pb.CertificateAuthority
+	resp     *apiv1.GetCertificateAuthorityResponse
+	parseErr error
+	err      error
+	expiry   time.Time
+}
+
+// certificateAuthorityCall is a request to Google CAS in progress, done is
+// closed once the result is set.
+type certificateAuthorityCall struct {
+	done   chan struct{}
+	result *cachedCertificateAuthority
+}
+
+const (
+	// certificateAuthorityCacheTTL is the time a certificate authority is
+	// cached after it's fetched from Google CAS.
+	certificateAuthorityCacheTTL = 5 * time.Minute
+	// certificateAuthorityErrorTTL is the time a failure fetching a
+	// certificate authority is cached.
+	certificateAuthorityErrorTTL = 10 * time.Second
+)
+
 // newCertificateAuthorityClient creates the certificate authority client. This
 // function is used for testing purposes.
-var newCertificateAuthorityClient = func(ctx context.Context, credentialsFile string) (CertificateAuthorityClient, error) {
-	var cloudOpts []option.ClientOption
-	if credentialsFile != "" {
-		cloudOpts = append(cloudOpts, option.WithCredentialsFile(credentialsFile))
-	}
-	client, err := privateca.NewCertificateAuthorityClient(ctx, cloudOpts...)
+var newCertificateAuthorityClient = func(ctx context.Context, opts apiv1.Options) (CertificateAuthorityClient, error) {
+	client, err := privateca.NewCertificateAuthorityClient(ctx, clientOptions(opts)...)
 	if err != nil {
 		return nil, errors.Wrap(err, "error creating client")
 	}
 	return client, nil
 }
 
+// clientOptions returns the options used to create the certificate authority
+// client. If no endpoint is set the client will use the production one.
+func clientOptions(opts apiv1.Options) []option.ClientOption {
+	var cloudOpts []option.ClientOption
+	if opts.CredentialsFile != "" {
+		cloudOpts = append(cloudOpts, option.WithCredentialsFile(opts.CredentialsFile))
+	}
+	if opts.Endpoint != "" {
+		cloudOpts = append(cloudOpts, option.WithEndpoint(opts.Endpoint))
+	}
+	if opts.WithoutAuthentication {
+		cloudOpts = append(cloudOpts, option.WithoutAuthentication())
+	}
+	return cloudOpts
+}
+
 // New creates a new CertificateAuthorityService implementation using Google
 // Cloud CAS.
 func New(ctx context.Context, opts apiv1.Options) (*CloudCAS, error) {
@@ -74,70 +154,452 @@ func New(ctx context.Context, opts apiv1.Options) (*CloudCAS, error) {
 		return nil, errors.New("cloudCAS 'certificateAuthority' cannot be empty")
 	}
 
-	client, err := newCertificateAuthorityClient(ctx, opts.CredentialsFile)
+	keyUsage, extKeyUsage, err := parseKeyUsages(opts.KeyUsage, opts.ExtKeyUsage)
 	if err != nil {
 		return nil, err
 	}
 
-	return &CloudCAS{
+	if opts.ReusableConfig != "" && !reusableConfigRegexp.MatchString(opts.ReusableConfig) {
+		return nil, errors.Errorf("cloudCAS 'reusableConfig=%s' is not valid, it must have the format projects/*/locations/*/reusableConfigs/*", opts.ReusableConfig)
+	}
+
+	if !certificateIDPrefixRegexp.MatchString(opts.CertificateIDPrefix) {
+		return nil, errors.Errorf("cloudCAS 'certificateIDPrefix=%s' is not valid, it must have at most 27 letters, digits, '-' or '_'", opts.CertificateIDPrefix)
+	}
+
+	client, err := newCertificateAuthorityClient(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &CloudCAS{
 		client:               client,
 		certificateAuthority: opts.CertificateAuthority,
-	}, nil
+		metrics:              opts.Metrics,
+		keyUsage:             keyUsage,
+		extKeyUsage:          extKeyUsage,
+		callOptions:          opts.CallOptions,
+		reusableConfig:       opts.ReusableConfig,
+		certificateIDPrefix:  opts.CertificateIDPrefix,
+	}
+	if opts.CheckState {
+		if err := c.checkState(ctx); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// checkState returns an error if the certificate authority is not enabled.
+func (c *CloudCAS) checkState(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	resp, err := c.client.GetCertificateAuthority(ctx, &pb.GetCertificateAuthorityRequest{
+		Name: c.certificateAuthority,
+	}, c.callOptions...)
+	c.observe("GetCertificateAuthority", start, err)
+	if err != nil {
+		return errors.Wrap(err, "cloudCAS GetCertificateAuthority failed")
+	}
+	if state := resp.GetState(); state != pb.CertificateAuthority_ENABLED {
+		return errors.Errorf("cloudCAS certificate authority %s is not enabled: current state is %s", c.certificateAuthority, state)
+	}
+	return nil
 }
 
-// GetCertificateAuthority returns the root certificate for the given
-// certificate authority. It implements apiv1.CertificateAuthorityGetter
-// interface.
+// GetCertificateAuthority returns the root certificate and the intermediate
+// certificates for the given certificate authority. It implements
+// apiv1.CertificateAuthorityGetter interface.
+//
+// The certificates are cached by name for certificateAuthorityCacheTTL, the
+// request NoCache flag forces them to be fetched again.
 func (c *CloudCAS) GetCertificateAuthority(req *apiv1.GetCertificateAuthorityRequest) (*apiv1.GetCertificateAuthorityResponse, error) {
 	name := req.Name
 	if name == "" {
 		name = c.certificateAuthority
 	}
 
-	ctx, cancel := defaultContext()
-	defer cancel()
-
-	resp, err := c.client.GetCertificateAuthority(ctx, &pb.GetCertificateAuthorityRequest{
-		Name: name,
-	})
+	cached, err := c.getCertificateAuthority(name, req.NoCache)
 	if err != nil {
-		return nil, errors.Wrap(err, "cloudCAS GetCertificateAuthority failed")
+		return nil, err
+	}
+	if cached.parseErr != nil {
+		return nil, cached.parseErr
 	}
-	if len(resp.PemCaCertificates) == 0 {
+	return copyCertificateAuthorityResponse(cached.resp), nil
+}
+
+// parseCertificateAuthority parses the root and intermediate certificates of
+// the given certificate authority.
+func parseCertificateAuthority(ca *pb.CertificateAuthority) (*apiv1.GetCertificateAuthorityResponse, error) {
+	if len(ca.PemCaCertificates) == 0 {
 		return nil, errors.New("cloudCAS GetCertificateAuthority: PemCACertificate should not be empty")
 	}
 
-	// Last certificate in the chain is the root.
-	root, err := parseCertificate(resp.PemCaCertificates[len(resp.PemCaCertificates)-1])
+	// Last certificate in the chain is the root, the rest are intermediates.
+	last := len(ca.PemCaCertificates) - 1
+	root, err := parseCertificate(ca.PemCaCertificates[last])
 	if err != nil {
 		return nil, err
 	}
+	chain := make([]*x509.Certificate, last)
+	for i := 0; i < last; i++ {
+		if chain[i], err = parseCertificate(ca.PemCaCertificates[i]); err != nil {
+			return nil, err
+		}
+	}
 
 	return &apiv1.GetCertificateAuthorityResponse{
-		RootCertificate: root,
+		RootCertificate:  root,
+		CertificateChain: chain,
 	}, nil
 }
 
-// CreateCertificate signs a new certificate using Google Cloud CAS.
-func (c *CloudCAS) CreateCertificate(req *apiv1.CreateCertificateRequest) (*apiv1.CreateCertificateResponse, error) {
+// copyCertificateAuthorityResponse returns a copy of the given response, so
+// callers cannot modify the cached chain.
+func copyCertificateAuthorityResponse(resp *apiv1.GetCertificateAuthorityResponse) *apiv1.GetCertificateAuthorityResponse {
+	return &apiv1.GetCertificateAuthorityResponse{
+		RootCertificate:  resp.RootCertificate,
+		CertificateChain: append([]*x509.Certificate{}, resp.CertificateChain...),
+	}
+}
+
+// GetCertificateAuthorityCSR returns the PEM encoded certificate signing
+// request of the given certificate authority. If the name is empty the
+// configured certificate authority is used. The certificate authority must be
+// a subordinate one waiting to be activated, the CSR can then be signed by an
+// external root.
+func (c *CloudCAS) GetCertificateAuthorityCSR(name string) ([]byte, error) {
+	if name == "" {
+		name = c.certificateAuthority
+	}
+
+	ctx, cancel := defaultContext()
+	defer cancel()
+
+	start := time.Now()
+	resp, err := c.client.FetchCertificateAuthorityCsr(ctx, &pb.FetchCertificateAuthorityCsrRequest{
+		Name: name,
+	}, c.callOptions...)
+	c.observe("FetchCertificateAuthorityCsr", start, err)
+	if err != nil {
+		return nil, errors.Wrap(err, "cloudCAS FetchCertificateAuthorityCsr failed")
+	}
+
+	block, _ := pem.Decode([]byte(resp.PemCsr))
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return nil, errors.New("cloudCAS FetchCertificateAuthorityCsr: PemCsr is not a valid PEM certificate request")
+	}
+	if _, err := x509.ParseCertificateRequest(block.Bytes); err != nil {
+		return nil, errors.Wrap(err, "error parsing certificate request")
+	}
+	return []byte(resp.PemCsr), nil
+}
+
+// ListCertificateAuthorities returns the name, state and tier of all the
+// certificate authorities in the given project and location.
+func (c *CloudCAS) ListCertificateAuthorities(ctx context.Context, project, location string) ([]*apiv1.CertificateAuthorityInfo, error) {
 	switch {
-	case req.Template == nil:
-		return nil, errors.New("createCertificateRequest `template` cannot be nil")
-	case req.Lifetime == 0:
-		return nil, errors.New("createCertificateRequest `lifetime` cannot be 0")
+	case project == "" || strings.Contains(project, "/"):
+		return nil, errors.Errorf("listCertificateAuthorities 'project=%s' is not valid", project)
+	case location == "" || strings.Contains(location, "/"):
+		return nil, errors.Errorf("listCertificateAuthorities 'location=%s' is not valid", location)
+	}
+
+	it := c.client.ListCertificateAuthorities(ctx, &pb.ListCertificateAuthoritiesRequest{
+		Parent: "projects/" + project + "/locations/" + location,
+	}, c.callOptions...)
+
+	// Fetch the pages directly, this allows the client to be easily mocked
+	// and to record the metrics of each call.
+	var infos []*apiv1.CertificateAuthorityInfo
+	var pageToken string
+	for {
+		start := time.Now()
+		cas, nextPageToken, err := it.InternalFetch(0, pageToken)
+		c.observe("ListCertificateAuthorities", start, err)
+		if err != nil {
+			return nil, errors.Wrap(err, "cloudCAS ListCertificateAuthorities failed")
+		}
+		for _, ca := range cas {
+			infos = append(infos, &apiv1.CertificateAuthorityInfo{
+				Name:  ca.GetName(),
+				State: ca.GetState().String(),
+				Tier:  ca.GetTier().String(),
+			})
+		}
+		if nextPageToken == "" {
+			return infos, nil
+		}
+		pageToken = nextPageToken
+	}
+}
+
+// waitUpdateOperation waits for the update of a certificate authority to
+// complete. This variable is used for testing purposes.
+var waitUpdateOperation = func(ctx context.Context, op *privateca.UpdateCertificateAuthorityOperation) (*pb.CertificateAuthority, error) {
+	return op.Wait(ctx)
+}
+
+// UpdateCertificateAuthorityLabels replaces the labels of the given
+// certificate authority, other fields are not modified. If the name is empty
+// the configured certificate authority is used.
+func (c *CloudCAS) UpdateCertificateAuthorityLabels(name string, labels map[string]string) error {
+	if name == "" {
+		name = c.certificateAuthority
+	}
+	for k, v := range labels {
+		if !labelKeyRegexp.MatchString(k) {
+			return errors.Errorf("updateCertificateAuthorityLabels label key '%s' is not valid, it must start with a lowercase letter and have at most 63 lowercase letters, digits, '-' or '_'", k)
+		}
+		if !labelValueRegexp.MatchString(v) {
+			return errors.Errorf("updateCertificateAuthorityLabels label value '%s' is not valid, it must have at most 63 lowercase letters, digits, '-' or '_'", v)
+		}
+	}
+
+	ctx, cancel := defaultContext()
+	defer cancel()
+
+	start := time.Now()
+	op, err := c.client.UpdateCertificateAuthority(ctx, &pb.UpdateCertificateAuthorityRequest{
+		CertificateAuthority: &pb.CertificateAuthority{
+			Name:   name,
+			Labels: labels,
+		},
+		UpdateMask: &fieldmaskpb.FieldMask{
+			Paths: []string{"labels"},
+		},
+	}, c.callOptions...)
+	if err == nil {
+		_, err = waitUpdateOperation(ctx, op)
+	}
+	c.observe("UpdateCertificateAuthority", start, err)
+	if err != nil {
+		return errors.Wrap(err, "cloudCAS UpdateCertificateAuthority failed")
+	}
+	return nil
+}
+
+// waitActivateOperation waits for the activation of a certificate authority
+// to complete. This variable is used for testing purposes.
+var waitActivateOperation = func(ctx context.Context, op *privateca.ActivateCertificateAuthorityOperation) (*pb.CertificateAuthority, error) {
+	return op.Wait(ctx)
+}
+
+// ActivateCertificateAuthority activates a subordinate certificate authority
+// with a certificate signed by an external issuer, for example an offline
+// root. The certificate must be signed with the CSR returned by
+// GetCertificateAuthorityCSR, and the chain must contain its issuer and any
+// other issuer up to the self-signed root. If the name is empty the configured
+// certificate authority is used.
+func (c *CloudCAS) ActivateCertificateAuthority(name string, cert *x509.Certificate, chain []*x509.Certificate) error {
+	switch {
+	case cert == nil:
+		return errors.New("activateCertificateAuthority `certificate` cannot be nil")
+	case !cert.IsCA:
+		return errors.New("activateCertificateAuthority `certificate` is not a certificate authority")
+	case len(chain) == 0:
+		return errors.New("activateCertificateAuthority `chain` cannot be empty")
+	}
+	if name == "" {
+		name = c.certificateAuthority
+	}
+
+	// Google CAS requires the full chain up to a self-signed root.
+	pemChain := make([]string, len(chain))
+	issued := cert
+	for i, crt := range chain {
+		if err := issued.CheckSignatureFrom(crt); err != nil {
+			return errors.Wrapf(err, "activateCertificateAuthority `chain` is not valid: certificate %d is not the issuer of the previous one", i)
+		}
+		pemChain[i] = string(pem.EncodeToMemory(&pem.Block{
+			Type:  "CERTIFICATE",
+			Bytes: crt.Raw,
+		}))
+		issued = crt
+	}
+	if err := issued.CheckSignatureFrom(issued); err != nil {
+		return errors.New("activateCertificateAuthority `chain` is not valid: the last certificate is not a self-signed root")
 	}
 
-	cert, chain, err := c.createCertificate(req.Template, req.Lifetime, req.RequestID)
+	ctx, cancel := defaultContext()
+	defer cancel()
+
+	start := time.Now()
+	op, err := c.client.ActivateCertificateAuthority(ctx, &pb.ActivateCertificateAuthorityRequest{
+		Name: name,
+		PemCaCertificate: string(pem.EncodeToMemory(&pem.Block{
+			Type:  "CERTIFICATE",
+			Bytes: cert.Raw,
+		})),
+		SubordinateConfig: &pb.SubordinateConfig{
+			SubordinateConfig: &pb.SubordinateConfig_PemIssuerChain{
+				PemIssuerChain: &pb.SubordinateConfig_SubordinateConfigChain{
+					PemCertificates: pemChain,
+				},
+			},
+		},
+	}, c.callOptions...)
+	if err == nil {
+		_, err = waitActivateOperation(ctx, op)
+	}
+	c.observe("ActivateCertificateAuthority", start, err)
 	if err != nil {
+		return errors.Wrap(err, "cloudCAS ActivateCertificateAuthority failed")
+	}
+	return nil
+}
+
+// CreateCertificate signs a new certificate using Google Cloud CAS.
+func (c *CloudCAS) CreateCertificate(req *apiv1.CreateCertificateRequest) (*apiv1.CreateCertificateResponse, error) {
+	if err := validateCreateCertificateRequest(req); err != nil {
 		return nil, err
 	}
 
+	id := req.CertificateID
+	if id == "" {
+		var err error
+		if id, err = c.createCertificateID(); err != nil {
+			return nil, err
+		}
+	}
+
+	var cert *x509.Certificate
+	var chain []*x509.Certificate
+	if c.submitCSR(req) {
+		certpb, err := c.newCertificateFromCSR(req.CSR, req.Lifetime, true)
+		if err != nil {
+			return nil, err
+		}
+		if cert, chain, err = c.issueCertificate(certpb, id, req.RequestID); err != nil {
+			return nil, err
+		}
+	} else {
+		tpl, err := certificateTemplate(req)
+		if err != nil {
+			return nil, err
+		}
+		if cert, chain, err = c.createCertificate(tpl, req.Lifetime, id, req.RequestID); err != nil {
+			return nil, err
+		}
+	}
+
 	return &apiv1.CreateCertificateResponse{
 		Certificate:      cert,
 		CertificateChain: chain,
 	}, nil
 }
 
+// DryRunCreateCertificate validates the given request and returns the request
+// that CreateCertificate would send to Google Cloud CAS, without calling it.
+// The checks that require the certificate authority, like the signature
+// algorithm or the maximum lifetime, are skipped.
+func (c *CloudCAS) DryRunCreateCertificate(req *apiv1.CreateCertificateRequest) (*pb.CreateCertificateRequest, error) {
+	if err := validateCreateCertificateRequest(req); err != nil {
+		return nil, err
+	}
+
+	id := req.CertificateID
+	if id == "" {
+		var err error
+		if id, err = c.createCertificateID(); err != nil {
+			return nil, err
+		}
+	}
+
+	var certpb *pb.Certificate
+	if c.submitCSR(req) {
+		var err error
+		if certpb, err = c.newCertificateFromCSR(req.CSR, req.Lifetime, false); err != nil {
+			return nil, err
+		}
+	} else {
+		tpl, err := certificateTemplate(req)
+		if err != nil {
+			return nil, err
+		}
+		// newCertificate modifies the template, a dry run must not.
+		if certpb, err = c.newCertificate(copyTemplate(tpl), req.Lifetime, id, false); err != nil {
+			return nil, err
+		}
+	}
+
+	return c.newCreateCertificateRequest(certpb, id, req.RequestID), nil
+}
+
+// submitCSR returns true if the CSR in the request is sent as it is to Google
+// CAS. This is the case if the request does not have a template and there's
+// no reusable config or key usages configured, these cannot be applied to a
+// CSR.
+func (c *CloudCAS) submitCSR(req *apiv1.CreateCertificateRequest) bool {
+	return req.CSR != nil && req.Template == nil &&
+		c.reusableConfig == "" && c.keyUsage == 0 && len(c.extKeyUsage) == 0
+}
+
+// certificateTemplate returns the template of the certificate to create. If the
+// request has a CSR its signature is verified, and if there's no template one
+// is created from the CSR with the default leaf template.
+func certificateTemplate(req *apiv1.CreateCertificateRequest) (*x509.Certificate, error) {
+	if req.CSR == nil {
+		return req.Template, nil
+	}
+	if err := req.CSR.CheckSignature(); err != nil {
+		return nil, errors.Wrap(err, "createCertificateRequest `csr` signature is not valid")
+	}
+	if req.Template != nil {
+		if !equalPublicKeys(req.Template.PublicKey, req.CSR.PublicKey) {
+			return nil, errors.New("createCertificateRequest `template` and `csr` public keys do not match")
+		}
+		return req.Template, nil
+	}
+	cert, err := x509util.NewCertificate(req.CSR)
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating certificate template from csr")
+	}
+	return cert.GetCertificate(), nil
+}
+
+// copyTemplate returns a copy of the given template with its own extensions
+// and extended key usages, so it can be modified without changing the
+// original.
+func copyTemplate(tpl *x509.Certificate) *x509.Certificate {
+	cp := *tpl
+	cp.ExtraExtensions = append([]pkix.Extension(nil), tpl.ExtraExtensions...)
+	cp.ExtKeyUsage = append([]x509.ExtKeyUsage(nil), tpl.ExtKeyUsage...)
+	cp.UnknownExtKeyUsage = append([]asn1.ObjectIdentifier(nil), tpl.UnknownExtKeyUsage...)
+	return &cp
+}
+
+// equalPublicKeys returns true if both public keys are the same.
+func equalPublicKeys(a, b crypto.PublicKey) bool {
+	ab, err := x509.MarshalPKIXPublicKey(a)
+	if err != nil {
+		return false
+	}
+	bb, err := x509.MarshalPKIXPublicKey(b)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(ab, bb)
+}
+
+// validateCreateCertificateRequest checks the required fields of a create
+// certificate request.
+func validateCreateCertificateRequest(req *apiv1.CreateCertificateRequest) error {
+	switch {
+	case req.Template == nil && req.CSR == nil:
+		return errors.New("createCertificateRequest `template` or `csr` are required")
+	case req.Lifetime == 0:
+		return errors.New("createCertificateRequest `lifetime` cannot be 0")
+	case req.CertificateID != "" && !certificateIDRegexp.MatchString(req.CertificateID):
+		return errors.Errorf("createCertificateRequest `certificateID=%s` is not valid, it must have at most 63 letters, digits, '-' or '_'", req.CertificateID)
+	default:
+		return nil
+	}
+}
+
 // RenewCertificate renews the given certificate using Google Cloud CAS.
 // Google's CAS does not support the renew operation, so this method uses
 // CreateCertificate.
@@ -149,7 +611,12 @@ func (c *CloudCAS) RenewCertificate(req *apiv1.RenewCertificateRequest) (*apiv1.
 		return nil, errors.New("renewCertificateRequest `lifetime` cannot be 0")
 	}
 
-	cert, chain, err := c.createCertificate(req.Template, req.Lifetime, req.RequestID)
+	id, err := c.createCertificateID()
+	if err != nil {
+		return nil, err
+	}
+
+	cert, chain, err := c.createCertificate(req.Template, req.Lifetime, id, req.RequestID)
 	if err != nil {
 		return nil, err
 	}
@@ -164,32 +631,39 @@ func (c *CloudCAS) RenewCertificate(req *apiv1.RenewCertificateRequest) (*apiv1.
 func (c *CloudCAS) RevokeCertificate(req *apiv1.RevokeCertificateRequest) (*apiv1.RevokeCertificateResponse, error) {
 	reason, ok := revocationCodeMap[req.ReasonCode]
 	switch {
+	case req.ReasonCode == 7:
+		return nil, errors.New("revokeCertificate 'reasonCode=7' is invalid: reason code 7 is unassigned in RFC 5280")
+	case req.ReasonCode == 8:
+		return nil, errors.New("revokeCertificate 'reasonCode=8' is not supported: removeFromCRL is not supported by Google CAS")
 	case !ok:
 		return nil, errors.Errorf("revokeCertificate 'reasonCode=%d' is invalid or not supported", req.ReasonCode)
-	case req.Certificate == nil:
-		return nil, errors.New("revokeCertificateRequest `certificate` cannot be nil")
+	case req.Certificate == nil && req.CertificateID == "":
+		return nil, errors.New("revokeCertificateRequest `certificate` or `certificateID` are required")
+	case strings.Contains(req.CertificateID, "/"):
+		return nil, errors.Errorf("revokeCertificateRequest `certificateID=%s` is not valid", req.CertificateID)
 	}
 
-	ext, ok := apiv1.FindCertificateAuthorityExtension(req.Certificate)
-	if !ok {
-		return nil, errors.New("error revoking certificate: certificate authority extension was not found")
-	}
-
-	var cae apiv1.CertificateAuthorityExtension
-	if _, err := asn1.Unmarshal(ext.Value, &cae); err != nil {
-		return nil, errors.Wrap(err, "error unmarshaling certificate authority extension")
+	certificateID := req.CertificateID
+	if certificateID == "" {
+		id, err := getCertificateID(req.Certificate)
+		if err != nil {
+			return nil, err
+		}
+		certificateID = id
 	}
 
 	ctx, cancel := defaultContext()
 	defer cancel()
 
+	start := time.Now()
 	certpb, err := c.client.RevokeCertificate(ctx, &pb.RevokeCertificateRequest{
-		Name:      c.certificateAuthority + "/certificates/" + cae.CertificateID,
+		Name:      c.certificateAuthority + "/certificates/" + certificateID,
 		Reason:    reason,
 		RequestId: req.RequestID,
-	})
+	}, c.callOptions...)
+	c.observe("RevokeCertificate", start, err)
 	if err != nil {
-		return nil, errors.Wrap(err, "cloudCAS RevokeCertificate failed")
+		return nil, wrapError(err, "RevokeCertificate", c.certificateAuthority+"/certificates/"+certificateID, req.RequestID)
 	}
 
 	cert, chain, err := getCertificateAndChain(certpb)
@@ -203,52 +677,320 @@ func (c *CloudCAS) RevokeCertificate(req *apiv1.RevokeCertificateRequest) (*apiv
 	}, nil
 }
 
-func (c *CloudCAS) createCertificate(tpl *x509.Certificate, lifetime time.Duration, requestID string) (*x509.Certificate, []*x509.Certificate, error) {
-	// Removes the CAS extension if it exists.
-	apiv1.RemoveCertificateAuthorityExtension(tpl)
+// getCertificateID returns the id in the CAS of the given certificate. The id
+// is stored in the CAS extension.
+func getCertificateID(cert *x509.Certificate) (string, error) {
+	ext, ok := apiv1.FindCertificateAuthorityExtension(cert)
+	if !ok {
+		return "", errors.New("error revoking certificate: certificate authority extension was not found")
+	}
 
-	// Create new CAS extension with the certificate id.
-	id, err := createCertificateID()
+	var cae apiv1.CertificateAuthorityExtension
+	if _, err := asn1.Unmarshal(ext.Value, &cae); err != nil {
+		return "", errors.Wrap(err, "error unmarshaling certificate authority extension")
+	}
+	return cae.CertificateID, nil
+}
+
+func (c *CloudCAS) createCertificate(tpl *x509.Certificate, lifetime time.Duration, id, requestID string) (*x509.Certificate, []*x509.Certificate, error) {
+	certpb, err := c.newCertificate(tpl, lifetime, id, true)
 	if err != nil {
 		return nil, nil, err
 	}
+	return c.issueCertificate(certpb, id, requestID)
+}
+
+// newCertificate returns the certificate to create from the given template.
+// If validate is true, the signature algorithm and the lifetime are checked
+// against the certificate authority.
+func (c *CloudCAS) newCertificate(tpl *x509.Certificate, lifetime time.Duration, id string, validate bool) (*pb.Certificate, error) {
+	// Removes the CAS extension if it exists.
+	apiv1.RemoveCertificateAuthorityExtension(tpl)
+
+	// Create new CAS extension with the certificate id.
 	casExtension, err := apiv1.CreateCertificateAuthorityExtension(apiv1.CloudCAS, id)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 	tpl.ExtraExtensions = append(tpl.ExtraExtensions, casExtension)
 
+	// Remove the usages not allowed by the configuration.
+	c.restrictKeyUsages(tpl)
+
+	if validate {
+		// Google CAS signs with the algorithm of the CA key, so a requested
+		// signature algorithm can only be honored if it matches that key.
+		if tpl.SignatureAlgorithm != x509.UnknownSignatureAlgorithm {
+			if err := c.validateSignatureAlgorithm(tpl.SignatureAlgorithm); err != nil {
+				return nil, err
+			}
+		}
+
+		// Fail early with a clear error if the lifetime is not allowed.
+		if err := c.validateLifetime(lifetime); err != nil {
+			return nil, err
+		}
+	}
+
 	// Create and submit certificate
 	certConfig, err := createCertificateConfig(tpl)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
+	}
+	// Use the configured reusable config instead of the template values.
+	if c.reusableConfig != "" {
+		certConfig.Config.ReusableConfig = &pb.ReusableConfigWrapper{
+			ConfigValues: &pb.ReusableConfigWrapper_ReusableConfig{
+				ReusableConfig: c.reusableConfig,
+			},
+		}
 	}
 
-	ctx, cancel := defaultContext()
-	defer cancel()
+	return &pb.Certificate{
+		CertificateConfig: certConfig,
+		Lifetime:          durationpb.New(lifetime),
+		Labels:            map[string]string{},
+	}, nil
+}
 
-	cert, err := c.client.CreateCertificate(ctx, &pb.CreateCertificateRequest{
+// newCertificateFromCSR returns the certificate to create from the given
+// certificate request, the subject, SANs and public key are taken from the CSR
+// by Google CAS. The certificate will not have the CAS extension, so it can
+// only be revoked using its certificate id. If validate is true, the lifetime
+// is checked against the certificate authority.
+func (c *CloudCAS) newCertificateFromCSR(csr *x509.CertificateRequest, lifetime time.Duration, validate bool) (*pb.Certificate, error) {
+	if err := csr.CheckSignature(); err != nil {
+		return nil, errors.Wrap(err, "createCertificateRequest `csr` signature is not valid")
+	}
+
+	// Fail early with a clear error if the lifetime is not allowed.
+	if validate {
+		if err := c.validateLifetime(lifetime); err != nil {
+			return nil, err
+		}
+	}
+
+	return &pb.Certificate{
+		CertificateConfig: &pb.Certificate_PemCsr{
+			PemCsr: string(pem.EncodeToMemory(&pem.Block{
+				Type:  "CERTIFICATE REQUEST",
+				Bytes: csr.Raw,
+			})),
+		},
+		Lifetime: durationpb.New(lifetime),
+		Labels:   map[string]string{},
+	}, nil
+}
+
+// newCreateCertificateRequest returns the request to create the given
+// certificate in the configured certificate authority.
+func (c *CloudCAS) newCreateCertificateRequest(certpb *pb.Certificate, id, requestID string) *pb.CreateCertificateRequest {
+	return &pb.CreateCertificateRequest{
 		Parent:        c.certificateAuthority,
 		CertificateId: id,
-		Certificate: &pb.Certificate{
-			CertificateConfig: certConfig,
-			Lifetime:          durationpb.New(lifetime),
-			Labels:            map[string]string{},
-		},
-		RequestId: requestID,
-	})
+		Certificate:   certpb,
+		RequestId:     requestID,
+	}
+}
+
+// issueCertificate submits the given certificate to Google CAS and returns
+// the certificate and its chain.
+func (c *CloudCAS) issueCertificate(certpb *pb.Certificate, id, requestID string) (*x509.Certificate, []*x509.Certificate, error) {
+	ctx, cancel := defaultContext()
+	defer cancel()
+
+	start := time.Now()
+	cert, err := c.client.CreateCertificate(ctx, c.newCreateCertificateRequest(certpb, id, requestID), c.callOptions...)
+	c.observe("CreateCertificate", start, err)
 	if err != nil {
-		return nil, nil, errors.Wrap(err, "cloudCAS CreateCertificate failed")
+		return nil, nil, wrapError(err, "CreateCertificate", c.certificateAuthority+"/certificates/"+id, requestID)
 	}
 
 	// Return certificate and certificate chain
 	return getCertificateAndChain(cert)
 }
 
+// wrapError wraps an error returned by Google CAS adding the name of the
+// resource, the request id sent, and the request id assigned by Google if the
+// error contains it. These ids are required to troubleshoot the request with
+// Google support.
+func wrapError(err error, method, name, requestID string) error {
+	var ids []string
+	if name != "" {
+		ids = append(ids, "name="+name)
+	}
+	if requestID != "" {
+		ids = append(ids, "requestId="+requestID)
+	}
+	if st, ok := status.FromError(err); ok {
+		for _, d := range st.Details() {
+			if info, ok := d.(*errdetails.RequestInfo); ok && info.RequestId != "" {
+				ids = append(ids, "gcpRequestId="+info.RequestId)
+			}
+		}
+	}
+	if len(ids) == 0 {
+		return errors.Wrapf(err, "cloudCAS %s failed", method)
+	}
+	return errors.Wrapf(err, "cloudCAS %s failed [%s]", method, strings.Join(ids, ", "))
+}
+
+// restrictKeyUsages removes from the template the key usages and extended key
+// usages that are not in the configured ones.
+func (c *CloudCAS) restrictKeyUsages(tpl *x509.Certificate) {
+	if c.keyUsage != 0 {
+		tpl.KeyUsage &= c.keyUsage
+	}
+	if len(c.extKeyUsage) > 0 {
+		var ekus []x509.ExtKeyUsage
+		for _, eku := range tpl.ExtKeyUsage {
+			for _, allowed := range c.extKeyUsage {
+				if eku == allowed {
+					ekus = append(ekus, eku)
+					break
+				}
+			}
+		}
+		tpl.ExtKeyUsage = ekus
+		tpl.UnknownExtKeyUsage = nil
+	}
+}
+
+// validateSignatureAlgorithm checks that the given signature algorithm is the
+// one used by the certificate authority key. If the key is in Cloud KMS the
+// exact algorithm is not known and only the key type is validated.
+func (c *CloudCAS) validateSignatureAlgorithm(sa x509.SignatureAlgorithm) error {
+	cached, err := c.getCertificateAuthority(c.certificateAuthority, false)
+	if err != nil {
+		return err
+	}
+	ca := cached.ca
+
+	if alg, ok := signatureAlgorithmMapping[ca.GetKeySpec().GetAlgorithm()]; ok {
+		if alg != sa {
+			return errors.Errorf("cloudCAS certificate authority does not support signature algorithm %s, it uses %s", sa, alg)
+		}
+		return nil
+	}
+
+	if len(ca.PemCaCertificates) == 0 {
+		return errors.New("cloudCAS GetCertificateAuthority: PemCACertificate should not be empty")
+	}
+	cert, err := parseCertificate(ca.PemCaCertificates[0])
+	if err != nil {
+		return err
+	}
+	if publicKeyAlgorithm(sa) != cert.PublicKeyAlgorithm {
+		return errors.Errorf("cloudCAS certificate authority does not support signature algorithm %s with a %s key", sa, cert.PublicKeyAlgorithm)
+	}
+	return nil
+}
+
+// validateLifetime returns an error if the given lifetime is greater than the
+// maximum lifetime allowed by the certificate authority.
+func (c *CloudCAS) validateLifetime(lifetime time.Duration) error {
+	cached, err := c.getCertificateAuthority(c.certificateAuthority, false)
+	if err != nil {
+		return err
+	}
+	if max := cached.ca.GetCertificatePolicy().GetMaximumLifetime(); max != nil {
+		if d := max.AsDuration(); d > 0 && lifetime > d {
+			return errors.Errorf("cloudCAS certificate lifetime %s exceeds the maximum lifetime %s allowed by the certificate authority", lifetime, d)
+		}
+	}
+	return nil
+}
+
+// getCertificateAuthority returns the certificate authority with the given
+// name. The response is cached for certificateAuthorityCacheTTL to avoid a
+// request to Google CAS on every certificate, if noCache is true it's always
+// fetched and the cache is refreshed. Failures are cached for a shorter time,
+// but they never replace a valid response.
+//
+// The lock is not held during the request, concurrent calls for the same name
+// wait for the request in progress instead of sending a new one.
+func (c *CloudCAS) getCertificateAuthority(name string, noCache bool) (*cachedCertificateAuthority, error) {
+	c.caMutex.Lock()
+	if cached, ok := c.caCache[name]; ok && !noCache && time.Now().Before(cached.expiry) {
+		c.caMutex.Unlock()
+		return cached, cached.err
+	}
+	if call, ok := c.caCalls[name]; ok {
+		c.caMutex.Unlock()
+		<-call.done
+		return call.result, call.result.err
+	}
+	call := &certificateAuthorityCall{done: make(chan struct{})}
+	if c.caCalls == nil {
+		c.caCalls = make(map[string]*certificateAuthorityCall)
+	}
+	c.caCalls[name] = call
+	c.caMutex.Unlock()
+
+	call.result = c.fetchCertificateAuthority(name)
+
+	c.caMutex.Lock()
+	delete(c.caCalls, name)
+	if c.caCache == nil {
+		c.caCache = make(map[string]*cachedCertificateAuthority)
+	}
+	if cached, ok := c.caCache[name]; call.result.err == nil || !ok || cached.err != nil || time.Now().After(cached.expiry) {
+		c.caCache[name] = call.result
+	}
+	c.caMutex.Unlock()
+	close(call.done)
+
+	return call.result, call.result.err
+}
+
+// fetchCertificateAuthority gets the certificate authority with the given name
+// from Google CAS.
+func (c *CloudCAS) fetchCertificateAuthority(name string) *cachedCertificateAuthority {
+	ctx, cancel := defaultContext()
+	defer cancel()
+
+	start := time.Now()
+	ca, err := c.client.GetCertificateAuthority(ctx, &pb.GetCertificateAuthorityRequest{
+		Name: name,
+	}, c.callOptions...)
+	c.observe("GetCertificateAuthority", start, err)
+	if err != nil {
+		return &cachedCertificateAuthority{
+			err:    errors.Wrap(err, "cloudCAS GetCertificateAuthority failed"),
+			expiry: time.Now().Add(certificateAuthorityErrorTTL),
+		}
+	}
+
+	cached := &cachedCertificateAuthority{
+		ca:     ca,
+		expiry: time.Now().Add(certificateAuthorityCacheTTL),
+	}
+	cached.resp, cached.parseErr = parseCertificateAuthority(ca)
+	return cached
+}
+
+// observe records the result and the duration of a call to Google Cloud CAS
+// if metrics are enabled.
+func (c *CloudCAS) observe(method string, start time.Time, err error) {
+	if c.metrics != nil {
+		c.metrics.Observe(method, err == nil, status.Code(err).String(), time.Since(start))
+	}
+}
+
 func defaultContext() (context.Context, context.CancelFunc) {
 	return context.WithTimeout(context.Background(), 15*time.Second)
 }
 
+// createCertificateID generates a new certificate id with the configured
+// prefix.
+func (c *CloudCAS) createCertificateID() (string, error) {
+	id, err := createCertificateID()
+	if err != nil {
+		return "", err
+	}
+	return c.certificateIDPrefix + id, nil
+}
+
 func createCertificateID() (string, error) {
 	id, err := uuid.NewRandomFromReader(rand.Reader)
 	if err != nil {
@@ -275,7 +1017,12 @@ func getCertificateAndChain(certpb *pb.Certificate) (*x509.Certificate, []*x509.
 		return nil, nil, err
 	}
 
-	pemChain := certpb.PemCertificateChain[:len(certpb.PemCertificateChain)-1]
+	// The last certificate in the chain is the root, the chain might be empty
+	// if the certificate was issued directly by the root.
+	var pemChain []string
+	if n := len(certpb.PemCertificateChain); n > 0 {
+		pemChain = certpb.PemCertificateChain[:n-1]
+	}
 	chain := make([]*x509.Certificate, len(pemChain))
 	for i := range pemChain {
 		chain[i], err = parseCertificate(pemChain[i])
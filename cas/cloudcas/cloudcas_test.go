@@ -3,20 +3,36 @@ package cloudcas
 import (
 	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
 	"io"
+	"math/big"
 	"os"
 	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	privateca "cloud.google.com/go/security/privateca/apiv1beta1"
 	"github.com/google/uuid"
 	gax "github.com/googleapis/gax-go/v2"
 	"github.com/pkg/errors"
 	"github.com/smallstep/certificates/cas/apiv1"
+	"google.golang.org/api/option"
 	pb "google.golang.org/genproto/googleapis/cloud/security/privateca/v1beta1"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	durationpb "google.golang.org/protobuf/types/known/durationpb"
 )
 
 var (
@@ -78,6 +94,17 @@ type testClient struct {
 	certificate          *pb.Certificate
 	certificateAuthority *pb.CertificateAuthority
 	err                  error
+	createRequest        *pb.CreateCertificateRequest
+	revokeRequest        *pb.RevokeCertificateRequest
+	fetchCsrRequest      *pb.FetchCertificateAuthorityCsrRequest
+	pemCsr               string
+	listRequest          *pb.ListCertificateAuthoritiesRequest
+	listPages            [][]*pb.CertificateAuthority
+	listPageTokens       []string
+	updateRequest        *pb.UpdateCertificateAuthorityRequest
+	activateRequest      *pb.ActivateCertificateAuthorityRequest
+	getCalls             int
+	callOptions          []gax.CallOption
 }
 
 func newTestClient(credentialsFile string) (CertificateAuthorityClient, error) {
@@ -134,17 +161,82 @@ func setTeeReader(t *testing.T, w *bytes.Buffer) {
 }
 
 func (c *testClient) CreateCertificate(ctx context.Context, req *pb.CreateCertificateRequest, opts ...gax.CallOption) (*pb.Certificate, error) {
+	c.callOptions = opts
+	c.createRequest = req
 	return c.certificate, c.err
 }
 
 func (c *testClient) RevokeCertificate(ctx context.Context, req *pb.RevokeCertificateRequest, opts ...gax.CallOption) (*pb.Certificate, error) {
+	c.callOptions = opts
+	c.revokeRequest = req
 	return c.certificate, c.err
 }
 
 func (c *testClient) GetCertificateAuthority(ctx context.Context, req *pb.GetCertificateAuthorityRequest, opts ...gax.CallOption) (*pb.CertificateAuthority, error) {
+	c.callOptions = opts
+	c.getCalls++
 	return c.certificateAuthority, c.err
 }
 
+func (c *testClient) FetchCertificateAuthorityCsr(ctx context.Context, req *pb.FetchCertificateAuthorityCsrRequest, opts ...gax.CallOption) (*pb.FetchCertificateAuthorityCsrResponse, error) {
+	c.callOptions = opts
+	c.fetchCsrRequest = req
+	if c.err != nil {
+		return nil, c.err
+	}
+	return &pb.FetchCertificateAuthorityCsrResponse{
+		PemCsr: c.pemCsr,
+	}, nil
+}
+
+// ListCertificateAuthorities returns an iterator over listPages, the token of a
+// page is its index in listPages.
+func (c *testClient) ListCertificateAuthorities(ctx context.Context, req *pb.ListCertificateAuthoritiesRequest, opts ...gax.CallOption) *privateca.CertificateAuthorityIterator {
+	c.callOptions = opts
+	c.listRequest = req
+	it := &privateca.CertificateAuthorityIterator{}
+	it.InternalFetch = func(pageSize int, pageToken string) ([]*pb.CertificateAuthority, string, error) {
+		c.listPageTokens = append(c.listPageTokens, pageToken)
+		if c.err != nil {
+			return nil, "", c.err
+		}
+		var i int
+		if pageToken != "" {
+			var err error
+			if i, err = strconv.Atoi(pageToken); err != nil || i >= len(c.listPages) {
+				return nil, "", errors.Errorf("invalid page token %s", pageToken)
+			}
+		}
+		if i >= len(c.listPages) {
+			return nil, "", nil
+		}
+		var next string
+		if i+1 < len(c.listPages) {
+			next = strconv.Itoa(i + 1)
+		}
+		return c.listPages[i], next, nil
+	}
+	return it
+}
+
+func (c *testClient) UpdateCertificateAuthority(ctx context.Context, req *pb.UpdateCertificateAuthorityRequest, opts ...gax.CallOption) (*privateca.UpdateCertificateAuthorityOperation, error) {
+	c.callOptions = opts
+	c.updateRequest = req
+	if c.err != nil {
+		return nil, c.err
+	}
+	return &privateca.UpdateCertificateAuthorityOperation{}, nil
+}
+
+func (c *testClient) ActivateCertificateAuthority(ctx context.Context, req *pb.ActivateCertificateAuthorityRequest, opts ...gax.CallOption) (*privateca.ActivateCertificateAuthorityOperation, error) {
+	c.callOptions = opts
+	c.activateRequest = req
+	if c.err != nil {
+		return nil, c.err
+	}
+	return &privateca.ActivateCertificateAuthorityOperation{}, nil
+}
+
 func mustParseCertificate(t *testing.T, pemCert string) *x509.Certificate {
 	t.Helper()
 	crt, err := parseCertificate(pemCert)
@@ -156,8 +248,8 @@ func mustParseCertificate(t *testing.T, pemCert string) *x509.Certificate {
 
 func TestNew(t *testing.T) {
 	tmp := newCertificateAuthorityClient
-	newCertificateAuthorityClient = func(ctx context.Context, credentialsFile string) (CertificateAuthorityClient, error) {
-		return newTestClient(credentialsFile)
+	newCertificateAuthorityClient = func(ctx context.Context, opts apiv1.Options) (CertificateAuthorityClient, error) {
+		return newTestClient(opts.CredentialsFile)
 	}
 	t.Cleanup(func() {
 		newCertificateAuthorityClient = tmp
@@ -185,7 +277,44 @@ func TestNew(t *testing.T) {
 			client:               &testClient{credentialsFile: "testdata/credentials.json"},
 			certificateAuthority: testAuthorityName,
 		}, false},
+		{"ok with metrics", args{context.Background(), apiv1.Options{
+			CertificateAuthority: testAuthorityName, Metrics: &testMetrics{},
+		}}, &CloudCAS{
+			client:               &testClient{},
+			certificateAuthority: testAuthorityName,
+			metrics:              &testMetrics{},
+		}, false},
+		{"ok with key usages", args{context.Background(), apiv1.Options{
+			CertificateAuthority: testAuthorityName,
+			KeyUsage:             []string{"digitalSignature", "keyEncipherment"},
+			ExtKeyUsage:          []string{"serverAuth"},
+		}}, &CloudCAS{
+			client:               &testClient{},
+			certificateAuthority: testAuthorityName,
+			keyUsage:             x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+			extKeyUsage:          []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}, false},
+		{"ok with reusable config", args{context.Background(), apiv1.Options{
+			CertificateAuthority: testAuthorityName,
+			ReusableConfig:       "projects/test-project/locations/us-west1/reusableConfigs/leaf-server-tls",
+		}}, &CloudCAS{
+			client:               &testClient{},
+			certificateAuthority: testAuthorityName,
+			reusableConfig:       "projects/test-project/locations/us-west1/reusableConfigs/leaf-server-tls",
+		}, false},
 		{"fail certificate authority", args{context.Background(), apiv1.Options{}}, nil, true},
+		{"fail reusable config", args{context.Background(), apiv1.Options{
+			CertificateAuthority: testAuthorityName, ReusableConfig: "leaf-server-tls",
+		}}, nil, true},
+		{"fail reusable config format", args{context.Background(), apiv1.Options{
+			CertificateAuthority: testAuthorityName, ReusableConfig: "projects/test-project/locations/us-west1/reusableConfigs/",
+		}}, nil, true},
+		{"fail key usage", args{context.Background(), apiv1.Options{
+			CertificateAuthority: testAuthorityName, KeyUsage: []string{"foo"},
+		}}, nil, true},
+		{"fail ext key usage", args{context.Background(), apiv1.Options{
+			CertificateAuthority: testAuthorityName, ExtKeyUsage: []string{"bar"},
+		}}, nil, true},
 		{"fail with credentials", args{context.Background(), apiv1.Options{
 			CertificateAuthority: testAuthorityName, CredentialsFile: "testdata/error.json",
 		}}, nil, true},
@@ -204,10 +333,106 @@ func TestNew(t *testing.T) {
 	}
 }
 
+func TestNew_endpoint(t *testing.T) {
+	tmp := newCertificateAuthorityClient
+	t.Cleanup(func() {
+		newCertificateAuthorityClient = tmp
+	})
+
+	var got apiv1.Options
+	newCertificateAuthorityClient = func(ctx context.Context, opts apiv1.Options) (CertificateAuthorityClient, error) {
+		got = opts
+		return okTestClient(), nil
+	}
+	if _, err := New(context.Background(), apiv1.Options{
+		CertificateAuthority:  testAuthorityName,
+		Endpoint:              "localhost:8443",
+		WithoutAuthentication: true,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	want := []option.ClientOption{option.WithEndpoint("localhost:8443"), option.WithoutAuthentication()}
+	if opts := clientOptions(got); !reflect.DeepEqual(opts, want) {
+		t.Errorf("clientOptions() = %v, want %v", opts, want)
+	}
+}
+
+func Test_clientOptions(t *testing.T) {
+	tests := []struct {
+		name string
+		opts apiv1.Options
+		want []option.ClientOption
+	}{
+		{"ok default", apiv1.Options{}, nil},
+		{"ok credentials", apiv1.Options{CredentialsFile: "testdata/credentials.json"}, []option.ClientOption{
+			option.WithCredentialsFile("testdata/credentials.json"),
+		}},
+		{"ok endpoint", apiv1.Options{Endpoint: "privateca.example.com:443"}, []option.ClientOption{
+			option.WithEndpoint("privateca.example.com:443"),
+		}},
+		{"ok emulator", apiv1.Options{Endpoint: "localhost:8443", WithoutAuthentication: true}, []option.ClientOption{
+			option.WithEndpoint("localhost:8443"), option.WithoutAuthentication(),
+		}},
+		{"ok all", apiv1.Options{CredentialsFile: "testdata/credentials.json", Endpoint: "localhost:8443", WithoutAuthentication: true}, []option.ClientOption{
+			option.WithCredentialsFile("testdata/credentials.json"), option.WithEndpoint("localhost:8443"), option.WithoutAuthentication(),
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := clientOptions(tt.opts); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("clientOptions() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNew_checkState(t *testing.T) {
+	tmp := newCertificateAuthorityClient
+	t.Cleanup(func() {
+		newCertificateAuthorityClient = tmp
+	})
+
+	withState := func(state pb.CertificateAuthority_State) *testClient {
+		client := okTestClient()
+		client.certificateAuthority.State = state
+		return client
+	}
+
+	tests := []struct {
+		name       string
+		client     *testClient
+		checkState bool
+		wantErr    bool
+	}{
+		{"ok enabled", withState(pb.CertificateAuthority_ENABLED), true, false},
+		{"ok disabled without check", withState(pb.CertificateAuthority_DISABLED), false, false},
+		{"fail disabled", withState(pb.CertificateAuthority_DISABLED), true, true},
+		{"fail pending", withState(pb.CertificateAuthority_PENDING_ACTIVATION), true, true},
+		{"fail GetCertificateAuthority", failTestClient(), true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newCertificateAuthorityClient = func(ctx context.Context, opts apiv1.Options) (CertificateAuthorityClient, error) {
+				return tt.client, nil
+			}
+			got, err := New(context.Background(), apiv1.Options{
+				CertificateAuthority: testAuthorityName,
+				CheckState:           tt.checkState,
+			})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("New() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got.client != tt.client {
+				t.Errorf("New() client = %v, want %v", got.client, tt.client)
+			}
+		})
+	}
+}
+
 func TestNew_register(t *testing.T) {
 	tmp := newCertificateAuthorityClient
-	newCertificateAuthorityClient = func(ctx context.Context, credentialsFile string) (CertificateAuthorityClient, error) {
-		return newTestClient(credentialsFile)
+	newCertificateAuthorityClient = func(ctx context.Context, opts apiv1.Options) (CertificateAuthorityClient, error) {
+		return newTestClient(opts.CredentialsFile)
 	}
 	t.Cleanup(func() {
 		newCertificateAuthorityClient = tmp
@@ -276,6 +501,8 @@ func TestNew_real(t *testing.T) {
 
 func TestCloudCAS_GetCertificateAuthority(t *testing.T) {
 	root := mustParseCertificate(t, testRootCertificate)
+	intermediate := mustParseCertificate(t, testIntermediateCertificate)
+	leaf := mustParseCertificate(t, testLeafCertificate)
 	type fields struct {
 		client               CertificateAuthorityClient
 		certificateAuthority string
@@ -291,15 +518,32 @@ func TestCloudCAS_GetCertificateAuthority(t *testing.T) {
 		wantErr bool
 	}{
 		{"ok", fields{okTestClient(), testCertificateName}, args{&apiv1.GetCertificateAuthorityRequest{}}, &apiv1.GetCertificateAuthorityResponse{
-			RootCertificate: root,
+			RootCertificate:  root,
+			CertificateChain: []*x509.Certificate{intermediate},
 		}, false},
 		{"ok with name", fields{okTestClient(), testCertificateName}, args{&apiv1.GetCertificateAuthorityRequest{
 			Name: testCertificateName,
 		}}, &apiv1.GetCertificateAuthorityResponse{
-			RootCertificate: root,
+			RootCertificate:  root,
+			CertificateChain: []*x509.Certificate{intermediate},
+		}, false},
+		{"ok multiple intermediates", fields{&testClient{certificateAuthority: &pb.CertificateAuthority{
+			PemCaCertificates: []string{testLeafCertificate, testIntermediateCertificate, testRootCertificate},
+		}}, testCertificateName}, args{&apiv1.GetCertificateAuthorityRequest{}}, &apiv1.GetCertificateAuthorityResponse{
+			RootCertificate:  root,
+			CertificateChain: []*x509.Certificate{leaf, intermediate},
+		}, false},
+		{"ok root only", fields{&testClient{certificateAuthority: &pb.CertificateAuthority{
+			PemCaCertificates: []string{testRootCertificate},
+		}}, testCertificateName}, args{&apiv1.GetCertificateAuthorityRequest{}}, &apiv1.GetCertificateAuthorityResponse{
+			RootCertificate:  root,
+			CertificateChain: []*x509.Certificate{},
 		}, false},
 		{"fail GetCertificateAuthority", fields{failTestClient(), testCertificateName}, args{&apiv1.GetCertificateAuthorityRequest{}}, nil, true},
 		{"fail bad root", fields{badTestClient(), testCertificateName}, args{&apiv1.GetCertificateAuthorityRequest{}}, nil, true},
+		{"fail bad intermediate", fields{&testClient{certificateAuthority: &pb.CertificateAuthority{
+			PemCaCertificates: []string{"not a pem cert", testRootCertificate},
+		}}, testCertificateName}, args{&apiv1.GetCertificateAuthorityRequest{}}, nil, true},
 		{"fail no pems", fields{&testClient{certificateAuthority: &pb.CertificateAuthority{}}, testCertificateName}, args{&apiv1.GetCertificateAuthorityRequest{}}, nil, true},
 	}
 	for _, tt := range tests {
@@ -320,6 +564,443 @@ func TestCloudCAS_GetCertificateAuthority(t *testing.T) {
 	}
 }
 
+func TestCloudCAS_GetCertificateAuthority_cache(t *testing.T) {
+	client := okTestClient()
+	c := &CloudCAS{
+		client:               client,
+		certificateAuthority: testAuthorityName,
+	}
+	otherName := "projects/test-project/locations/us-west1/certificateAuthorities/other-ca"
+
+	steps := []struct {
+		name         string
+		req          *apiv1.GetCertificateAuthorityRequest
+		expire       bool
+		wantGetCalls int
+	}{
+		{"fetch", &apiv1.GetCertificateAuthorityRequest{}, false, 1},
+		{"cached", &apiv1.GetCertificateAuthorityRequest{}, false, 1},
+		{"cached by name", &apiv1.GetCertificateAuthorityRequest{Name: testAuthorityName}, false, 1},
+		{"fetch other name", &apiv1.GetCertificateAuthorityRequest{Name: otherName}, false, 2},
+		{"fetch no cache", &apiv1.GetCertificateAuthorityRequest{NoCache: true}, false, 3},
+		{"fetch expired", &apiv1.GetCertificateAuthorityRequest{}, true, 4},
+		{"cached after refresh", &apiv1.GetCertificateAuthorityRequest{}, false, 4},
+	}
+	for _, st := range steps {
+		if st.expire {
+			c.caCache[testAuthorityName].expiry = time.Now().Add(-time.Second)
+		}
+		got, err := c.GetCertificateAuthority(st.req)
+		if err != nil {
+			t.Fatalf("%s: CloudCAS.GetCertificateAuthority() error = %v", st.name, err)
+		}
+		if client.getCalls != st.wantGetCalls {
+			t.Errorf("%s: client.GetCertificateAuthority calls = %d, want %d", st.name, client.getCalls, st.wantGetCalls)
+		}
+		if !reflect.DeepEqual(got.RootCertificate, mustParseCertificate(t, testRootCertificate)) {
+			t.Errorf("%s: CloudCAS.GetCertificateAuthority() root = %v", st.name, got.RootCertificate)
+		}
+	}
+
+	// A failed refresh does not replace a valid response.
+	client.err = errTest
+	if _, err := c.GetCertificateAuthority(&apiv1.GetCertificateAuthorityRequest{NoCache: true}); err == nil {
+		t.Error("CloudCAS.GetCertificateAuthority() error = nil")
+	}
+	if _, err := c.GetCertificateAuthority(&apiv1.GetCertificateAuthorityRequest{}); err != nil {
+		t.Errorf("CloudCAS.GetCertificateAuthority() error = %v", err)
+	}
+}
+
+func TestCloudCAS_GetCertificateAuthority_cacheError(t *testing.T) {
+	client := okTestClient()
+	c := &CloudCAS{
+		client:               client,
+		certificateAuthority: testAuthorityName,
+	}
+
+	steps := []struct {
+		name         string
+		err          error
+		expire       bool
+		wantGetCalls int
+		wantErr      bool
+	}{
+		{"fetch", errTest, false, 1, true},
+		{"cached", errTest, false, 1, true},
+		{"cached after recovery", nil, false, 1, true},
+		{"fetch expired", nil, true, 2, false},
+		{"cached", nil, false, 2, false},
+	}
+	for _, st := range steps {
+		client.err = st.err
+		if st.expire {
+			c.caCache[testAuthorityName].expiry = time.Now().Add(-time.Second)
+		}
+		_, err := c.GetCertificateAuthority(&apiv1.GetCertificateAuthorityRequest{})
+		if (err != nil) != st.wantErr {
+			t.Errorf("%s: CloudCAS.GetCertificateAuthority() error = %v, wantErr %v", st.name, err, st.wantErr)
+		}
+		if client.getCalls != st.wantGetCalls {
+			t.Errorf("%s: client.GetCertificateAuthority calls = %d, want %d", st.name, client.getCalls, st.wantGetCalls)
+		}
+	}
+}
+
+type blockingTestClient struct {
+	*testClient
+	started chan struct{}
+	release chan struct{}
+}
+
+func (c *blockingTestClient) GetCertificateAuthority(ctx context.Context, req *pb.GetCertificateAuthorityRequest, opts ...gax.CallOption) (*pb.CertificateAuthority, error) {
+	c.started <- struct{}{}
+	<-c.release
+	return c.testClient.GetCertificateAuthority(ctx, req, opts...)
+}
+
+func TestCloudCAS_GetCertificateAuthority_concurrent(t *testing.T) {
+	otherName := "projects/test-project/locations/us-west1/certificateAuthorities/other-ca"
+	client := &blockingTestClient{
+		testClient: okTestClient(),
+		started:    make(chan struct{}, 10),
+		release:    make(chan struct{}),
+	}
+	c := &CloudCAS{
+		client:               client,
+		certificateAuthority: testAuthorityName,
+		caCache: map[string]*cachedCertificateAuthority{
+			otherName: {
+				resp:   &apiv1.GetCertificateAuthorityResponse{},
+				expiry: time.Now().Add(time.Hour),
+			},
+		},
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 5)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := c.GetCertificateAuthority(&apiv1.GetCertificateAuthorityRequest{})
+			errs <- err
+		}()
+	}
+	<-client.started
+
+	// The lock is not held while the certificate authority is fetched.
+	done := make(chan error)
+	go func() {
+		_, err := c.GetCertificateAuthority(&apiv1.GetCertificateAuthorityRequest{Name: otherName})
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("CloudCAS.GetCertificateAuthority() error = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("CloudCAS.GetCertificateAuthority() blocked by a request in progress")
+	}
+
+	close(client.release)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("CloudCAS.GetCertificateAuthority() error = %v", err)
+		}
+	}
+	if client.getCalls != 1 {
+		t.Errorf("client.GetCertificateAuthority calls = %d, want 1", client.getCalls)
+	}
+}
+
+func TestCloudCAS_GetCertificateAuthorityCSR(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: "Test Subordinate CA"},
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCsr := string(pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE REQUEST",
+		Bytes: der,
+	}))
+
+	tests := []struct {
+		name     string
+		client   *testClient
+		caName   string
+		wantName string
+		want     []byte
+		wantErr  bool
+	}{
+		{"ok", &testClient{pemCsr: testCsr}, "", testAuthorityName, []byte(testCsr), false},
+		{"ok with name", &testClient{pemCsr: testCsr}, "projects/test-project/locations/us-west1/certificateAuthorities/other-ca", "projects/test-project/locations/us-west1/certificateAuthorities/other-ca", []byte(testCsr), false},
+		{"fail FetchCertificateAuthorityCsr", failTestClient(), "", testAuthorityName, nil, true},
+		{"fail empty", &testClient{}, "", testAuthorityName, nil, true},
+		{"fail certificate", &testClient{pemCsr: testRootCertificate}, "", testAuthorityName, nil, true},
+		{"fail parse", &testClient{pemCsr: string(pem.EncodeToMemory(&pem.Block{
+			Type:  "CERTIFICATE REQUEST",
+			Bytes: []byte("not a csr"),
+		}))}, "", testAuthorityName, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &CloudCAS{
+				client:               tt.client,
+				certificateAuthority: testAuthorityName,
+			}
+			got, err := c.GetCertificateAuthorityCSR(tt.caName)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("CloudCAS.GetCertificateAuthorityCSR() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("CloudCAS.GetCertificateAuthorityCSR() = %s, want %s", got, tt.want)
+			}
+			if name := tt.client.fetchCsrRequest.GetName(); name != tt.wantName {
+				t.Errorf("FetchCertificateAuthorityCsrRequest.Name = %s, want %s", name, tt.wantName)
+			}
+		})
+	}
+}
+
+func TestCloudCAS_ListCertificateAuthorities(t *testing.T) {
+	parent := "projects/test-project/locations/us-west1"
+	ca := func(name string, state pb.CertificateAuthority_State, tier pb.CertificateAuthority_Tier) *pb.CertificateAuthority {
+		return &pb.CertificateAuthority{
+			Name:  parent + "/certificateAuthorities/" + name,
+			State: state,
+			Tier:  tier,
+		}
+	}
+	info := func(name, state, tier string) *apiv1.CertificateAuthorityInfo {
+		return &apiv1.CertificateAuthorityInfo{
+			Name:  parent + "/certificateAuthorities/" + name,
+			State: state,
+			Tier:  tier,
+		}
+	}
+
+	tests := []struct {
+		name           string
+		client         *testClient
+		project        string
+		location       string
+		want           []*apiv1.CertificateAuthorityInfo
+		wantPageTokens []string
+		wantErr        bool
+	}{
+		{"ok", &testClient{listPages: [][]*pb.CertificateAuthority{
+			{ca("root-ca", pb.CertificateAuthority_ENABLED, pb.CertificateAuthority_ENTERPRISE)},
+		}}, "test-project", "us-west1", []*apiv1.CertificateAuthorityInfo{
+			info("root-ca", "ENABLED", "ENTERPRISE"),
+		}, []string{""}, false},
+		{"ok paginated", &testClient{listPages: [][]*pb.CertificateAuthority{
+			{ca("root-ca", pb.CertificateAuthority_ENABLED, pb.CertificateAuthority_ENTERPRISE), ca("sub-ca", pb.CertificateAuthority_PENDING_ACTIVATION, pb.CertificateAuthority_ENTERPRISE)},
+			{},
+			{ca("devops-ca", pb.CertificateAuthority_DISABLED, pb.CertificateAuthority_DEVOPS)},
+		}}, "test-project", "us-west1", []*apiv1.CertificateAuthorityInfo{
+			info("root-ca", "ENABLED", "ENTERPRISE"),
+			info("sub-ca", "PENDING_ACTIVATION", "ENTERPRISE"),
+			info("devops-ca", "DISABLED", "DEVOPS"),
+		}, []string{"", "1", "2"}, false},
+		{"ok empty", &testClient{}, "test-project", "us-west1", nil, []string{""}, false},
+		{"fail ListCertificateAuthorities", failTestClient(), "test-project", "us-west1", nil, []string{""}, true},
+		{"fail project", &testClient{}, "", "us-west1", nil, nil, true},
+		{"fail location", &testClient{}, "test-project", "us-west1/certificateAuthorities", nil, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &CloudCAS{
+				client:               tt.client,
+				certificateAuthority: testAuthorityName,
+			}
+			got, err := c.ListCertificateAuthorities(context.Background(), tt.project, tt.location)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("CloudCAS.ListCertificateAuthorities() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("CloudCAS.ListCertificateAuthorities() = %v, want %v", got, tt.want)
+			}
+			if !reflect.DeepEqual(tt.client.listPageTokens, tt.wantPageTokens) {
+				t.Errorf("page tokens = %q, want %q", tt.client.listPageTokens, tt.wantPageTokens)
+			}
+			if tt.wantPageTokens != nil && tt.client.listRequest.Parent != parent {
+				t.Errorf("ListCertificateAuthoritiesRequest.Parent = %s, want %s", tt.client.listRequest.Parent, parent)
+			}
+		})
+	}
+}
+
+func TestCloudCAS_UpdateCertificateAuthorityLabels(t *testing.T) {
+	tmp := waitUpdateOperation
+	t.Cleanup(func() {
+		waitUpdateOperation = tmp
+	})
+	var waitErr error
+	waitUpdateOperation = func(ctx context.Context, op *privateca.UpdateCertificateAuthorityOperation) (*pb.CertificateAuthority, error) {
+		return nil, waitErr
+	}
+
+	otherAuthorityName := "projects/test-project/locations/us-west1/certificateAuthorities/other-ca"
+	tests := []struct {
+		name     string
+		client   *testClient
+		waitErr  error
+		caName   string
+		labels   map[string]string
+		wantName string
+		wantErr  bool
+	}{
+		{"ok", &testClient{}, nil, "", map[string]string{"team": "platform", "cost-center": "1234"}, testAuthorityName, false},
+		{"ok name", &testClient{}, nil, otherAuthorityName, map[string]string{"env": "prod"}, otherAuthorityName, false},
+		{"ok empty value", &testClient{}, nil, "", map[string]string{"deprecated": ""}, testAuthorityName, false},
+		{"ok remove all", &testClient{}, nil, "", nil, testAuthorityName, false},
+		{"fail key", &testClient{}, nil, "", map[string]string{"Team": "platform"}, "", true},
+		{"fail value", &testClient{}, nil, "", map[string]string{"team": "Platform"}, "", true},
+		{"fail update", &testClient{err: errTest}, nil, "", map[string]string{"team": "platform"}, "", true},
+		{"fail wait", &testClient{}, errTest, "", map[string]string{"team": "platform"}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			waitErr = tt.waitErr
+			c := &CloudCAS{
+				client:               tt.client,
+				certificateAuthority: testAuthorityName,
+			}
+			if err := c.UpdateCertificateAuthorityLabels(tt.caName, tt.labels); (err != nil) != tt.wantErr {
+				t.Fatalf("CloudCAS.UpdateCertificateAuthorityLabels() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			req := tt.client.updateRequest
+			if got := req.GetCertificateAuthority().GetName(); got != tt.wantName {
+				t.Errorf("UpdateCertificateAuthorityRequest.CertificateAuthority.Name = %s, want %s", got, tt.wantName)
+			}
+			if got := req.GetCertificateAuthority().GetLabels(); !reflect.DeepEqual(got, tt.labels) {
+				t.Errorf("UpdateCertificateAuthorityRequest.CertificateAuthority.Labels = %v, want %v", got, tt.labels)
+			}
+			if got := req.GetUpdateMask().GetPaths(); !reflect.DeepEqual(got, []string{"labels"}) {
+				t.Errorf("UpdateCertificateAuthorityRequest.UpdateMask.Paths = %v, want [labels]", got)
+			}
+		})
+	}
+}
+
+func TestCloudCAS_ActivateCertificateAuthority(t *testing.T) {
+	tmp := waitActivateOperation
+	t.Cleanup(func() {
+		waitActivateOperation = tmp
+	})
+	var waitErr error
+	waitActivateOperation = func(ctx context.Context, op *privateca.ActivateCertificateAuthorityOperation) (*pb.CertificateAuthority, error) {
+		return nil, waitErr
+	}
+
+	// External root and intermediate, and the subordinate in Google CAS.
+	newCA := func(cn string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tpl := &x509.Certificate{
+			SerialNumber:          big.NewInt(time.Now().UnixNano()),
+			Subject:               pkix.Name{CommonName: cn},
+			NotBefore:             time.Now(),
+			NotAfter:              time.Now().Add(time.Hour),
+			KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+			BasicConstraintsValid: true,
+			IsCA:                  true,
+		}
+		if parent == nil {
+			parent, parentKey = tpl, key
+		}
+		b, err := x509.CreateCertificate(rand.Reader, tpl, parent, key.Public(), parentKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		crt, err := x509.ParseCertificate(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return crt, key
+	}
+	root, rootKey := newCA("External Root", nil, nil)
+	intermediate, intermediateKey := newCA("External Intermediate", root, rootKey)
+	subordinate, _ := newCA("Google CAS Subordinate", intermediate, intermediateKey)
+	otherRoot, _ := newCA("Other Root", nil, nil)
+	leaf := mustParseCertificate(t, testLeafCertificate)
+
+	pemEncode := func(crts ...*x509.Certificate) []string {
+		var ret []string
+		for _, crt := range crts {
+			ret = append(ret, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: crt.Raw})))
+		}
+		return ret
+	}
+	otherAuthorityName := "projects/test-project/locations/us-west1/certificateAuthorities/other-ca"
+
+	tests := []struct {
+		name      string
+		client    *testClient
+		waitErr   error
+		caName    string
+		cert      *x509.Certificate
+		chain     []*x509.Certificate
+		wantName  string
+		wantChain []string
+		wantErr   bool
+	}{
+		{"ok", &testClient{}, nil, "", subordinate, []*x509.Certificate{intermediate, root}, testAuthorityName, pemEncode(intermediate, root), false},
+		{"ok root issuer", &testClient{}, nil, otherAuthorityName, intermediate, []*x509.Certificate{root}, otherAuthorityName, pemEncode(root), false},
+		{"fail nil certificate", &testClient{}, nil, "", nil, []*x509.Certificate{intermediate, root}, "", nil, true},
+		{"fail not ca", &testClient{}, nil, "", leaf, []*x509.Certificate{intermediate, root}, "", nil, true},
+		{"fail empty chain", &testClient{}, nil, "", subordinate, nil, "", nil, true},
+		{"fail wrong issuer", &testClient{}, nil, "", subordinate, []*x509.Certificate{otherRoot}, "", nil, true},
+		{"fail wrong order", &testClient{}, nil, "", subordinate, []*x509.Certificate{root, intermediate}, "", nil, true},
+		{"fail no root", &testClient{}, nil, "", subordinate, []*x509.Certificate{intermediate}, "", nil, true},
+		{"fail activate", &testClient{err: errTest}, nil, "", subordinate, []*x509.Certificate{intermediate, root}, "", nil, true},
+		{"fail wait", &testClient{}, errTest, "", subordinate, []*x509.Certificate{intermediate, root}, "", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			waitErr = tt.waitErr
+			c := &CloudCAS{
+				client:               tt.client,
+				certificateAuthority: testAuthorityName,
+			}
+			if err := c.ActivateCertificateAuthority(tt.caName, tt.cert, tt.chain); (err != nil) != tt.wantErr {
+				t.Fatalf("CloudCAS.ActivateCertificateAuthority() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			req := tt.client.activateRequest
+			if req.GetName() != tt.wantName {
+				t.Errorf("ActivateCertificateAuthorityRequest.Name = %s, want %s", req.GetName(), tt.wantName)
+			}
+			if want := pemEncode(tt.cert)[0]; req.GetPemCaCertificate() != want {
+				t.Errorf("ActivateCertificateAuthorityRequest.PemCaCertificate = %s, want %s", req.GetPemCaCertificate(), want)
+			}
+			if got := req.GetSubordinateConfig().GetPemIssuerChain().GetPemCertificates(); !reflect.DeepEqual(got, tt.wantChain) {
+				t.Errorf("ActivateCertificateAuthorityRequest.SubordinateConfig.PemIssuerChain = %v, want %v", got, tt.wantChain)
+			}
+		})
+	}
+}
+
 func TestCloudCAS_CreateCertificate(t *testing.T) {
 	type fields struct {
 		client               CertificateAuthorityClient
@@ -387,6 +1068,7 @@ func TestCloudCAS_createCertificate(t *testing.T) {
 	type args struct {
 		tpl       *x509.Certificate
 		lifetime  time.Duration
+		id        string
 		requestID string
 	}
 	tests := []struct {
@@ -397,31 +1079,18 @@ func TestCloudCAS_createCertificate(t *testing.T) {
 		want1   []*x509.Certificate
 		wantErr bool
 	}{
-		{"ok", fields{okTestClient(), testAuthorityName}, args{leaf, 24 * time.Hour, "request-id"}, signed, chain, false},
-		{"fail CertificateConfig", fields{okTestClient(), testAuthorityName}, args{&x509.Certificate{}, 24 * time.Hour, "request-id"}, nil, nil, true},
-		{"fail CreateCertificate", fields{failTestClient(), testAuthorityName}, args{leaf, 24 * time.Hour, "request-id"}, nil, nil, true},
-		{"fail ParseCertificates", fields{badTestClient(), testAuthorityName}, args{leaf, 24 * time.Hour, "request-id"}, nil, nil, true},
-		{"fail create id", fields{okTestClient(), testAuthorityName}, args{leaf, 24 * time.Hour, "request-id"}, nil, nil, true},
-	}
-
-	// Pre-calculate rand.Random
-	buf := new(bytes.Buffer)
-	setTeeReader(t, buf)
-	for i := 0; i < len(tests)-1; i++ {
-		_, err := uuid.NewRandomFromReader(rand.Reader)
-		if err != nil {
-			t.Fatal(err)
-		}
+		{"ok", fields{okTestClient(), testAuthorityName}, args{leaf, 24 * time.Hour, "test-certificate", "request-id"}, signed, chain, false},
+		{"fail CertificateConfig", fields{okTestClient(), testAuthorityName}, args{&x509.Certificate{}, 24 * time.Hour, "test-certificate", "request-id"}, nil, nil, true},
+		{"fail CreateCertificate", fields{failTestClient(), testAuthorityName}, args{leaf, 24 * time.Hour, "test-certificate", "request-id"}, nil, nil, true},
+		{"fail ParseCertificates", fields{badTestClient(), testAuthorityName}, args{leaf, 24 * time.Hour, "test-certificate", "request-id"}, nil, nil, true},
 	}
-	rand.Reader = buf
-
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			c := &CloudCAS{
 				client:               tt.fields.client,
 				certificateAuthority: tt.fields.certificateAuthority,
 			}
-			got, got1, err := c.createCertificate(tt.args.tpl, tt.args.lifetime, tt.args.requestID)
+			got, got1, err := c.createCertificate(tt.args.tpl, tt.args.lifetime, tt.args.id, tt.args.requestID)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("CloudCAS.createCertificate() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -436,10 +1105,370 @@ func TestCloudCAS_createCertificate(t *testing.T) {
 	}
 }
 
-func TestCloudCAS_RenewCertificate(t *testing.T) {
-	type fields struct {
-		client               CertificateAuthorityClient
-		certificateAuthority string
+func TestCloudCAS_CreateCertificate_csr(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: "test.smallstep.com"},
+		DNSNames: []string{"test.smallstep.com"},
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	badSignature, err := x509.ParseCertificateRequest(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	badSignature.Signature = append([]byte{}, csr.Signature...)
+	badSignature.Signature[len(badSignature.Signature)-1]++
+
+	template := func(publicKey interface{}) *x509.Certificate {
+		return &x509.Certificate{
+			Subject:     pkix.Name{CommonName: "template.smallstep.com"},
+			DNSNames:    []string{"template.smallstep.com"},
+			PublicKey:   publicKey,
+			KeyUsage:    x509.KeyUsageDigitalSignature,
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		}
+	}
+	reusableConfig := "projects/test-project/locations/us-west1/reusableConfigs/leaf-server-tls"
+	casExtension, err := apiv1.CreateCertificateAuthorityExtension(apiv1.CloudCAS, "test-certificate")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name               string
+		client             *testClient
+		extKeyUsage        []x509.ExtKeyUsage
+		reusableConfig     string
+		template           *x509.Certificate
+		csr                *x509.CertificateRequest
+		wantCommonName     string
+		wantClientAuth     bool
+		wantReusableConfig string
+		wantPemCsr         bool
+		wantErr            bool
+	}{
+		{"ok csr", okTestClient(), nil, "", nil, csr, "", false, "", true, false},
+		{"ok csr and template", okTestClient(), nil, "", template(key.Public()), csr, "template.smallstep.com", true, "", false, false},
+		{"ok key usages", okTestClient(), []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}, "", nil, csr, "test.smallstep.com", false, "", false, false},
+		{"ok reusable config", okTestClient(), nil, reusableConfig, nil, csr, "test.smallstep.com", false, reusableConfig, false, false},
+		{"fail none", okTestClient(), nil, "", nil, nil, "", false, "", false, true},
+		{"fail signature", okTestClient(), nil, "", nil, badSignature, "", false, "", false, true},
+		{"fail signature template", okTestClient(), []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}, "", nil, badSignature, "", false, "", false, true},
+		{"fail public key", okTestClient(), nil, "", template(mustParseCertificate(t, testLeafCertificate).PublicKey), csr, "", false, "", false, true},
+		{"fail create", failTestClient(), nil, "", nil, csr, "", false, "", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &CloudCAS{
+				client:               tt.client,
+				certificateAuthority: testAuthorityName,
+				extKeyUsage:          tt.extKeyUsage,
+				reusableConfig:       tt.reusableConfig,
+			}
+			got, err := c.CreateCertificate(&apiv1.CreateCertificateRequest{
+				Template:      tt.template,
+				CSR:           tt.csr,
+				Lifetime:      24 * time.Hour,
+				CertificateID: "test-certificate",
+			})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("CloudCAS.CreateCertificate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got.Certificate == nil {
+				t.Error("CloudCAS.CreateCertificate() certificate is nil")
+			}
+
+			// Without a template or a policy to apply, the CSR is sent as it
+			// is.
+			req := tt.client.createRequest
+			if req.GetCertificateId() != "test-certificate" {
+				t.Errorf("CreateCertificateRequest.CertificateId = %s, want test-certificate", req.GetCertificateId())
+			}
+			if tt.wantPemCsr {
+				want := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr.Raw}))
+				if got := req.GetCertificate().GetPemCsr(); got != want {
+					t.Errorf("CreateCertificateRequest.Certificate.PemCsr = %q, want %q", got, want)
+				}
+				return
+			}
+			if req.GetCertificate().GetPemCsr() != "" {
+				t.Error("CreateCertificateRequest.Certificate.PemCsr is not empty")
+			}
+			config := req.GetCertificate().GetConfig()
+			if got := config.GetSubjectConfig().GetCommonName(); got != tt.wantCommonName {
+				t.Errorf("CreateCertificateRequest common name = %s, want %s", got, tt.wantCommonName)
+			}
+			pk, err := createPublicKey(key.Public())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(config.GetPublicKey(), pk) {
+				t.Errorf("CreateCertificateRequest public key = %v, want %v", config.GetPublicKey(), pk)
+			}
+			if got := config.GetReusableConfig().GetReusableConfig(); got != tt.wantReusableConfig {
+				t.Errorf("CreateCertificateRequest reusable config = %s, want %s", got, tt.wantReusableConfig)
+			}
+			if tt.wantReusableConfig != "" {
+				return
+			}
+
+			values := config.GetReusableConfig().GetReusableConfigValues()
+			if got := values.GetKeyUsage().GetExtendedKeyUsage().GetClientAuth(); got != tt.wantClientAuth {
+				t.Errorf("CreateCertificateRequest clientAuth = %v, want %v", got, tt.wantClientAuth)
+			}
+			// The CAS extension is required to revoke the certificate.
+			var found bool
+			for _, ext := range values.GetAdditionalExtensions() {
+				if reflect.DeepEqual(ext, &pb.X509Extension{
+					ObjectId: createObjectID(casExtension.Id),
+					Critical: casExtension.Critical,
+					Value:    casExtension.Value,
+				}) {
+					found = true
+				}
+			}
+			if !found {
+				t.Errorf("CreateCertificateRequest extensions = %v, want the CAS extension", values.GetAdditionalExtensions())
+			}
+		})
+	}
+}
+
+func TestCloudCAS_DryRunCreateCertificate(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: "test.smallstep.com"},
+		DNSNames: []string{"test.smallstep.com"},
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name           string
+		reusableConfig string
+		req            *apiv1.CreateCertificateRequest
+		wantConfig     bool
+		wantErr        bool
+	}{
+		{"ok template", "", &apiv1.CreateCertificateRequest{
+			Template:      mustParseCertificate(t, testLeafCertificate),
+			Lifetime:      24 * time.Hour,
+			CertificateID: "test-certificate",
+			RequestID:     "request-id",
+		}, true, false},
+		{"ok reusable config", "projects/test-project/locations/us-west1/reusableConfigs/leaf-server-tls", &apiv1.CreateCertificateRequest{
+			Template:      mustParseCertificate(t, testLeafCertificate),
+			Lifetime:      24 * time.Hour,
+			CertificateID: "test-certificate",
+		}, true, false},
+		{"ok csr", "", &apiv1.CreateCertificateRequest{
+			CSR:           csr,
+			Lifetime:      24 * time.Hour,
+			CertificateID: "test-certificate",
+		}, false, false},
+		{"ok csr reusable config", "projects/test-project/locations/us-west1/reusableConfigs/leaf-server-tls", &apiv1.CreateCertificateRequest{
+			CSR:           csr,
+			Lifetime:      24 * time.Hour,
+			CertificateID: "test-certificate",
+		}, true, false},
+		{"fail none", "", &apiv1.CreateCertificateRequest{Lifetime: 24 * time.Hour}, false, true},
+		{"fail lifetime", "", &apiv1.CreateCertificateRequest{CSR: csr}, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := failTestClient()
+			c := &CloudCAS{
+				client:               client,
+				certificateAuthority: testAuthorityName,
+				reusableConfig:       tt.reusableConfig,
+			}
+			got, err := c.DryRunCreateCertificate(tt.req)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("CloudCAS.DryRunCreateCertificate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if client.createRequest != nil || client.getCalls != 0 || client.callOptions != nil {
+				t.Errorf("CloudCAS.DryRunCreateCertificate() called the client")
+			}
+			if tt.wantErr {
+				return
+			}
+
+			if got.Parent != testAuthorityName || got.CertificateId != "test-certificate" || got.RequestId != tt.req.RequestID {
+				t.Errorf("CloudCAS.DryRunCreateCertificate() = %v", got)
+			}
+			if got.Certificate.GetLifetime().AsDuration() != tt.req.Lifetime {
+				t.Errorf("CreateCertificateRequest.Certificate.Lifetime = %v, want %v", got.Certificate.GetLifetime().AsDuration(), tt.req.Lifetime)
+			}
+			if cfg := got.Certificate.GetConfig(); (cfg != nil) != tt.wantConfig {
+				t.Errorf("CreateCertificateRequest.Certificate.Config = %v, want config %v", cfg, tt.wantConfig)
+			}
+			if pemCsr := got.Certificate.GetPemCsr(); (pemCsr == "") != tt.wantConfig {
+				t.Errorf("CreateCertificateRequest.Certificate.PemCsr = %q, want csr %v", pemCsr, !tt.wantConfig)
+			}
+			if got := got.Certificate.GetConfig().GetReusableConfig().GetReusableConfig(); got != tt.reusableConfig {
+				t.Errorf("CreateCertificateRequest.Certificate.Config.ReusableConfig = %q, want %q", got, tt.reusableConfig)
+			}
+		})
+	}
+}
+
+func TestCloudCAS_DryRunCreateCertificate_template(t *testing.T) {
+	template := func() *x509.Certificate {
+		crt := mustParseCertificate(t, testLeafCertificate)
+		ext, err := apiv1.CreateCertificateAuthorityExtension(apiv1.CloudCAS, "old-certificate")
+		if err != nil {
+			t.Fatal(err)
+		}
+		crt.ExtraExtensions = append(crt.ExtraExtensions, pkix.Extension{Id: asn1.ObjectIdentifier{1, 2, 3, 4}, Value: []byte{5, 0}}, ext)
+		crt.KeyUsage = x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment
+		crt.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+		crt.UnknownExtKeyUsage = []asn1.ObjectIdentifier{{1, 2, 3, 5}}
+		return crt
+	}
+
+	c := &CloudCAS{
+		client:               failTestClient(),
+		certificateAuthority: testAuthorityName,
+		keyUsage:             x509.KeyUsageDigitalSignature,
+		extKeyUsage:          []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	tpl, want := template(), template()
+	if _, err := c.DryRunCreateCertificate(&apiv1.CreateCertificateRequest{
+		Template:      tpl,
+		Lifetime:      24 * time.Hour,
+		CertificateID: "test-certificate",
+	}); err != nil {
+		t.Fatalf("CloudCAS.DryRunCreateCertificate() error = %v", err)
+	}
+	if !reflect.DeepEqual(tpl, want) {
+		t.Errorf("CloudCAS.DryRunCreateCertificate() modified the template = %v, want %v", tpl, want)
+	}
+}
+
+func TestCloudCAS_CreateCertificate_certificateID(t *testing.T) {
+	tests := []struct {
+		name          string
+		prefix        string
+		certificateID string
+		wantPrefix    string
+		wantLen       int
+		wantErr       bool
+	}{
+		{"ok random", "", "", "", 36, false},
+		{"ok prefix", "ticket-1234-", "", "ticket-1234-", 48, false},
+		{"ok supplied", "", "ticket-1234", "ticket-1234", 11, false},
+		{"ok supplied with prefix", "ignored-", "ticket_1234", "ticket_1234", 11, false},
+		{"fail supplied charset", "", "ticket/1234", "", 0, true},
+		{"fail supplied length", "", strings.Repeat("a", 64), "", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := okTestClient()
+			c := &CloudCAS{
+				client:               client,
+				certificateAuthority: testAuthorityName,
+				certificateIDPrefix:  tt.prefix,
+			}
+			tpl := mustParseCertificate(t, testLeafCertificate)
+			_, err := c.CreateCertificate(&apiv1.CreateCertificateRequest{
+				Template:      tpl,
+				Lifetime:      24 * time.Hour,
+				CertificateID: tt.certificateID,
+			})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("CloudCAS.CreateCertificate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			id := client.createRequest.CertificateId
+			if !strings.HasPrefix(id, tt.wantPrefix) || len(id) != tt.wantLen {
+				t.Errorf("CreateCertificateRequest.CertificateId = %s, want prefix %q and length %d", id, tt.wantPrefix, tt.wantLen)
+			}
+			// The same id must be in the CAS extension.
+			if got, err := getCertificateID(&x509.Certificate{Extensions: tpl.ExtraExtensions}); err != nil || got != id {
+				t.Errorf("getCertificateID() = %s, %v, want %s", got, err, id)
+			}
+		})
+	}
+
+	t.Run("fail create id", func(t *testing.T) {
+		setTeeReader(t, new(bytes.Buffer))
+		rand.Reader = new(bytes.Buffer)
+		c := &CloudCAS{
+			client:               okTestClient(),
+			certificateAuthority: testAuthorityName,
+		}
+		if _, err := c.CreateCertificate(&apiv1.CreateCertificateRequest{
+			Template: mustParseCertificate(t, testLeafCertificate),
+			Lifetime: 24 * time.Hour,
+		}); err == nil {
+			t.Error("CloudCAS.CreateCertificate() error = nil, wantErr true")
+		}
+	})
+}
+
+func TestNew_certificateIDPrefix(t *testing.T) {
+	tmp := newCertificateAuthorityClient
+	newCertificateAuthorityClient = func(ctx context.Context, opts apiv1.Options) (CertificateAuthorityClient, error) {
+		return &testClient{}, nil
+	}
+	t.Cleanup(func() {
+		newCertificateAuthorityClient = tmp
+	})
+
+	tests := []struct {
+		name    string
+		prefix  string
+		wantErr bool
+	}{
+		{"ok", "ticket-", false},
+		{"ok empty", "", false},
+		{"ok max length", strings.Repeat("a", 27), false},
+		{"fail length", strings.Repeat("a", 28), true},
+		{"fail charset", "ticket/", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := New(context.Background(), apiv1.Options{
+				CertificateAuthority: testAuthorityName,
+				CertificateIDPrefix:  tt.prefix,
+			})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("New() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && got.certificateIDPrefix != tt.prefix {
+				t.Errorf("CloudCAS.certificateIDPrefix = %s, want %s", got.certificateIDPrefix, tt.prefix)
+			}
+		})
+	}
+}
+
+func TestCloudCAS_RenewCertificate(t *testing.T) {
+	type fields struct {
+		client               CertificateAuthorityClient
+		certificateAuthority string
 	}
 	type args struct {
 		req *apiv1.RenewCertificateRequest
@@ -520,6 +1549,25 @@ func TestCloudCAS_RevokeCertificate(t *testing.T) {
 			Certificate:      mustParseCertificate(t, testSignedCertificate),
 			CertificateChain: []*x509.Certificate{mustParseCertificate(t, testIntermediateCertificate)},
 		}, false},
+		{"ok with certificate id", fields{okTestClient(), testCertificateName}, args{&apiv1.RevokeCertificateRequest{
+			CertificateID: "test-certificate",
+			ReasonCode:    1,
+		}}, &apiv1.RevokeCertificateResponse{
+			Certificate:      mustParseCertificate(t, testSignedCertificate),
+			CertificateChain: []*x509.Certificate{mustParseCertificate(t, testIntermediateCertificate)},
+		}, false},
+		{"ok with certificate and id", fields{okTestClient(), testCertificateName}, args{&apiv1.RevokeCertificateRequest{
+			Certificate:   mustParseCertificate(t, testLeafCertificate),
+			CertificateID: "test-certificate",
+			ReasonCode:    1,
+		}}, &apiv1.RevokeCertificateResponse{
+			Certificate:      mustParseCertificate(t, testSignedCertificate),
+			CertificateChain: []*x509.Certificate{mustParseCertificate(t, testIntermediateCertificate)},
+		}, false},
+		{"fail certificate id", fields{okTestClient(), testCertificateName}, args{&apiv1.RevokeCertificateRequest{
+			CertificateID: "../test-certificate",
+			ReasonCode:    1,
+		}}, nil, true},
 		{"fail Extension", fields{okTestClient(), testCertificateName}, args{&apiv1.RevokeCertificateRequest{
 			Certificate: mustParseCertificate(t, testLeafCertificate),
 			ReasonCode:  1,
@@ -566,6 +1614,113 @@ func TestCloudCAS_RevokeCertificate(t *testing.T) {
 			if !reflect.DeepEqual(got, tt.want) {
 				t.Errorf("CloudCAS.RevokeCertificate() = %v, want %v", got, tt.want)
 			}
+			if id := tt.args.req.CertificateID; !tt.wantErr && id != "" {
+				want := tt.fields.certificateAuthority + "/certificates/" + id
+				if name := tt.fields.client.(*testClient).revokeRequest.Name; name != want {
+					t.Errorf("RevokeCertificateRequest.Name = %s, want %s", name, want)
+				}
+			}
+		})
+	}
+}
+
+func TestCloudCAS_RevokeCertificate_reasonCode(t *testing.T) {
+	tests := []struct {
+		name       string
+		reasonCode int
+		wantErr    string
+	}{
+		{"unassigned", 7, "reason code 7 is unassigned in RFC 5280"},
+		{"removeFromCRL", 8, "removeFromCRL is not supported by Google CAS"},
+		{"unknown", 100, "'reasonCode=100' is invalid or not supported"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &CloudCAS{
+				client:               okTestClient(),
+				certificateAuthority: testAuthorityName,
+			}
+			_, err := c.RevokeCertificate(&apiv1.RevokeCertificateRequest{
+				Certificate: mustParseCertificate(t, testSignedCertificate),
+				ReasonCode:  tt.reasonCode,
+			})
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("CloudCAS.RevokeCertificate() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCloudCAS_requestIDErrors(t *testing.T) {
+	st, err := status.New(codes.Unavailable, "service unavailable").WithDetails(&errdetails.RequestInfo{
+		RequestId: "gcp-request-id",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	statusErr := st.Err()
+
+	// Skip the signature algorithm validation, it would fail first.
+	template := func() *x509.Certificate {
+		crt := mustParseCertificate(t, testLeafCertificate)
+		crt.SignatureAlgorithm = x509.UnknownSignatureAlgorithm
+		return crt
+	}
+
+	tests := []struct {
+		name  string
+		err   error
+		fn    func(c *CloudCAS) error
+		wants []string
+	}{
+		{"create", statusErr, func(c *CloudCAS) error {
+			_, err := c.CreateCertificate(&apiv1.CreateCertificateRequest{
+				Template:      template(),
+				Lifetime:      24 * time.Hour,
+				CertificateID: "test-certificate",
+				RequestID:     "request-id",
+			})
+			return err
+		}, []string{"cloudCAS CreateCertificate failed", "name=" + testCertificateName, "requestId=request-id", "gcpRequestId=gcp-request-id"}},
+		{"revoke", statusErr, func(c *CloudCAS) error {
+			_, err := c.RevokeCertificate(&apiv1.RevokeCertificateRequest{
+				CertificateID: "test-certificate",
+				ReasonCode:    1,
+				RequestID:     "request-id",
+			})
+			return err
+		}, []string{"cloudCAS RevokeCertificate failed", "name=" + testCertificateName, "requestId=request-id", "gcpRequestId=gcp-request-id"}},
+		{"create without details", errTest, func(c *CloudCAS) error {
+			_, err := c.CreateCertificate(&apiv1.CreateCertificateRequest{
+				Template:      template(),
+				Lifetime:      24 * time.Hour,
+				CertificateID: "test-certificate",
+			})
+			return err
+		}, []string{"cloudCAS CreateCertificate failed [name=" + testCertificateName + "]: test error"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Only the requests to create and revoke the certificate fail.
+			c := &CloudCAS{
+				client:               &testClient{err: tt.err},
+				certificateAuthority: testAuthorityName,
+				caCache: map[string]*cachedCertificateAuthority{
+					testAuthorityName: {
+						ca:     okTestClient().certificateAuthority,
+						expiry: time.Now().Add(time.Hour),
+					},
+				},
+			}
+			err := tt.fn(c)
+			if err == nil {
+				t.Fatal("error = nil, wantErr true")
+			}
+			for _, want := range tt.wants {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("error = %q, want it to contain %q", err.Error(), want)
+				}
+			}
 		})
 	}
 }
@@ -646,6 +1801,20 @@ func Test_getCertificateAndChain(t *testing.T) {
 			PemCertificate:      testSignedCertificate,
 			PemCertificateChain: []string{testIntermediateCertificate, testRootCertificate},
 		}}, mustParseCertificate(t, testSignedCertificate), []*x509.Certificate{mustParseCertificate(t, testIntermediateCertificate)}, false},
+		{"ok root only", args{&pb.Certificate{
+			Name:                testCertificateName,
+			PemCertificate:      testSignedCertificate,
+			PemCertificateChain: []string{testRootCertificate},
+		}}, mustParseCertificate(t, testSignedCertificate), []*x509.Certificate{}, false},
+		{"ok empty chain", args{&pb.Certificate{
+			Name:                testCertificateName,
+			PemCertificate:      testSignedCertificate,
+			PemCertificateChain: []string{},
+		}}, mustParseCertificate(t, testSignedCertificate), []*x509.Certificate{}, false},
+		{"ok nil chain", args{&pb.Certificate{
+			Name:           testCertificateName,
+			PemCertificate: testSignedCertificate,
+		}}, mustParseCertificate(t, testSignedCertificate), []*x509.Certificate{}, false},
 		{"fail PemCertificate", args{&pb.Certificate{
 			Name:                testCertificateName,
 			PemCertificate:      "foobar",
@@ -673,3 +1842,355 @@ func Test_getCertificateAndChain(t *testing.T) {
 		})
 	}
 }
+
+type testMetrics struct {
+	calls map[string]int
+}
+
+func (m *testMetrics) Observe(method string, success bool, code string, duration time.Duration) {
+	if m.calls == nil {
+		m.calls = make(map[string]int)
+	}
+	m.calls[fmt.Sprintf("%s:%v:%s", method, success, code)]++
+}
+
+func TestCloudCAS_metrics(t *testing.T) {
+	leaf := mustParseCertificate(t, testLeafCertificate)
+	leaf.SignatureAlgorithm = x509.UnknownSignatureAlgorithm
+	signed := mustParseCertificate(t, testSignedCertificate)
+
+	m := new(testMetrics)
+	ok := &CloudCAS{client: okTestClient(), certificateAuthority: testAuthorityName, metrics: m}
+	fail := &CloudCAS{client: failTestClient(), certificateAuthority: testAuthorityName, metrics: m}
+	for _, c := range []*CloudCAS{ok, fail} {
+		c.GetCertificateAuthority(&apiv1.GetCertificateAuthorityRequest{})
+		c.CreateCertificate(&apiv1.CreateCertificateRequest{Template: leaf, Lifetime: time.Hour})
+		c.RenewCertificate(&apiv1.RenewCertificateRequest{Template: leaf, Lifetime: time.Hour})
+		c.RevokeCertificate(&apiv1.RevokeCertificateRequest{Certificate: signed, ReasonCode: 1})
+	}
+
+	// GetCertificateAuthority, CreateCertificate and RenewCertificate share
+	// the cached certificate authority, failures are cached too. Without the
+	// certificate authority no certificate is requested.
+	want := map[string]int{
+		"GetCertificateAuthority:true:OK":       1,
+		"GetCertificateAuthority:false:Unknown": 1,
+		"CreateCertificate:true:OK":             2,
+		"RevokeCertificate:true:OK":             1,
+		"RevokeCertificate:false:Unknown":       1,
+	}
+	if !reflect.DeepEqual(m.calls, want) {
+		t.Errorf("Metrics.Observe() calls = %v, want %v", m.calls, want)
+	}
+
+	// No metrics should not panic
+	c := &CloudCAS{client: okTestClient(), certificateAuthority: testAuthorityName}
+	if _, err := c.GetCertificateAuthority(&apiv1.GetCertificateAuthorityRequest{}); err != nil {
+		t.Errorf("CloudCAS.GetCertificateAuthority() error = %v", err)
+	}
+}
+
+func TestCloudCAS_createCertificate_signatureAlgorithm(t *testing.T) {
+	withAlgorithm := func(sa x509.SignatureAlgorithm) *x509.Certificate {
+		leaf := mustParseCertificate(t, testLeafCertificate)
+		leaf.SignatureAlgorithm = sa
+		return leaf
+	}
+	withKeySpec := func(alg pb.CertificateAuthority_SignHashAlgorithm) *testClient {
+		client := okTestClient()
+		client.certificateAuthority.KeySpec = &pb.CertificateAuthority_KeyVersionSpec{
+			KeyVersion: &pb.CertificateAuthority_KeyVersionSpec_Algorithm{
+				Algorithm: alg,
+			},
+		}
+		return client
+	}
+	emptyClient := okTestClient()
+	emptyClient.certificateAuthority.PemCaCertificates = nil
+
+	tests := []struct {
+		name    string
+		client  *testClient
+		tpl     *x509.Certificate
+		wantErr bool
+	}{
+		{"ok not requested", emptyClient, withAlgorithm(x509.UnknownSignatureAlgorithm), false},
+		{"ok key spec", withKeySpec(pb.CertificateAuthority_EC_P384_SHA384), withAlgorithm(x509.ECDSAWithSHA384), false},
+		{"ok rsa key spec", withKeySpec(pb.CertificateAuthority_RSA_PSS_2048_SHA_256), withAlgorithm(x509.SHA256WithRSAPSS), false},
+		{"ok kms key", okTestClient(), withAlgorithm(x509.ECDSAWithSHA384), false},
+		{"fail key spec", withKeySpec(pb.CertificateAuthority_EC_P256_SHA256), withAlgorithm(x509.ECDSAWithSHA384), true},
+		{"fail kms key", okTestClient(), withAlgorithm(x509.SHA256WithRSA), true},
+		{"fail ed25519", okTestClient(), withAlgorithm(x509.PureEd25519), true},
+		{"fail GetCertificateAuthority", failTestClient(), withAlgorithm(x509.ECDSAWithSHA256), true},
+		{"fail no ca certificates", emptyClient, withAlgorithm(x509.ECDSAWithSHA256), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &CloudCAS{
+				client:               tt.client,
+				certificateAuthority: testAuthorityName,
+			}
+			_, _, err := c.createCertificate(tt.tpl, 24*time.Hour, "test-certificate", "request-id")
+			if (err != nil) != tt.wantErr {
+				t.Errorf("CloudCAS.createCertificate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCloudCAS_createCertificate_lifetime(t *testing.T) {
+	withMaxLifetime := func(d time.Duration) *testClient {
+		client := okTestClient()
+		client.certificateAuthority.CertificatePolicy = &pb.CertificateAuthority_CertificateAuthorityPolicy{
+			MaximumLifetime: durationpb.New(d),
+		}
+		return client
+	}
+	leaf := func() *x509.Certificate {
+		crt := mustParseCertificate(t, testLeafCertificate)
+		crt.SignatureAlgorithm = x509.UnknownSignatureAlgorithm
+		return crt
+	}
+
+	tests := []struct {
+		name         string
+		client       *testClient
+		lifetime     time.Duration
+		wantCreate   bool
+		wantErr      bool
+		wantContains string
+	}{
+		{"ok", withMaxLifetime(24 * time.Hour), time.Hour, true, false, ""},
+		{"ok equal", withMaxLifetime(24 * time.Hour), 24 * time.Hour, true, false, ""},
+		{"ok no policy", okTestClient(), 365 * 24 * time.Hour, true, false, ""},
+		{"ok zero max lifetime", withMaxLifetime(0), 365 * 24 * time.Hour, true, false, ""},
+		{"fail over limit", withMaxLifetime(24 * time.Hour), 25 * time.Hour, false, true, "exceeds the maximum lifetime 24h0m0s"},
+		{"fail GetCertificateAuthority", failTestClient(), time.Hour, false, true, "cloudCAS GetCertificateAuthority failed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &CloudCAS{
+				client:               tt.client,
+				certificateAuthority: testAuthorityName,
+			}
+			_, _, err := c.createCertificate(leaf(), tt.lifetime, "test-certificate", "")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("CloudCAS.createCertificate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !strings.Contains(err.Error(), tt.wantContains) {
+				t.Errorf("CloudCAS.createCertificate() error = %v, want it to contain %q", err, tt.wantContains)
+			}
+			if created := tt.client.createRequest != nil; created != tt.wantCreate {
+				t.Errorf("CreateCertificate called = %v, want %v", created, tt.wantCreate)
+			}
+		})
+	}
+
+	t.Run("cache", func(t *testing.T) {
+		client := withMaxLifetime(24 * time.Hour)
+		c := &CloudCAS{
+			client:               client,
+			certificateAuthority: testAuthorityName,
+		}
+		for i := 0; i < 3; i++ {
+			if _, _, err := c.createCertificate(leaf(), time.Hour, "test-certificate", ""); err != nil {
+				t.Fatalf("CloudCAS.createCertificate() error = %v", err)
+			}
+		}
+		if client.getCalls != 1 {
+			t.Errorf("GetCertificateAuthority calls = %d, want 1", client.getCalls)
+		}
+
+		// Expire the cache.
+		c.caCache[testAuthorityName].expiry = time.Now().Add(-time.Second)
+		if _, _, err := c.createCertificate(leaf(), time.Hour, "test-certificate", ""); err != nil {
+			t.Fatalf("CloudCAS.createCertificate() error = %v", err)
+		}
+		if client.getCalls != 2 {
+			t.Errorf("GetCertificateAuthority calls = %d, want 2", client.getCalls)
+		}
+
+		// The cache is shared with GetCertificateAuthority.
+		if _, err := c.GetCertificateAuthority(&apiv1.GetCertificateAuthorityRequest{}); err != nil {
+			t.Fatalf("CloudCAS.GetCertificateAuthority() error = %v", err)
+		}
+		if client.getCalls != 2 {
+			t.Errorf("GetCertificateAuthority calls = %d, want 2", client.getCalls)
+		}
+		if _, err := c.GetCertificateAuthority(&apiv1.GetCertificateAuthorityRequest{NoCache: true}); err != nil {
+			t.Fatalf("CloudCAS.GetCertificateAuthority() error = %v", err)
+		}
+		if _, _, err := c.createCertificate(leaf(), time.Hour, "test-certificate", ""); err != nil {
+			t.Fatalf("CloudCAS.createCertificate() error = %v", err)
+		}
+		if client.getCalls != 3 {
+			t.Errorf("GetCertificateAuthority calls = %d, want 3", client.getCalls)
+		}
+	})
+}
+
+func TestCloudCAS_createCertificate_reusableConfig(t *testing.T) {
+	reusableConfig := "projects/test-project/locations/us-west1/reusableConfigs/leaf-server-tls"
+	tests := []struct {
+		name           string
+		reusableConfig string
+		wantName       string
+		wantValues     bool
+	}{
+		{"ok inline", "", "", true},
+		{"ok reusable config", reusableConfig, reusableConfig, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			leaf := mustParseCertificate(t, testLeafCertificate)
+			leaf.SignatureAlgorithm = x509.UnknownSignatureAlgorithm
+			client := okTestClient()
+			c := &CloudCAS{
+				client:               client,
+				certificateAuthority: testAuthorityName,
+				reusableConfig:       tt.reusableConfig,
+			}
+			if _, _, err := c.createCertificate(leaf, 24*time.Hour, "test-certificate", "request-id"); err != nil {
+				t.Fatalf("CloudCAS.createCertificate() error = %v", err)
+			}
+			rc := client.createRequest.GetCertificate().GetConfig().GetReusableConfig()
+			if got := rc.GetReusableConfig(); got != tt.wantName {
+				t.Errorf("ReusableConfig = %s, want %s", got, tt.wantName)
+			}
+			if got := rc.GetReusableConfigValues() != nil; got != tt.wantValues {
+				t.Errorf("ReusableConfigValues = %v, want values %v", rc.GetReusableConfigValues(), tt.wantValues)
+			}
+		})
+	}
+}
+
+func TestCloudCAS_createCertificate_keyUsages(t *testing.T) {
+	template := func() *x509.Certificate {
+		leaf := mustParseCertificate(t, testLeafCertificate)
+		leaf.SignatureAlgorithm = x509.UnknownSignatureAlgorithm
+		leaf.KeyUsage = x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment
+		leaf.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageCodeSigning}
+		leaf.UnknownExtKeyUsage = []asn1.ObjectIdentifier{{1, 2, 3, 4}}
+		return leaf
+	}
+
+	tests := []struct {
+		name            string
+		keyUsage        x509.KeyUsage
+		extKeyUsage     []x509.ExtKeyUsage
+		wantKeyUsage    *pb.KeyUsage_KeyUsageOptions
+		wantExtKeyUsage *pb.KeyUsage_ExtendedKeyUsageOptions
+		wantUnknown     []*pb.ObjectId
+	}{
+		{"ok no restrictions", 0, nil,
+			&pb.KeyUsage_KeyUsageOptions{DigitalSignature: true, KeyEncipherment: true},
+			&pb.KeyUsage_ExtendedKeyUsageOptions{ServerAuth: true, ClientAuth: true, CodeSigning: true},
+			[]*pb.ObjectId{{ObjectIdPath: []int32{1, 2, 3, 4}}}},
+		{"ok key usage", x509.KeyUsageDigitalSignature, nil,
+			&pb.KeyUsage_KeyUsageOptions{DigitalSignature: true},
+			&pb.KeyUsage_ExtendedKeyUsageOptions{ServerAuth: true, ClientAuth: true, CodeSigning: true},
+			[]*pb.ObjectId{{ObjectIdPath: []int32{1, 2, 3, 4}}}},
+		{"ok no code signing", 0, []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+			&pb.KeyUsage_KeyUsageOptions{DigitalSignature: true, KeyEncipherment: true},
+			&pb.KeyUsage_ExtendedKeyUsageOptions{ServerAuth: true, ClientAuth: true},
+			nil},
+		{"ok both", x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign, []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+			&pb.KeyUsage_KeyUsageOptions{DigitalSignature: true},
+			&pb.KeyUsage_ExtendedKeyUsageOptions{ClientAuth: true},
+			nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := okTestClient()
+			c := &CloudCAS{
+				client:               client,
+				certificateAuthority: testAuthorityName,
+				keyUsage:             tt.keyUsage,
+				extKeyUsage:          tt.extKeyUsage,
+			}
+			if _, _, err := c.createCertificate(template(), 24*time.Hour, "test-certificate", "request-id"); err != nil {
+				t.Fatalf("CloudCAS.createCertificate() error = %v", err)
+			}
+			ku := client.createRequest.GetCertificate().GetConfig().GetReusableConfig().GetReusableConfigValues().GetKeyUsage()
+			if !proto.Equal(ku.BaseKeyUsage, tt.wantKeyUsage) {
+				t.Errorf("BaseKeyUsage = %v, want %v", ku.BaseKeyUsage, tt.wantKeyUsage)
+			}
+			if !proto.Equal(ku.ExtendedKeyUsage, tt.wantExtKeyUsage) {
+				t.Errorf("ExtendedKeyUsage = %v, want %v", ku.ExtendedKeyUsage, tt.wantExtKeyUsage)
+			}
+			if len(ku.UnknownExtendedKeyUsages) != len(tt.wantUnknown) {
+				t.Fatalf("UnknownExtendedKeyUsages = %v, want %v", ku.UnknownExtendedKeyUsages, tt.wantUnknown)
+			}
+			for i := range tt.wantUnknown {
+				if !proto.Equal(ku.UnknownExtendedKeyUsages[i], tt.wantUnknown[i]) {
+					t.Errorf("UnknownExtendedKeyUsages = %v, want %v", ku.UnknownExtendedKeyUsages, tt.wantUnknown)
+				}
+			}
+		})
+	}
+}
+
+type testCallOption struct {
+	name string
+}
+
+func (o testCallOption) Resolve(*gax.CallSettings) {}
+
+func TestCloudCAS_callOptions(t *testing.T) {
+	tmp := newCertificateAuthorityClient
+	t.Cleanup(func() {
+		newCertificateAuthorityClient = tmp
+	})
+
+	leaf := mustParseCertificate(t, testLeafCertificate)
+	leaf.SignatureAlgorithm = x509.UnknownSignatureAlgorithm
+	signed := mustParseCertificate(t, testSignedCertificate)
+	callOptions := []gax.CallOption{testCallOption{"retry"}, testCallOption{"timeout"}}
+
+	tests := []struct {
+		name string
+		fn   func(c *CloudCAS) error
+	}{
+		{"GetCertificateAuthority", func(c *CloudCAS) error {
+			_, err := c.GetCertificateAuthority(&apiv1.GetCertificateAuthorityRequest{})
+			return err
+		}},
+		{"CreateCertificate", func(c *CloudCAS) error {
+			_, err := c.CreateCertificate(&apiv1.CreateCertificateRequest{Template: leaf, Lifetime: time.Hour})
+			return err
+		}},
+		{"RenewCertificate", func(c *CloudCAS) error {
+			_, err := c.RenewCertificate(&apiv1.RenewCertificateRequest{Template: leaf, Lifetime: time.Hour})
+			return err
+		}},
+		{"RevokeCertificate", func(c *CloudCAS) error {
+			_, err := c.RevokeCertificate(&apiv1.RevokeCertificateRequest{Certificate: signed, ReasonCode: 1})
+			return err
+		}},
+		{"checkState", func(c *CloudCAS) error {
+			return c.checkState(context.Background())
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := okTestClient()
+			client.certificateAuthority.State = pb.CertificateAuthority_ENABLED
+			newCertificateAuthorityClient = func(ctx context.Context, opts apiv1.Options) (CertificateAuthorityClient, error) {
+				return client, nil
+			}
+			c, err := New(context.Background(), apiv1.Options{
+				CertificateAuthority: testAuthorityName,
+				CallOptions:          callOptions,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := tt.fn(c); err != nil {
+				t.Fatalf("CloudCAS.%s() error = %v", tt.name, err)
+			}
+			if !reflect.DeepEqual(client.callOptions, callOptions) {
+				t.Errorf("CloudCAS.%s() call options = %v, want %v", tt.name, client.callOptions, callOptions)
+			}
+		})
+	}
+}
@@ -24,8 +24,9 @@ var now = func() time.Time {
 // SoftCAS implements a Certificate Authority Service using Golang or KMS
 // crypto. This is the default CAS used in step-ca.
 type SoftCAS struct {
-	Issuer *x509.Certificate
-	Signer crypto.Signer
+	Issuer        *x509.Certificate
+	Signer        crypto.Signer
+	Intermediates []*x509.Certificate
 }
 
 // New creates a new CertificateAuthorityService implementation using Golang or KMS
@@ -38,8 +39,9 @@ func New(ctx context.Context, opts apiv1.Options) (*SoftCAS, error) {
 		return nil, errors.New("softCAS 'signer' cannot be nil")
 	}
 	return &SoftCAS{
-		Issuer: opts.Issuer,
-		Signer: opts.Signer,
+		Issuer:        opts.Issuer,
+		Signer:        opts.Signer,
+		Intermediates: opts.Intermediates,
 	}, nil
 }
 
@@ -68,10 +70,8 @@ func (c *SoftCAS) CreateCertificate(req *apiv1.CreateCertificateRequest) (*apiv1
 	}
 
 	return &apiv1.CreateCertificateResponse{
-		Certificate: cert,
-		CertificateChain: []*x509.Certificate{
-			c.Issuer,
-		},
+		Certificate:      cert,
+		CertificateChain: c.getCertificateChain(),
 	}, nil
 }
 
@@ -95,10 +95,8 @@ func (c *SoftCAS) RenewCertificate(req *apiv1.RenewCertificateRequest) (*apiv1.R
 	}
 
 	return &apiv1.RenewCertificateResponse{
-		Certificate: cert,
-		CertificateChain: []*x509.Certificate{
-			c.Issuer,
-		},
+		Certificate:      cert,
+		CertificateChain: c.getCertificateChain(),
 	}, nil
 }
 
@@ -107,9 +105,13 @@ func (c *SoftCAS) RenewCertificate(req *apiv1.RenewCertificateRequest) (*apiv1.R
 // in the db.
 func (c *SoftCAS) RevokeCertificate(req *apiv1.RevokeCertificateRequest) (*apiv1.RevokeCertificateResponse, error) {
 	return &apiv1.RevokeCertificateResponse{
-		Certificate: req.Certificate,
-		CertificateChain: []*x509.Certificate{
-			c.Issuer,
-		},
+		Certificate:      req.Certificate,
+		CertificateChain: c.getCertificateChain(),
 	}, nil
 }
+
+// getCertificateChain returns the issuer and the intermediates sent along with
+// the signed certificates.
+func (c *SoftCAS) getCertificateChain() []*x509.Certificate {
+	return append([]*x509.Certificate{c.Issuer}, c.Intermediates...)
+}
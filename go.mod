@@ -27,6 +27,7 @@ require (
 	google.golang.org/grpc v1.32.0
 	google.golang.org/protobuf v1.25.0
 	gopkg.in/square/go-jose.v2 v2.5.1
+	software.sslmate.com/src/go-pkcs12 v0.0.0-20201103104416-57fc603b7f52
 // cloud.google.com/go/security/privateca/apiv1alpha1 v0.0.0
 // google.golang.org/genproto/googleapis/cloud/security/privateca/v1alpha1 v0.0.0
 )
@@ -0,0 +1,115 @@
+package pki
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"go.step.sm/cli-utils/errs"
+)
+
+// openSSLConfig is a minimal configuration for `openssl ca` that signs leaf
+// certificates with the intermediate. The first argument is the directory of
+// the OpenSSL database, followed by the intermediate certificate and key.
+const openSSLConfig = `# OpenSSL CA configuration generated by step.
+#
+# Sign a certificate request with the intermediate:
+#   openssl ca -config %[1]s -in request.csr -out certificate.crt
+
+[ ca ]
+default_ca = intermediate_ca
+
+[ intermediate_ca ]
+dir             = %[2]s
+database        = $dir/index.txt
+new_certs_dir   = $dir/newcerts
+rand_serial     = yes
+unique_subject  = no
+certificate     = %[3]s
+private_key     = %[4]s
+default_md      = sha256
+default_days    = 1
+copy_extensions = copy
+policy          = policy_anything
+x509_extensions = leaf_ext
+
+[ policy_anything ]
+countryName            = optional
+stateOrProvinceName    = optional
+localityName           = optional
+organizationName       = optional
+organizationalUnitName = optional
+commonName             = supplied
+emailAddress           = optional
+
+[ leaf_ext ]
+basicConstraints       = critical, CA:FALSE
+keyUsage               = critical, digitalSignature
+extendedKeyUsage       = serverAuth, clientAuth
+subjectKeyIdentifier   = hash
+authorityKeyIdentifier = keyid
+`
+
+// openSSLRootConfig is the section of the OpenSSL configuration that signs
+// intermediates with the root. It's only added if the root key is on disk.
+const openSSLRootConfig = `
+# Sign an intermediate certificate request with the root:
+#   openssl ca -config %[1]s -name root_ca -in request.csr -out intermediate.crt
+
+[ root_ca ]
+dir             = %[2]s
+database        = $dir/index.txt
+new_certs_dir   = $dir/newcerts
+rand_serial     = yes
+unique_subject  = no
+certificate     = %[3]s
+private_key     = %[4]s
+default_md      = sha256
+default_days    = 3650
+policy          = policy_anything
+x509_extensions = intermediate_ext
+
+[ intermediate_ext ]
+basicConstraints       = critical, CA:TRUE, pathlen:0
+keyUsage               = critical, digitalSignature, keyCertSign, cRLSign
+subjectKeyIdentifier   = hash
+authorityKeyIdentifier = keyid
+`
+
+// WriteOpenSSLConfig writes to path an OpenSSL configuration that can be used
+// with `openssl ca` to sign certificates with the intermediate and, if its key
+// is on disk, with the root. The OpenSSL database is created in the directory
+// of path.
+func (p *PKI) WriteOpenSSLConfig(path string) error {
+	if p.isRegistrationAuthority() {
+		return errors.New("an OpenSSL configuration cannot be generated for a registration authority")
+	}
+
+	filename, err := filepath.Abs(path)
+	if err != nil {
+		return errors.Wrapf(err, "error getting absolute path for %s", path)
+	}
+	dir := filepath.Dir(filename)
+
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, openSSLConfig, filename, dir, p.intermediate, p.intermediateKey)
+	if p.keyManager == nil {
+		fmt.Fprintf(buf, openSSLRootConfig, filename, dir, p.root, p.rootKey)
+	}
+
+	// Create the database used by openssl ca.
+	newCerts := filepath.Join(dir, "newcerts")
+	if err := os.MkdirAll(newCerts, 0700); err != nil {
+		return errs.FileError(err, newCerts)
+	}
+	index := filepath.Join(dir, "index.txt")
+	if _, err := os.Stat(index); os.IsNotExist(err) {
+		if err := writeFileAtomic(index, nil, 0600); err != nil {
+			return err
+		}
+	}
+
+	return writeFile(filename, buf.Bytes(), 0600)
+}
@@ -1,29 +1,47 @@
 package pki
 
 import (
+	"bytes"
 	"context"
 	"crypto"
-	"crypto/sha256"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
 	"crypto/x509"
-	"encoding/hex"
+	"crypto/x509/pkix"
+	"encoding/asn1"
 	"encoding/json"
 	"encoding/pem"
 	"fmt"
 	"html"
+	"io"
+	"io/ioutil"
+	"math/big"
 	"net"
+	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/pkg/errors"
+	"github.com/smallstep/certificates/api"
 	"github.com/smallstep/certificates/authority"
 	"github.com/smallstep/certificates/authority/provisioner"
 	"github.com/smallstep/certificates/ca"
 	"github.com/smallstep/certificates/cas"
 	"github.com/smallstep/certificates/cas/apiv1"
 	"github.com/smallstep/certificates/db"
+	"github.com/smallstep/certificates/kms"
+	kmsapi "github.com/smallstep/certificates/kms/apiv1"
+	"github.com/smallstep/certificates/templates"
+	"github.com/smallstep/nosql"
+	"go.step.sm/cli-utils/command"
 	"go.step.sm/cli-utils/config"
 	"go.step.sm/cli-utils/errs"
 	"go.step.sm/cli-utils/fileutil"
@@ -31,8 +49,11 @@ import (
 	"go.step.sm/crypto/jose"
 	"go.step.sm/crypto/keyutil"
 	"go.step.sm/crypto/pemutil"
+	"go.step.sm/crypto/sshutil"
 	"go.step.sm/crypto/x509util"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/terminal"
+	"software.sslmate.com/src/go-pkcs12"
 )
 
 const (
@@ -93,8 +114,85 @@ func GetTemplatesPath() string {
 	return filepath.Join(config.StepPath(), templatesPath)
 }
 
-// GetProvisioners returns the map of provisioners on the given CA.
-func GetProvisioners(caURL, rootFile string) (provisioner.List, error) {
+// ListOption is the type of options used to modify the list of provisioners
+// returned by GetProvisioners.
+type ListOption func(o *listOptions)
+
+type listOptions struct {
+	limit      int
+	maxResults int
+	attempts   int
+	types      []provisioner.Type
+	names      []string
+}
+
+func (o *listOptions) match(p provisioner.Interface) bool {
+	if len(o.types) > 0 && !containsType(o.types, p.GetType()) {
+		return false
+	}
+	if len(o.names) > 0 && !containsString(o.names, p.GetName()) {
+		return false
+	}
+	return true
+}
+
+// WithListLimit sets the number of provisioners requested on each page. It
+// defaults to 100.
+func WithListLimit(limit int) ListOption {
+	return func(o *listOptions) {
+		o.limit = limit
+	}
+}
+
+// WithMaxResults sets the maximum number of provisioners to return. By default
+// all the provisioners are returned.
+func WithMaxResults(n int) ListOption {
+	return func(o *listOptions) {
+		o.maxResults = n
+	}
+}
+
+// WithListAttempts sets the number of times a page is requested before
+// failing, transient errors like network errors or 5xx responses are retried
+// with an exponential backoff. It defaults to 3.
+func WithListAttempts(n int) ListOption {
+	return func(o *listOptions) {
+		o.attempts = n
+	}
+}
+
+// WithTypeFilter returns only the provisioners of the given types.
+func WithTypeFilter(types ...provisioner.Type) ListOption {
+	return func(o *listOptions) {
+		o.types = append(o.types, types...)
+	}
+}
+
+// WithNameFilter returns only the provisioners with the given names.
+func WithNameFilter(names ...string) ListOption {
+	return func(o *listOptions) {
+		o.names = append(o.names, names...)
+	}
+}
+
+// GetProvisioners returns the map of provisioners on the given CA. By default
+// it fetches all the pages, the given options can be used to limit or filter
+// the results.
+func GetProvisioners(caURL, rootFile string, opts ...ListOption) (provisioner.List, error) {
+	o := &listOptions{limit: 100, attempts: 3}
+	for _, fn := range opts {
+		fn(o)
+	}
+	if o.limit <= 0 {
+		return nil, errors.Errorf("invalid list limit %d", o.limit)
+	}
+	if o.maxResults < 0 {
+		return nil, errors.Errorf("invalid max results %d", o.maxResults)
+	}
+	if o.attempts <= 0 {
+		return nil, errors.Errorf("invalid list attempts %d", o.attempts)
+	}
+
 	if len(rootFile) == 0 {
 		rootFile = GetRootCAPath()
 	}
@@ -105,11 +203,27 @@ func GetProvisioners(caURL, rootFile string) (provisioner.List, error) {
 	cursor := ""
 	provisioners := provisioner.List{}
 	for {
-		resp, err := client.Provisioners(ca.WithProvisionerCursor(cursor), ca.WithProvisionerLimit(100))
-		if err != nil {
-			return nil, err
+		// Transient errors only retry the current page.
+		var resp *api.ProvisionersResponse
+		for i, backoff := 1, listBackoff; ; i, backoff = i+1, 2*backoff {
+			resp, err = client.Provisioners(ca.WithProvisionerCursor(cursor), ca.WithProvisionerLimit(o.limit))
+			if err == nil {
+				break
+			}
+			if i >= o.attempts || !isTransientError(err) {
+				return nil, err
+			}
+			time.Sleep(backoff)
+		}
+		for _, p := range resp.Provisioners {
+			if !o.match(p) {
+				continue
+			}
+			provisioners = append(provisioners, p)
+			if o.maxResults > 0 && len(provisioners) == o.maxResults {
+				return provisioners, nil
+			}
 		}
-		provisioners = append(provisioners, resp.Provisioners...)
 		if resp.NextCursor == "" {
 			return provisioners, nil
 		}
@@ -117,6 +231,80 @@ func GetProvisioners(caURL, rootFile string) (provisioner.List, error) {
 	}
 }
 
+// listBackoff is the time to wait before the first retry of a page of
+// provisioners. This variable is used for testing purposes.
+var listBackoff = 500 * time.Millisecond
+
+// isTransientError returns true if the error returned by the CA client is
+// caused by a network error, a 429 or a 5xx response.
+func isTransientError(err error) bool {
+	var sc interface{ StatusCode() int }
+	if errors.As(err, &sc) {
+		code := sc.StatusCode()
+		return code == http.StatusTooManyRequests || code >= http.StatusInternalServerError
+	}
+	var urlErr *url.Error
+	return errors.As(err, &urlErr)
+}
+
+func containsType(types []provisioner.Type, typ provisioner.Type) bool {
+	for _, t := range types {
+		if t == typ {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(sl []string, s string) bool {
+	for _, v := range sl {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// BootstrapRoot downloads the root certificate from the CA at caURL, verifies
+// that its SHA-256 fingerprint matches the given one, and writes it to
+// GetRootCAPath().
+func BootstrapRoot(caURL, fingerprint string) (*x509.Certificate, error) {
+	return bootstrapRoot(caURL, fingerprint, GetRootCAPath())
+}
+
+func bootstrapRoot(caURL, fingerprint, rootFile string) (*x509.Certificate, error) {
+	if fingerprint == "" {
+		return nil, errors.New("fingerprint cannot be empty")
+	}
+	client, err := ca.NewClient(caURL, ca.WithTransport(http.DefaultTransport))
+	if err != nil {
+		return nil, err
+	}
+	// Root verifies the fingerprint of the downloaded certificate.
+	resp, err := client.Root(fingerprint)
+	if err != nil {
+		return nil, errors.Wrap(err, "error downloading root certificate")
+	}
+	root := resp.RootPEM.Certificate
+	if !VerifyFingerprint(root, strings.Replace(fingerprint, "-", "", -1), x509util.HexFingerprint) {
+		return nil, errors.New("root certificate fingerprint does not match")
+	}
+
+	b, err := encode(func(w io.Writer) error {
+		return writeCertificates(w, root)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(rootFile), 0700); err != nil {
+		return nil, errs.FileError(err, rootFile)
+	}
+	if err := writeFile(rootFile, b, 0600); err != nil {
+		return nil, err
+	}
+	return root, nil
+}
+
 func generateDefaultKey() (crypto.Signer, error) {
 	priv, err := keyutil.GenerateDefaultKey()
 	if err != nil {
@@ -129,6 +317,192 @@ func generateDefaultKey() (crypto.Signer, error) {
 	return signer, nil
 }
 
+// writeData writes the data in the given writer. This variable is used for
+// testing purposes.
+var writeData = func(w io.Writer, data []byte) error {
+	_, err := w.Write(data)
+	return err
+}
+
+// writeFile writes the data to the given filename atomically, the data is first
+// written to a temporary file in the same directory and then renamed, so a
+// failure never leaves a partially written file. Like fileutil.WriteFile, it
+// asks for confirmation before overwriting an existing file unless the force
+// flag is set.
+func writeFile(filename string, data []byte, perm os.FileMode) error {
+	if !command.IsForce() {
+		st, err := os.Stat(filename)
+		switch {
+		case os.IsNotExist(err):
+		case err != nil:
+			return errors.Wrapf(err, "error reading information for %s", filename)
+		case st.IsDir():
+			return fileutil.ErrIsDir
+		default:
+			str, err := ui.Prompt(fmt.Sprintf("Would you like to overwrite %s [y/n]", filename), ui.WithValidateYesNo())
+			if err != nil {
+				return err
+			}
+			if s := strings.ToLower(strings.TrimSpace(str)); s == "n" || s == "no" {
+				return fileutil.ErrFileExists
+			}
+		}
+	}
+	return writeFileAtomic(filename, data, perm)
+}
+
+// writeFileAtomic writes the data to the given filename atomically, without
+// asking for confirmation if the file already exists.
+func writeFileAtomic(filename string, data []byte, perm os.FileMode) error {
+	f, err := ioutil.TempFile(filepath.Dir(filename), "."+filepath.Base(filename)+".*")
+	if err != nil {
+		return errs.FileError(err, filename)
+	}
+	tmp := f.Name()
+	if err := writeData(f, data); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return errs.FileError(err, filename)
+	}
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return errs.FileError(err, filename)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return errs.FileError(err, filename)
+	}
+	if err := os.Rename(tmp, filename); err != nil {
+		os.Remove(tmp)
+		return errs.FileError(err, filename)
+	}
+	return nil
+}
+
+// writeFile writes the data to the given filename like writeFile, and if the
+// file did not exist, it records it so it can be removed by Cleanup.
+func (p *PKI) writeFile(filename string, data []byte, perm os.FileMode) error {
+	_, err := os.Stat(filename)
+	created := os.IsNotExist(err)
+	if err := writeFile(filename, data, perm); err != nil {
+		return err
+	}
+	if created {
+		p.createdFiles = append(p.createdFiles, filename)
+	}
+	return nil
+}
+
+// writeKey serializes the given private key encrypted with the given password
+// and writes it atomically to filename.
+func (p *PKI) writeKey(filename string, key interface{}, pass []byte) error {
+	b, err := encode(func(w io.Writer) error {
+		return p.writePrivateKey(w, key, pass)
+	})
+	if err != nil {
+		return err
+	}
+	return p.writeFile(filename, b, 0600)
+}
+
+// writeCertificates writes the given certificates in w as a PEM bundle.
+func writeCertificates(w io.Writer, certs ...*x509.Certificate) error {
+	for _, crt := range certs {
+		if err := pem.Encode(w, &pem.Block{
+			Type:  "CERTIFICATE",
+			Bytes: crt.Raw,
+		}); err != nil {
+			return errors.Wrap(err, "error writing certificate")
+		}
+	}
+	return nil
+}
+
+// writePrivateKey writes the given key in w as a PEM block encrypted with the
+// given password. An empty password writes the key unencrypted, but only if
+// it has been explicitly allowed with SetInsecureNoPassword.
+func (p *PKI) writePrivateKey(w io.Writer, key interface{}, pass []byte) error {
+	var opts []pemutil.Options
+	if len(pass) > 0 {
+		opts = append(opts, pemutil.WithPassword(pass))
+	} else if !p.insecureNoPassword {
+		return errors.New("error writing private key: the password cannot be empty, use SetInsecureNoPassword to write unencrypted keys")
+	}
+	block, err := pemutil.Serialize(key, opts...)
+	if err != nil {
+		return err
+	}
+	return errors.Wrap(pem.Encode(w, block), "error writing private key")
+}
+
+// EncryptKeyFile encrypts with the given password the unencrypted private key
+// in path, replacing the file atomically. It returns an error if the key is
+// already encrypted, so an existing password is never replaced.
+func EncryptKeyFile(path string, pass []byte) error {
+	if len(pass) == 0 {
+		return errors.New("error encrypting private key: the password cannot be empty")
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return errs.FileError(err, path)
+	}
+	block, _ := pem.Decode(b)
+	switch {
+	case block == nil:
+		return errors.Errorf("error decoding %s: not a valid PEM encoded block", path)
+	case block.Type == "ENCRYPTED PRIVATE KEY" || x509.IsEncryptedPEMBlock(block): // nolint:staticcheck
+		return errors.Errorf("error encrypting %s: the private key is already encrypted", path)
+	}
+	key, err := pemutil.ParseKey(b)
+	if err != nil {
+		return errors.Wrapf(err, "error parsing %s", path)
+	}
+	if _, ok := key.(crypto.Signer); !ok {
+		return errors.Errorf("error encrypting %s: the file does not contain a private key", path)
+	}
+	block, err = pemutil.Serialize(key, pemutil.WithPassword(pass))
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, pem.EncodeToMemory(block), 0600)
+}
+
+// encode returns the data written by fn.
+func encode(fn func(w io.Writer) error) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := fn(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// isTerminal returns true if the standard input is a terminal. This variable
+// is used for testing purposes.
+var isTerminal = func() bool {
+	return terminal.IsTerminal(int(os.Stdin.Fd()))
+}
+
+// promptPassword asks the user for a password. This variable is used for
+// testing purposes.
+var promptPassword = func(label string) ([]byte, error) {
+	return ui.PromptPassword(label, ui.WithValidateNotEmpty())
+}
+
+// promptPasswordIfNeeded returns the given password if it's not nil, otherwise
+// it will prompt the user for one. To avoid hanging in non-interactive
+// environments, the prompt is only shown if the standard input is a terminal,
+// an error is returned if it's not.
+func promptPasswordIfNeeded(pass []byte, name string) ([]byte, error) {
+	if pass != nil {
+		return pass, nil
+	}
+	if !isTerminal() {
+		return nil, errors.Errorf("a password is required to encrypt the %s, but it cannot be prompted because stdin is not a terminal", name)
+	}
+	return promptPassword(fmt.Sprintf("Please enter the password to encrypt the %s", name))
+}
+
 // GetProvisionerKey returns the encrypted provisioner key with the for the
 // given kid.
 func GetProvisionerKey(caURL, rootFile, kid string) (string, error) {
@@ -148,83 +522,313 @@ func GetProvisionerKey(caURL, rootFile, kid string) (string, error) {
 
 // PKI represents the Public Key Infrastructure used by a certificate authority.
 type PKI struct {
+	base                           string
 	root, rootKey, rootFingerprint string
 	intermediate, intermediateKey  string
+	crlSigner, crlSignerKey        string
 	sshHostPubKey, sshHostKey      string
 	sshUserPubKey, sshUserKey      string
-	config, defaults               string
+	config, defaults, provenance   string
+	defaultsProfile                string
+	skipDefaults                   bool
+	writeProvenance                bool
 	ottPublicKey                   *jose.JSONWebKey
 	ottPrivateKey                  *jose.JSONWebEncryption
 	provisioner                    string
 	address                        string
 	dnsNames                       []string
+	primaryDNSName                 string
+	ipAddresses                    []net.IP
 	caURL                          string
 	enableSSH                      bool
+	sshCriticalOptions             map[string]string
+	sshExtensions                  map[string]string
+	extraExtensions                []pkix.Extension
+	certificatePolicies            *pkix.Extension
+	intermediates                  []*x509.Certificate
+	keyManager                     kms.KeyManager
+	rootKeyName                    string
+	rootKeyURI                     string
+	subjectKeyIDMethod             SubjectKeyIDMethod
 	authorityOptions               *apiv1.Options
+	strict                         bool
+	insecureNoPassword             bool
+	intermediateLifetime           time.Duration
+	serialNumberGenerator          SerialNumberGenerator
+	serialNumbers                  map[string]bool
+	templateData                   map[string]interface{}
+	federatedRoots                 []string
+	federatedCerts                 []*x509.Certificate
+	createdFiles                   []string
+	sshOrganization                string
+	issuingCertificateURL          []string
+	hooks                          Hooks
+	rootPassword                   []byte
+	intermediatePassword           []byte
 }
 
+// Environment variables used by New to initialize the address and dns names
+// of the CA.
+const (
+	addressEnv  = "STEP_CA_ADDRESS"
+	dnsNamesEnv = "STEP_CA_DNS"
+)
+
 // New creates a new PKI configuration.
+//
+// The address and dns names of the CA default to the values in the
+// STEP_CA_ADDRESS and STEP_CA_DNS (a comma-separated list) environment
+// variables, or to 127.0.0.1:9000 and 127.0.0.1 if they are not set. The
+// values set with SetAddress and SetDNSNames take precedence over both.
 func New() (*PKI, error) {
-	public := GetPublicPath()
-	private := GetSecretsPath()
-	config := GetConfigPath()
+	p := &PKI{
+		provisioner: "step-cli",
+		address:     "127.0.0.1:9000",
+		dnsNames:    []string{"127.0.0.1"},
+	}
+	if err := p.loadEnv(); err != nil {
+		return nil, err
+	}
+	if err := p.SetBaseDir(config.StepPath()); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// loadEnv sets the address and dns names from the environment if they are
+// defined.
+func (p *PKI) loadEnv() error {
+	if address := os.Getenv(addressEnv); address != "" {
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			return errors.Wrapf(err, "error parsing %s", addressEnv)
+		}
+		p.address = address
+	}
+	if s := os.Getenv(dnsNamesEnv); s != "" {
+		var names []string
+		for _, name := range strings.Split(s, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, name)
+			}
+		}
+		if len(names) == 0 {
+			return errors.Errorf("error parsing %s: %q does not contain any dns name", dnsNamesEnv, s)
+		}
+		p.dnsNames = names
+	}
+	return nil
+}
+
+// SetBaseDir sets the directory where the PKI files will be stored, by default
+// this is the STEPPATH. It creates the required directories and updates the
+// paths of all the files generated. Using a different base directory per PKI
+// allows to generate multiple PKIs concurrently.
+func (p *PKI) SetBaseDir(dir string) error {
+	base, err := filepath.Abs(dir)
+	if err != nil {
+		return errors.Wrapf(err, "error getting absolute path for %s", dir)
+	}
+
+	public := filepath.Join(base, publicPath)
+	private := filepath.Join(base, privatePath)
+	config := filepath.Join(base, configPath)
 
 	// Create directories
-	dirs := []string{public, private, config, GetTemplatesPath()}
+	dirs := []string{public, private, config, filepath.Join(base, templatesPath)}
 	for _, name := range dirs {
-		if _, err := os.Stat(name); os.IsNotExist(err) {
+		fi, err := os.Stat(name)
+		switch {
+		case os.IsNotExist(err):
 			if err = os.MkdirAll(name, 0700); err != nil {
-				return nil, errs.FileError(err, name)
+				return baseDirError(err, base, name)
 			}
+		case err != nil:
+			return baseDirError(err, base, name)
+		case !fi.IsDir():
+			return notDirectoryError(name)
 		}
 	}
 
-	// get absolute path for dir/name
-	getPath := func(dir string, name string) (string, error) {
-		s, err := filepath.Abs(filepath.Join(dir, name))
-		return s, errors.Wrapf(err, "error getting absolute path for %s", name)
-	}
+	p.setPaths(base)
+	return nil
+}
 
-	var err error
-	p := &PKI{
-		provisioner: "step-cli",
-		address:     "127.0.0.1:9000",
-		dnsNames:    []string{"127.0.0.1"},
-	}
-	if p.root, err = getPath(public, "root_ca.crt"); err != nil {
-		return nil, err
+// setPaths sets the paths of all the files generated using the given base
+// directory.
+func (p *PKI) setPaths(base string) {
+	public := filepath.Join(base, publicPath)
+	private := filepath.Join(base, privatePath)
+	config := filepath.Join(base, configPath)
+
+	p.base = base
+	p.root = filepath.Join(public, "root_ca.crt")
+	p.rootKey = filepath.Join(private, "root_ca_key")
+	p.intermediate = filepath.Join(public, "intermediate_ca.crt")
+	p.intermediateKey = filepath.Join(private, "intermediate_ca_key")
+	p.crlSigner = filepath.Join(public, "crl_signer.crt")
+	p.crlSignerKey = filepath.Join(private, "crl_signer_key")
+	p.sshHostPubKey = filepath.Join(public, "ssh_host_ca_key.pub")
+	p.sshUserPubKey = filepath.Join(public, "ssh_user_ca_key.pub")
+	p.sshHostKey = filepath.Join(private, "ssh_host_ca_key")
+	p.sshUserKey = filepath.Join(private, "ssh_user_ca_key")
+	p.config = filepath.Join(config, "ca.json")
+	p.provenance = filepath.Join(config, "provenance.json")
+	p.defaults = filepath.Join(config, defaultsFilename(p.defaultsProfile))
+}
+
+// PlannedFile is a file or directory that will be created by a PKI.
+type PlannedFile struct {
+	Name   string
+	Path   string
+	Mode   os.FileMode
+	IsDir  bool
+	Exists bool
+}
+
+// Plan returns the files and directories that a PKI using the given base
+// directory will create, including the SSH keys and templates if enableSSH is
+// true. Unlike New, it does not create any directory, so it can be used to ask
+// for confirmation before creating a PKI. The database directory is created
+// when the CA starts.
+func Plan(dir string, enableSSH bool) ([]PlannedFile, error) {
+	base, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error getting absolute path for %s", dir)
 	}
-	if p.rootKey, err = getPath(private, "root_ca_key"); err != nil {
-		return nil, err
+
+	p := &PKI{enableSSH: enableSSH}
+	p.setPaths(base)
+	return p.plan(), nil
+}
+
+// plan returns the files and directories that the PKI will create.
+func (p *PKI) plan() []PlannedFile {
+	var files []PlannedFile
+	add := func(name, path string, mode os.FileMode, isDir bool) {
+		_, err := os.Stat(path)
+		files = append(files, PlannedFile{
+			Name:   name,
+			Path:   path,
+			Mode:   mode,
+			IsDir:  isDir,
+			Exists: err == nil,
+		})
 	}
-	if p.intermediate, err = getPath(public, "intermediate_ca.crt"); err != nil {
-		return nil, err
+
+	add("Public directory", filepath.Join(p.base, publicPath), 0700, true)
+	add("Private directory", filepath.Join(p.base, privatePath), 0700, true)
+	add("Configuration directory", filepath.Join(p.base, configPath), 0700, true)
+	add("Templates directory", p.getTemplatesPath(), 0700, true)
+	add("Root certificate", p.root, 0600, false)
+	if p.isRegistrationAuthority() {
+		if p.intermediate != "" {
+			add("Intermediate certificate", p.intermediate, 0600, false)
+		}
+	} else {
+		if p.keyManager == nil {
+			add("Root private key", p.rootKey, 0600, false)
+		}
+		add("Intermediate certificate", p.intermediate, 0600, false)
+		add("Intermediate private key", p.intermediateKey, 0600, false)
 	}
-	if p.intermediateKey, err = getPath(private, "intermediate_ca_key"); err != nil {
-		return nil, err
+	if p.enableSSH {
+		add("SSH user root certificate", p.sshUserPubKey, 0600, false)
+		add("SSH user root private key", p.sshUserKey, 0600, false)
+		add("SSH host root certificate", p.sshHostPubKey, 0600, false)
+		add("SSH host root private key", p.sshHostKey, 0600, false)
 	}
-	if p.sshHostPubKey, err = getPath(public, "ssh_host_ca_key.pub"); err != nil {
-		return nil, err
+	if !p.skipDefaults {
+		add("Default configuration", p.defaults, 0644, false)
 	}
-	if p.sshUserPubKey, err = getPath(public, "ssh_user_ca_key.pub"); err != nil {
-		return nil, err
+	add("Certificate Authority configuration", p.config, 0644, false)
+	if p.writeProvenance {
+		add("Provenance", p.provenance, 0644, false)
 	}
-	if p.sshHostKey, err = getPath(private, "ssh_host_ca_key"); err != nil {
-		return nil, err
+	add("Database folder", p.getDBPath(), 0700, true)
+
+	if t := p.getTemplates(); t != nil && t.SSH != nil {
+		dirs := map[string]bool{p.getTemplatesPath(): true}
+		for _, tpl := range append(append([]templates.Template{}, t.SSH.User...), t.SSH.Host...) {
+			filename := config.StepAbs(tpl.TemplatePath)
+			for dir := filepath.Dir(filename); !dirs[dir] && dir != p.base; dir = filepath.Dir(dir) {
+				dirs[dir] = true
+				add("Templates directory", dir, 0700, true)
+			}
+			add("Template "+tpl.Name, filename, 0644, false)
+		}
 	}
-	if p.sshUserKey, err = getPath(private, "ssh_user_ca_key"); err != nil {
-		return nil, err
+
+	return files
+}
+
+// baseDirError returns an actionable error if the directory could not be
+// created because the base directory is not writable, otherwise it returns a
+// file error.
+func baseDirError(err error, base, name string) error {
+	switch {
+	case errors.Is(err, syscall.EACCES) || errors.Is(err, syscall.EROFS):
+		return errors.Wrapf(err, "the STEPPATH %s is not writable, fix its permissions "+
+			"or set the STEPPATH environment variable to a writable directory", base)
+	case errors.Is(err, syscall.ENOTDIR):
+		return notDirectoryError(name)
+	default:
+		return errs.FileError(err, name)
 	}
-	if len(config) > 0 {
-		if p.config, err = getPath(config, "ca.json"); err != nil {
-			return nil, err
+}
+
+// notDirectoryError returns an error naming the first path, name or one of its
+// parents, that exists but is not a directory.
+func notDirectoryError(name string) error {
+	for dir := name; ; dir = filepath.Dir(dir) {
+		if fi, err := os.Stat(dir); err == nil && !fi.IsDir() {
+			return errors.Errorf("%s exists but it is not a directory, remove or rename it, "+
+				"or set the STEPPATH environment variable to a different directory", dir)
 		}
-		if p.defaults, err = getPath(config, "defaults.json"); err != nil {
-			return nil, err
+		if parent := filepath.Dir(dir); parent == dir {
+			return errors.Errorf("%s is not a directory", name)
 		}
 	}
+}
 
-	return p, nil
+var defaultsProfileRegexp = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// SetDefaultsProfile sets the name of the profile used in the defaults file.
+// With a profile, for example "prod", the defaults will be written in
+// defaults.prod.json. The unnamed defaults.json is still written if it does
+// not exist. An empty name resets the profile.
+func (p *PKI) SetDefaultsProfile(name string) error {
+	if name != "" && !defaultsProfileRegexp.MatchString(name) {
+		return errors.Errorf("invalid defaults profile %q: only letters, digits, '-' and '_' are allowed", name)
+	}
+	p.defaultsProfile = name
+	p.defaults = filepath.Join(filepath.Dir(p.defaults), defaultsFilename(name))
+	return nil
+}
+
+// SetSkipDefaults enables or disables the generation of the defaults file. If
+// skip is true, Save will only write ca.json and the templates, useful when the
+// client configuration is managed separately.
+func (p *PKI) SetSkipDefaults(skip bool) {
+	p.skipDefaults = skip
+}
+
+// defaultsFilename returns the name of the defaults file for the given
+// profile.
+func defaultsFilename(profile string) string {
+	if profile == "" {
+		return "defaults.json"
+	}
+	return "defaults." + profile + ".json"
+}
+
+// getDBPath returns the path where the file-system persistence is stored.
+func (p *PKI) getDBPath() string {
+	return filepath.Join(p.base, dbPath)
+}
+
+// getTemplatesPath returns the path where the templates are stored.
+func (p *PKI) getTemplatesPath() string {
+	return filepath.Join(p.base, templatesPath)
 }
 
 // GetCAConfigPath returns the path of the CA configuration file.
@@ -243,6 +847,77 @@ func (p *PKI) SetAuthorityOptions(opts *apiv1.Options) {
 	p.authorityOptions = opts
 }
 
+// SetKeyManager sets the key manager used to create the root key. If set, the
+// root private key will be created in the KMS with the given name, and only the
+// root certificate will be written to disk. The generated configuration does
+// not use the KMS, the CA only signs with the intermediate key, and it is
+// still written to disk. The URI of the root key in the KMS is returned by
+// SaveWithResult and recorded in the provenance.
+func (p *PKI) SetKeyManager(km kms.KeyManager, rootKeyName string) {
+	p.keyManager = km
+	p.rootKeyName = rootKeyName
+}
+
+// AddIntermediate adds an intermediate certificate between the root and the
+// issuing intermediate. Intermediates must be added in order, starting with the
+// one signed by the root, and the issuing intermediate must be signed by the
+// last one. They are written after the issuing intermediate in the certificate
+// bundle.
+func (p *PKI) AddIntermediate(crt *x509.Certificate) error {
+	if !crt.IsCA {
+		return errors.Errorf("certificate %s is not a certificate authority", crt.Subject)
+	}
+	if n := len(p.intermediates); n > 0 {
+		if err := crt.CheckSignatureFrom(p.intermediates[n-1]); err != nil {
+			return errors.Wrapf(err, "certificate %s is not signed by %s", crt.Subject, p.intermediates[n-1].Subject)
+		}
+	}
+	p.intermediates = append(p.intermediates, crt)
+	return nil
+}
+
+// AddFederatedRootFromFile adds the roots in the given PEM file to the
+// federated roots of the CA. All the certificates in the file must be
+// certificate authorities. Files with roots that have already been added are
+// ignored.
+func (p *PKI) AddFederatedRootFromFile(path string) error {
+	filename, err := filepath.Abs(path)
+	if err != nil {
+		return errors.Wrapf(err, "error getting absolute path for %s", path)
+	}
+	certs, err := pemutil.ReadCertificateBundle(filename)
+	if err != nil {
+		return err
+	}
+
+	var added bool
+	for _, crt := range certs {
+		if !crt.IsCA {
+			return errors.Errorf("certificate %s in %s is not a certificate authority", crt.Subject, path)
+		}
+		if !containsCertificate(p.federatedCerts, crt) {
+			added = true
+		}
+	}
+	if !added || containsString(p.federatedRoots, filename) {
+		return nil
+	}
+
+	p.federatedRoots = append(p.federatedRoots, filename)
+	p.federatedCerts = append(p.federatedCerts, certs...)
+	return nil
+}
+
+// containsCertificate returns true if the given certificate is in the list.
+func containsCertificate(certs []*x509.Certificate, crt *x509.Certificate) bool {
+	for _, c := range certs {
+		if c.Equal(crt) {
+			return true
+		}
+	}
+	return false
+}
+
 // SetProvisioner sets the provisioner name of the OTT keys.
 func (p *PKI) SetProvisioner(s string) {
 	p.provisioner = s
@@ -258,31 +933,316 @@ func (p *PKI) SetDNSNames(s []string) {
 	p.dnsNames = s
 }
 
-// SetCAURL sets the ca-url to use in the defaults.json.
-func (p *PKI) SetCAURL(s string) {
-	p.caURL = s
-}
-
-// GenerateKeyPairs generates the key pairs used by the certificate authority.
-func (p *PKI) GenerateKeyPairs(pass []byte) error {
-	var err error
-	// Create OTT key pair, the user doesn't need to know about this.
-	p.ottPublicKey, p.ottPrivateKey, err = jose.GenerateDefaultKeyPair(pass)
-	if err != nil {
-		return err
+// SetIPAddresses sets the IP addresses of the CA. They are added to the dns
+// names in the configuration.
+func (p *PKI) SetIPAddresses(ips []net.IP) error {
+	for _, ip := range ips {
+		if len(ip) != net.IPv4len && len(ip) != net.IPv6len {
+			return errors.Errorf("invalid IP address %v", ip)
+		}
 	}
-
+	p.ipAddresses = ips
 	return nil
 }
 
-// GenerateRootCertificate generates a root certificate with the given name.
-func (p *PKI) GenerateRootCertificate(name string, pass []byte) (*x509.Certificate, interface{}, error) {
-	signer, err := generateDefaultKey()
-	if err != nil {
-		return nil, nil, err
+// getDNSNames returns the dns names of the CA including the IP addresses.
+func (p *PKI) getDNSNames() []string {
+	names := append([]string{}, p.dnsNames...)
+	for _, ip := range p.ipAddresses {
+		name := ip.String()
+		if !containsString(names, name) {
+			names = append(names, name)
+		}
 	}
+	return names
+}
 
-	cr, err := x509util.CreateCertificateRequest(name, []string{}, signer)
+// Hooks are the functions called after each step of the PKI generation, they
+// can be used to record audit events. Hooks that are not set are ignored.
+type Hooks struct {
+	// OnRootGenerated is called with the root certificate once it has been
+	// generated and written.
+	OnRootGenerated func(crt *x509.Certificate)
+	// OnIntermediateGenerated is called with the intermediate certificate once
+	// it has been generated and written.
+	OnIntermediateGenerated func(crt *x509.Certificate)
+	// OnSSHKeysGenerated is called with the public keys of the SSH host and
+	// user CAs once they have been generated and written.
+	OnSSHKeysGenerated func(hostKey, userKey ssh.PublicKey)
+	// OnSaved is called with the configuration written by Save.
+	OnSaved func(config *authority.Config)
+}
+
+// SetHooks sets the functions called after each step of the PKI generation.
+func (p *PKI) SetHooks(hooks Hooks) {
+	p.hooks = hooks
+}
+
+// SerialNumberGenerator is the interface used to get the serial numbers of the
+// root and intermediate certificates.
+type SerialNumberGenerator interface {
+	SerialNumber() (*big.Int, error)
+}
+
+// SetSerialNumberGenerator sets the generator used for the serial numbers of
+// the root and intermediate certificates. By default, the serial numbers are
+// random.
+func (p *PKI) SetSerialNumberGenerator(g SerialNumberGenerator) {
+	p.serialNumberGenerator = g
+}
+
+// nextSerialNumber returns the serial number for the next certificate, or nil
+// if a random one should be used. Serial numbers must be positive, at most 20
+// octets long as required by RFC 5280, and different from the ones already
+// used by this PKI or by the given certificates.
+func (p *PKI) nextSerialNumber(used ...*x509.Certificate) (*big.Int, error) {
+	if p.serialNumberGenerator == nil {
+		return nil, nil
+	}
+	sn, err := p.serialNumberGenerator.SerialNumber()
+	if err != nil {
+		return nil, errors.Wrap(err, "error generating serial number")
+	}
+	switch {
+	case sn == nil || sn.Sign() <= 0:
+		return nil, errors.Errorf("invalid serial number %v: serial number must be positive", sn)
+	case len(sn.Bytes()) > 20:
+		return nil, errors.Errorf("invalid serial number %v: serial number must not be longer than 20 octets", sn)
+	case p.serialNumbers[sn.String()]:
+		return nil, errors.Errorf("invalid serial number %v: serial number has already been used", sn)
+	}
+	for _, crt := range used {
+		if crt.SerialNumber != nil && crt.SerialNumber.Cmp(sn) == 0 {
+			return nil, errors.Errorf("invalid serial number %v: serial number has already been used", sn)
+		}
+	}
+	if p.serialNumbers == nil {
+		p.serialNumbers = make(map[string]bool)
+	}
+	p.serialNumbers[sn.String()] = true
+	return sn, nil
+}
+
+// SubjectKeyIDMethod is the method used to compute the subject key identifier
+// of the root and intermediate certificates. The methods are defined in RFC
+// 5280, section 4.2.1.2.
+type SubjectKeyIDMethod int
+
+const (
+	// SubjectKeyIDSHA1 uses the SHA-1 hash of the public key, this is the
+	// default.
+	SubjectKeyIDSHA1 SubjectKeyIDMethod = iota
+	// SubjectKeyIDTruncatedSHA1 uses the four bits 0100 followed by the last 60
+	// bits of the SHA-1 hash of the public key.
+	SubjectKeyIDTruncatedSHA1
+)
+
+// SetSubjectKeyIDMethod sets the method used to compute the subject key
+// identifier of the root and intermediate certificates.
+func (p *PKI) SetSubjectKeyIDMethod(m SubjectKeyIDMethod) error {
+	switch m {
+	case SubjectKeyIDSHA1, SubjectKeyIDTruncatedSHA1:
+		p.subjectKeyIDMethod = m
+		return nil
+	default:
+		return errors.Errorf("invalid subject key identifier method %d", m)
+	}
+}
+
+// subjectKeyID returns the subject key identifier of the given public key
+// using the configured method, or nil if the default one from x509util should
+// be used.
+func (p *PKI) subjectKeyID(pub crypto.PublicKey) ([]byte, error) {
+	if p.subjectKeyIDMethod == SubjectKeyIDSHA1 {
+		return nil, nil
+	}
+	b, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, errors.Wrap(err, "error marshaling public key")
+	}
+	var info struct {
+		Algorithm        pkix.AlgorithmIdentifier
+		SubjectPublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(b, &info); err != nil {
+		return nil, errors.Wrap(err, "error unmarshaling public key")
+	}
+	hash := sha1.Sum(info.SubjectPublicKey.Bytes)
+	id := hash[len(hash)-8:]
+	id[0] = 0x40 | (id[0] & 0x0f)
+	return id, nil
+}
+
+// SetStrict enables or disables the strict mode. In strict mode, some checks
+// that would only print a warning, like an address not covered by the dns
+// names, return an error instead.
+func (p *PKI) SetStrict(strict bool) {
+	p.strict = strict
+}
+
+// SetInsecureNoPassword allows writing private keys without encryption when
+// the password is empty. By default an empty password is an error, to prevent
+// writing unencrypted private keys by accident.
+func (p *PKI) SetInsecureNoPassword(value bool) {
+	p.insecureNoPassword = value
+}
+
+// checkAddress checks that the host in the address is one of the dns names or
+// IP addresses of the CA. Wildcard binds, like ":9000" or "0.0.0.0:9000", are
+// always accepted.
+func (p *PKI) checkAddress() error {
+	host, _, err := net.SplitHostPort(p.address)
+	if err != nil {
+		return errors.Wrapf(err, "error parsing address %s", p.address)
+	}
+	if host == "" {
+		return nil
+	}
+	ip := net.ParseIP(host)
+	if ip != nil && ip.IsUnspecified() {
+		return nil
+	}
+	for _, name := range p.getDNSNames() {
+		if ip == nil {
+			if strings.EqualFold(host, name) {
+				return nil
+			}
+		} else if ip.Equal(net.ParseIP(name)) {
+			return nil
+		}
+	}
+	return errors.Errorf("address %s is not covered by the dns names %s", p.address, strings.Join(p.getDNSNames(), ", "))
+}
+
+// SetCAURL sets the ca-url to use in the defaults.json.
+func (p *PKI) SetCAURL(s string) {
+	p.caURL = s
+}
+
+// SetSSHCriticalOptions sets the critical options, like force-command or
+// source-address, that will be added by default to the SSH certificates signed
+// by the default provisioner.
+func (p *PKI) SetSSHCriticalOptions(opts map[string]string) {
+	p.sshCriticalOptions = opts
+}
+
+// SetSSHExtensions sets the extensions that will be added by default to the SSH
+// certificates signed by the default provisioner. These extensions replace the
+// default ones, like permit-pty or permit-port-forwarding.
+func (p *PKI) SetSSHExtensions(exts map[string]string) {
+	p.sshExtensions = exts
+}
+
+// SetExtraExtensions sets a list of extensions that will be added to the root
+// and intermediate certificates.
+func (p *PKI) SetExtraExtensions(exts []pkix.Extension) {
+	p.extraExtensions = exts
+}
+
+// SetIssuingCertificateURL sets the URLs of the root certificate added in the
+// Authority Information Access extension of the intermediate certificate. The
+// URLs must use the http or https scheme.
+func (p *PKI) SetIssuingCertificateURL(urls []string) error {
+	for _, s := range urls {
+		u, err := url.Parse(s)
+		if err != nil {
+			return errors.Wrapf(err, "error parsing issuing certificate url %s", s)
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.Errorf("invalid issuing certificate url %s: url must use the http or https scheme", s)
+		}
+	}
+	p.issuingCertificateURL = urls
+	return nil
+}
+
+var (
+	oidExtensionCertificatePolicies = asn1.ObjectIdentifier{2, 5, 29, 32}
+	oidPolicyQualifierCPS           = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 2, 1}
+)
+
+// policyInformation is the ASN.1 structure of a certificate policy as defined
+// in RFC 5280, section 4.2.1.4.
+type policyInformation struct {
+	PolicyIdentifier asn1.ObjectIdentifier
+	PolicyQualifiers []policyQualifierInfo `asn1:"optional,omitempty"`
+}
+
+// policyQualifierInfo is the ASN.1 structure of a CPS policy qualifier.
+type policyQualifierInfo struct {
+	PolicyQualifierID asn1.ObjectIdentifier
+	Qualifier         string `asn1:"ia5"`
+}
+
+// SetCertificatePolicies sets the certificate policies extension that will be
+// added to the intermediate certificate. If cpsURI is not empty, it will be
+// added as the CPS qualifier of all the policies.
+func (p *PKI) SetCertificatePolicies(oids []asn1.ObjectIdentifier, cpsURI string) error {
+	if len(oids) == 0 {
+		return errors.New("certificate policies cannot be empty")
+	}
+
+	var qualifiers []policyQualifierInfo
+	if cpsURI != "" {
+		u, err := url.Parse(cpsURI)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return errors.Errorf("cps uri %s is not a valid url", cpsURI)
+		}
+		qualifiers = []policyQualifierInfo{{
+			PolicyQualifierID: oidPolicyQualifierCPS,
+			Qualifier:         cpsURI,
+		}}
+	}
+
+	policies := make([]policyInformation, len(oids))
+	for i, oid := range oids {
+		policies[i] = policyInformation{
+			PolicyIdentifier: oid,
+			PolicyQualifiers: qualifiers,
+		}
+	}
+	b, err := asn1.Marshal(policies)
+	if err != nil {
+		return errors.Wrap(err, "error marshaling certificate policies")
+	}
+
+	p.certificatePolicies = &pkix.Extension{
+		Id:    oidExtensionCertificatePolicies,
+		Value: b,
+	}
+	return nil
+}
+
+// GenerateKeyPairs generates the key pairs used by the certificate authority.
+func (p *PKI) GenerateKeyPairs(pass []byte) error {
+	pass, err := promptPasswordIfNeeded(pass, "provisioner key")
+	if err != nil {
+		return err
+	}
+
+	// Create OTT key pair, the user doesn't need to know about this.
+	p.ottPublicKey, p.ottPrivateKey, err = jose.GenerateDefaultKeyPair(pass)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// GenerateRootCertificate generates a root certificate with the given name.
+func (p *PKI) GenerateRootCertificate(name string, pass []byte) (*x509.Certificate, interface{}, error) {
+	var signer crypto.Signer
+	var err error
+	if p.keyManager != nil {
+		signer, err = p.createKMSRootKey()
+	} else {
+		signer, err = generateDefaultKey()
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cr, err := x509util.CreateCertificateRequest(name, []string{}, signer)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -296,46 +1256,174 @@ func (p *PKI) GenerateRootCertificate(name string, pass []byte) (*x509.Certifica
 	template := cert.GetCertificate()
 	template.NotBefore = time.Now()
 	template.NotAfter = template.NotBefore.AddDate(10, 0, 0)
+	if template.SerialNumber, err = p.nextSerialNumber(); err != nil {
+		return nil, nil, err
+	}
+	if template.SubjectKeyId, err = p.subjectKeyID(signer.Public()); err != nil {
+		return nil, nil, err
+	}
+	template.ExtraExtensions = append(template.ExtraExtensions, p.extraExtensions...)
 	rootCrt, err := x509util.CreateCertificate(template, template, signer.Public(), signer)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	if err := p.WriteRootCertificate(rootCrt, signer, pass); err != nil {
+	// The private key of a KMS is never written to disk.
+	var rootKey interface{} = signer
+	if p.keyManager != nil {
+		rootKey = nil
+	}
+	if err := p.WriteRootCertificate(rootCrt, rootKey, pass); err != nil {
 		return nil, nil, err
 	}
+	if p.hooks.OnRootGenerated != nil {
+		p.hooks.OnRootGenerated(rootCrt)
+	}
 
 	return rootCrt, signer, nil
 }
 
-// WriteRootCertificate writes to disk the given certificate and key.
+// createKMSRootKey creates the root key in the configured KMS and returns a
+// signer for it.
+func (p *PKI) createKMSRootKey() (crypto.Signer, error) {
+	resp, err := p.keyManager.CreateKey(&kmsapi.CreateKeyRequest{
+		Name:               p.rootKeyName,
+		SignatureAlgorithm: kmsapi.ECDSAWithSHA256,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating root key")
+	}
+	signer, err := p.keyManager.CreateSigner(&resp.CreateSignerRequest)
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating root signer")
+	}
+	p.rootKeyURI = resp.Name
+	return signer, nil
+}
+
+// SetRootPassword sets the password used to encrypt the root private key
+// instead of the one passed to the write methods. An empty, non-nil, password
+// writes the key unencrypted if SetInsecureNoPassword is enabled.
+func (p *PKI) SetRootPassword(pass []byte) {
+	p.rootPassword = pass
+}
+
+// SetIntermediatePassword sets the password used to encrypt the intermediate
+// private key instead of the one passed to the write methods. An empty,
+// non-nil, password writes the key unencrypted if SetInsecureNoPassword is
+// enabled.
+func (p *PKI) SetIntermediatePassword(pass []byte) {
+	p.intermediatePassword = pass
+}
+
+// SetIntermediateLifetime sets the lifetime of the intermediate certificate,
+// starting now. The validity is always clamped to the validity of the root.
+// If it's not set, or it's 0, the intermediate has the same validity as the
+// root.
+func (p *PKI) SetIntermediateLifetime(d time.Duration) error {
+	if d < 0 {
+		return errors.Errorf("intermediate lifetime %s cannot be negative", d)
+	}
+	p.intermediateLifetime = d
+	return nil
+}
+
+// keyPassword returns the password used to encrypt a private key. If keyPass
+// is set it's used, and a nil password is returned if it's empty, otherwise
+// the common password is used, prompting for it if necessary.
+func keyPassword(keyPass, pass []byte, name string) ([]byte, error) {
+	if keyPass != nil {
+		if len(keyPass) == 0 {
+			return nil, nil
+		}
+		return keyPass, nil
+	}
+	return promptPasswordIfNeeded(pass, name)
+}
+
+// WriteRootCertificate writes to disk the given certificate and, if present,
+// its encrypted private key.
 func (p *PKI) WriteRootCertificate(rootCrt *x509.Certificate, rootKey interface{}, pass []byte) error {
-	if err := fileutil.WriteFile(p.root, pem.EncodeToMemory(&pem.Block{
-		Type:  "CERTIFICATE",
-		Bytes: rootCrt.Raw,
-	}), 0600); err != nil {
+	b, err := encode(func(w io.Writer) error {
+		return p.WriteRootCertificateTo(w, rootCrt)
+	})
+	if err != nil {
+		return err
+	}
+	if err := p.writeFile(p.root, b, 0600); err != nil {
 		return err
 	}
 
 	if rootKey != nil {
-		_, err := pemutil.Serialize(rootKey, pemutil.WithPassword(pass), pemutil.ToFile(p.rootKey, 0600))
+		b, err := encode(func(w io.Writer) error {
+			return p.WriteRootKeyTo(w, rootKey, pass)
+		})
 		if err != nil {
 			return err
 		}
+		if err := p.writeFile(p.rootKey, b, 0600); err != nil {
+			return err
+		}
 	}
 
-	sum := sha256.Sum256(rootCrt.Raw)
-	p.rootFingerprint = strings.ToLower(hex.EncodeToString(sum[:]))
+	return nil
+}
 
+// WriteRootCertificateTo writes the given root certificate to w in PEM format.
+func (p *PKI) WriteRootCertificateTo(w io.Writer, rootCrt *x509.Certificate) error {
+	if err := writeCertificates(w, rootCrt); err != nil {
+		return err
+	}
+	p.setRootFingerprint(rootCrt)
 	return nil
 }
 
+// WriteRootKeyTo writes the given root private key to w in PEM format,
+// encrypted with the root password or the given one.
+func (p *PKI) WriteRootKeyTo(w io.Writer, rootKey interface{}, pass []byte) error {
+	pass, err := keyPassword(p.rootPassword, pass, "root private key")
+	if err != nil {
+		return err
+	}
+	return p.writePrivateKey(w, rootKey, pass)
+}
+
+func (p *PKI) setRootFingerprint(rootCrt *x509.Certificate) {
+	p.rootFingerprint = Fingerprint(rootCrt)
+}
+
+// Fingerprint returns the SHA-256 fingerprint of the certificate in hex
+// format. This is the fingerprint written in the defaults.json.
+func Fingerprint(cert *x509.Certificate) string {
+	return x509util.Fingerprint(cert)
+}
+
+// VerifyFingerprint returns true if the SHA-256 fingerprint of the certificate
+// in the given encoding matches the expected one. Hex fingerprints are
+// compared case-insensitively.
+func VerifyFingerprint(cert *x509.Certificate, expected string, encoding x509util.FingerprintEncoding) bool {
+	fp := x509util.EncodedFingerprint(cert, encoding)
+	if fp == "" {
+		return false
+	}
+	if encoding == x509util.HexFingerprint {
+		expected = strings.ToLower(expected)
+	}
+	return subtle.ConstantTimeCompare([]byte(fp), []byte(expected)) == 1
+}
+
+// isRegistrationAuthority returns true if the CA is configured as a
+// registration authority of a remote CAS.
+func (p *PKI) isRegistrationAuthority() bool {
+	return p.authorityOptions != nil && !p.authorityOptions.Is(apiv1.SoftCAS)
+}
+
 // GetCertificateAuthority attempts to load the certificate authority from the
 // RA.
 func (p *PKI) GetCertificateAuthority() error {
 	ca, err := cas.New(context.Background(), *p.authorityOptions)
 	if err != nil {
-		return err
+		return errors.Wrapf(err, "error initializing %s", p.authorityOptions.Summary())
 	}
 
 	srv, ok := ca.(apiv1.CertificateAuthorityGetter)
@@ -347,18 +1435,28 @@ func (p *PKI) GetCertificateAuthority() error {
 		Name: p.authorityOptions.CertificateAuthority,
 	})
 	if err != nil {
-		return err
+		return errors.Wrapf(err, "error getting the certificate authority from %s", p.authorityOptions.Summary())
 	}
 
 	if err := p.WriteRootCertificate(resp.RootCertificate, nil, nil); err != nil {
 		return err
 	}
 
-	// Issuer is in the RA
-	p.intermediate = ""
+	// Issuer is in the RA, but we keep a copy of the intermediates if the RA
+	// provides them.
 	p.intermediateKey = ""
+	if len(resp.CertificateChain) == 0 {
+		p.intermediate = ""
+		return nil
+	}
 
-	return nil
+	b, err := encode(func(w io.Writer) error {
+		return writeCertificates(w, resp.CertificateChain...)
+	})
+	if err != nil {
+		return err
+	}
+	return p.writeFile(p.intermediate, b, 0600)
 }
 
 // GenerateIntermediateCertificate generates an intermediate certificate with
@@ -383,97 +1481,314 @@ func (p *PKI) GenerateIntermediateCertificate(name string, rootCrt *x509.Certifi
 	template := cert.GetCertificate()
 	template.NotBefore = rootCrt.NotBefore
 	template.NotAfter = rootCrt.NotAfter
+	if p.intermediateLifetime > 0 {
+		now := time.Now()
+		if now.After(template.NotBefore) {
+			template.NotBefore = now
+		}
+		if notAfter := now.Add(p.intermediateLifetime); notAfter.Before(template.NotAfter) {
+			template.NotAfter = notAfter
+		}
+	}
+	if template.SerialNumber, err = p.nextSerialNumber(rootCrt); err != nil {
+		return err
+	}
+	if template.SubjectKeyId, err = p.subjectKeyID(key.Public()); err != nil {
+		return err
+	}
+	template.IssuingCertificateURL = p.issuingCertificateURL
+	template.ExtraExtensions = append(template.ExtraExtensions, p.extraExtensions...)
+	if p.certificatePolicies != nil {
+		template.ExtraExtensions = append(template.ExtraExtensions, *p.certificatePolicies)
+	}
 	intermediateCrt, err := x509util.CreateCertificate(template, rootCrt, key.Public(), rootKey.(crypto.Signer))
 	if err != nil {
 		return err
 	}
 
-	return p.WriteIntermediateCertificate(intermediateCrt, key, pass)
+	if err := p.WriteIntermediateCertificate(intermediateCrt, key, pass); err != nil {
+		return err
+	}
+	if p.hooks.OnIntermediateGenerated != nil {
+		p.hooks.OnIntermediateGenerated(intermediateCrt)
+	}
+	return nil
 }
 
-// WriteIntermediateCertificate writes to disk the given certificate and key.
+// WriteIntermediateCertificate writes to disk the given certificate and its
+// encrypted private key.
 func (p *PKI) WriteIntermediateCertificate(crt *x509.Certificate, key interface{}, pass []byte) error {
-	if err := fileutil.WriteFile(p.intermediate, pem.EncodeToMemory(&pem.Block{
-		Type:  "CERTIFICATE",
-		Bytes: crt.Raw,
-	}), 0600); err != nil {
+	b, err := encode(func(w io.Writer) error {
+		return p.WriteIntermediateCertificateTo(w, crt)
+	})
+	if err != nil {
 		return err
 	}
-	_, err := pemutil.Serialize(key, pemutil.WithPassword(pass), pemutil.ToFile(p.intermediateKey, 0600))
-	if err != nil {
+	if err := p.writeFile(p.intermediate, b, 0600); err != nil {
 		return err
 	}
-	return nil
-}
 
-// GenerateSSHSigningKeys generates and encrypts a private key used for signing
-// SSH user certificates and a private key used for signing host certificates.
-func (p *PKI) GenerateSSHSigningKeys(password []byte) error {
-	var pubNames = []string{p.sshHostPubKey, p.sshUserPubKey}
-	var privNames = []string{p.sshHostKey, p.sshUserKey}
-	for i := 0; i < 2; i++ {
-		pub, priv, err := keyutil.GenerateDefaultKeyPair()
-		if err != nil {
-			return err
-		}
-		if _, ok := priv.(crypto.Signer); !ok {
-			return errors.Errorf("key of type %T is not a crypto.Signer", priv)
-		}
-		sshKey, err := ssh.NewPublicKey(pub)
-		if err != nil {
-			return errors.Wrapf(err, "error converting public key")
-		}
-		_, err = pemutil.Serialize(priv, pemutil.WithFilename(privNames[i]), pemutil.WithPassword(password))
-		if err != nil {
-			return err
-		}
-		if err = fileutil.WriteFile(pubNames[i], ssh.MarshalAuthorizedKey(sshKey), 0600); err != nil {
-			return err
-		}
+	b, err = encode(func(w io.Writer) error {
+		return p.WriteIntermediateKeyTo(w, key, pass)
+	})
+	if err != nil {
+		return err
 	}
-	p.enableSSH = true
-	return nil
+	return p.writeFile(p.intermediateKey, b, 0600)
 }
 
-func (p *PKI) askFeedback() {
-	ui.Println()
-	ui.Printf("\033[1mFEEDBACK\033[0m %s %s\n",
-		html.UnescapeString("&#"+strconv.Itoa(128525)+";"),
-		html.UnescapeString("&#"+strconv.Itoa(127867)+";"))
-	ui.Println("      The \033[1mstep\033[0m utility is not instrumented for usage statistics. It does not")
-	ui.Println("      phone home. But your feedback is extremely valuable. Any information you")
-	ui.Println("      can provide regarding how you’re using `step` helps. Please send us a")
-	ui.Println("      sentence or two, good or bad: \033[1mfeedback@smallstep.com\033[0m or join")
-	ui.Println("      \033[1mhttps://github.com/smallstep/certificates/discussions\033[0m.")
+// WriteIntermediateCertificateTo writes the given intermediate certificate to
+// w in PEM format, followed by the intermediates added with AddIntermediate.
+func (p *PKI) WriteIntermediateCertificateTo(w io.Writer, crt *x509.Certificate) error {
+	chain, err := p.getIntermediateChain(crt)
+	if err != nil {
+		return err
+	}
+	return writeCertificates(w, chain...)
 }
 
-// TellPKI outputs the locations of public and private keys generated
-// generated for a new PKI. Generally this will consist of a root certificate
-// and key and an intermediate certificate and key.
-func (p *PKI) TellPKI() {
-	p.tellPKI()
-	p.askFeedback()
+// WriteIntermediateKeyTo writes the given intermediate private key to w in PEM
+// format, encrypted with the intermediate password or the given one.
+func (p *PKI) WriteIntermediateKeyTo(w io.Writer, key interface{}, pass []byte) error {
+	pass, err := keyPassword(p.intermediatePassword, pass, "intermediate private key")
+	if err != nil {
+		return err
+	}
+	return p.writePrivateKey(w, key, pass)
 }
 
-func (p *PKI) tellPKI() {
-	ui.Println()
-	if p.authorityOptions == nil || p.authorityOptions.Is(apiv1.SoftCAS) {
-		ui.PrintSelected("Root certificate", p.root)
-		ui.PrintSelected("Root private key", p.rootKey)
-		ui.PrintSelected("Root fingerprint", p.rootFingerprint)
-		ui.PrintSelected("Intermediate certificate", p.intermediate)
-		ui.PrintSelected("Intermediate private key", p.intermediateKey)
-	} else if p.rootFingerprint != "" {
-		ui.PrintSelected("Root certificate", p.root)
-		ui.PrintSelected("Root fingerprint", p.rootFingerprint)
-	} else {
-		ui.Printf(`{{ "%s" | red }} {{ "Root certificate:" | bold }} failed to retrieve it from RA`+"\n", ui.IconBad)
+// WriteIntermediatePKCS12 writes to path a PKCS#12 archive with the
+// intermediate private key, the intermediate certificate and the root
+// certificate, plus any intermediate added with AddIntermediate, as CA
+// certificates. The given password is used to encrypt the archive and, if no
+// intermediate password has been set, to decrypt the intermediate private key.
+func (p *PKI) WriteIntermediatePKCS12(path string, pass []byte) error {
+	pass, err := promptPasswordIfNeeded(pass, "PKCS#12 archive")
+	if err != nil {
+		return err
 	}
-	if p.enableSSH {
-		ui.PrintSelected("SSH user root certificate", p.sshUserPubKey)
-		ui.PrintSelected("SSH user root private key", p.sshUserKey)
-		ui.PrintSelected("SSH host root certificate", p.sshHostPubKey)
-		ui.PrintSelected("SSH host root private key", p.sshHostKey)
+	crt, err := pemutil.ReadCertificate(p.intermediate)
+	if err != nil {
+		return err
+	}
+	keyPass := pass
+	if p.intermediatePassword != nil {
+		keyPass = p.intermediatePassword
+	}
+	key, err := pemutil.Read(p.intermediateKey, pemutil.WithPassword(keyPass))
+	if err != nil {
+		return err
+	}
+	root, err := pemutil.ReadCertificate(p.root)
+	if err != nil {
+		return err
+	}
+	caCerts := []*x509.Certificate{root}
+	caCerts = append(caCerts, p.intermediates...)
+	b, err := pkcs12.Encode(rand.Reader, key, crt, caCerts, string(pass))
+	if err != nil {
+		return errors.Wrap(err, "error creating PKCS#12 archive")
+	}
+	return writeFile(path, b, 0600)
+}
+
+// WriteRootCertificateDER writes the root certificate in DER format to path.
+func (p *PKI) WriteRootCertificateDER(path string) error {
+	return writeCertificateDER(p.root, path)
+}
+
+// WriteIntermediateCertificateDER writes the intermediate certificate in DER
+// format to path. Only the intermediate is written, DER does not support
+// bundles.
+func (p *PKI) WriteIntermediateCertificateDER(path string) error {
+	return writeCertificateDER(p.intermediate, path)
+}
+
+// writeCertificateDER reads the first certificate in the PEM file src and
+// writes it in DER format to dst.
+func writeCertificateDER(src, dst string) error {
+	crt, err := pemutil.ReadCertificate(src)
+	if err != nil {
+		return err
+	}
+	return writeFile(dst, crt.Raw, 0600)
+}
+
+// getIntermediateChain returns the bundle with the given issuing intermediate
+// followed by the intermediates added with AddIntermediate, in order from the
+// issuer to the root.
+func (p *PKI) getIntermediateChain(crt *x509.Certificate) ([]*x509.Certificate, error) {
+	n := len(p.intermediates)
+	if n == 0 {
+		return []*x509.Certificate{crt}, nil
+	}
+	if err := crt.CheckSignatureFrom(p.intermediates[n-1]); err != nil {
+		return nil, errors.Wrapf(err, "certificate %s is not signed by %s", crt.Subject, p.intermediates[n-1].Subject)
+	}
+	chain := []*x509.Certificate{crt}
+	for i := n - 1; i >= 0; i-- {
+		chain = append(chain, p.intermediates[i])
+	}
+	return chain, nil
+}
+
+// VerifyChain loads the root and the intermediate bundle written by the PKI
+// and verifies that each certificate in the bundle is signed by the next one,
+// and the last one by the root. It also verifies that all of them are
+// certificate authorities with basic constraints that allow the chain.
+func (p *PKI) VerifyChain() error {
+	root, err := pemutil.ReadCertificate(p.root)
+	if err != nil {
+		return err
+	}
+	chain, err := pemutil.ReadCertificateBundle(p.intermediate)
+	if err != nil {
+		return err
+	}
+	chain = append(chain, root)
+
+	for i, crt := range chain {
+		// The issuing intermediate is at 0, so i is the number of CAs that
+		// crt has below it.
+		if err := checkCAConstraints(crt, i); err != nil {
+			return err
+		}
+		parent := root
+		if i < len(chain)-1 {
+			parent = chain[i+1]
+		}
+		if err := crt.CheckSignatureFrom(parent); err != nil {
+			if crt == root {
+				return errors.Wrapf(err, "root certificate %s is not self-signed", crt.Subject)
+			}
+			return errors.Wrapf(err, "certificate %s is not signed by %s", crt.Subject, parent.Subject)
+		}
+	}
+	return nil
+}
+
+// checkCAConstraints returns an error if the given certificate is not a
+// certificate authority that can have n intermediates below it.
+func checkCAConstraints(crt *x509.Certificate, n int) error {
+	switch {
+	case !crt.BasicConstraintsValid || !crt.IsCA:
+		return errors.Errorf("certificate %s is not a certificate authority", crt.Subject)
+	case crt.KeyUsage != 0 && crt.KeyUsage&x509.KeyUsageCertSign == 0:
+		return errors.Errorf("certificate %s key usage does not allow to sign certificates", crt.Subject)
+	case (crt.MaxPathLen > 0 || crt.MaxPathLenZero) && n > crt.MaxPathLen:
+		return errors.Errorf("certificate %s path length constraint %d does not allow %d intermediates below it", crt.Subject, crt.MaxPathLen, n)
+	default:
+		return nil
+	}
+}
+
+// SetSSHOrganization sets the organization added to the comment of the SSH
+// public keys, e.g. "step-ca host CA Smallstep".
+func (p *PKI) SetSSHOrganization(org string) {
+	p.sshOrganization = org
+}
+
+// getSSHKeyComment returns the comment of the SSH public key of the given type.
+func (p *PKI) getSSHKeyComment(typ string) string {
+	comment := "step-ca " + typ + " CA"
+	if org := strings.TrimSpace(p.sshOrganization); org != "" {
+		comment += " " + org
+	}
+	return comment
+}
+
+// marshalAuthorizedKey serializes the given public key in the authorized_keys
+// format with the given comment.
+func marshalAuthorizedKey(key ssh.PublicKey, comment string) []byte {
+	b := bytes.TrimSuffix(ssh.MarshalAuthorizedKey(key), []byte("\n"))
+	return append(append(b, ' '), comment+"\n"...)
+}
+
+// GenerateSSHSigningKeys generates and encrypts a private key used for signing
+// SSH user certificates and a private key used for signing host certificates.
+func (p *PKI) GenerateSSHSigningKeys(password []byte) error {
+	password, err := promptPasswordIfNeeded(password, "SSH private keys")
+	if err != nil {
+		return err
+	}
+
+	var pubNames = []string{p.sshHostPubKey, p.sshUserPubKey}
+	var privNames = []string{p.sshHostKey, p.sshUserKey}
+	var comments = []string{p.getSSHKeyComment("host"), p.getSSHKeyComment("user")}
+	var sshKeys = make([]ssh.PublicKey, 2)
+	for i := 0; i < 2; i++ {
+		pub, priv, err := keyutil.GenerateDefaultKeyPair()
+		if err != nil {
+			return err
+		}
+		if _, ok := priv.(crypto.Signer); !ok {
+			return errors.Errorf("key of type %T is not a crypto.Signer", priv)
+		}
+		sshKey, err := ssh.NewPublicKey(pub)
+		if err != nil {
+			return errors.Wrapf(err, "error converting public key")
+		}
+		if err = p.writeKey(privNames[i], priv, password); err != nil {
+			return err
+		}
+		if err = p.writeFile(pubNames[i], marshalAuthorizedKey(sshKey, comments[i]), 0600); err != nil {
+			return err
+		}
+		sshKeys[i] = sshKey
+	}
+	p.enableSSH = true
+	if p.hooks.OnSSHKeysGenerated != nil {
+		p.hooks.OnSSHKeysGenerated(sshKeys[0], sshKeys[1])
+	}
+	return nil
+}
+
+func (p *PKI) askFeedback() {
+	ui.Println()
+	ui.Printf("\033[1mFEEDBACK\033[0m %s %s\n",
+		html.UnescapeString("&#"+strconv.Itoa(128525)+";"),
+		html.UnescapeString("&#"+strconv.Itoa(127867)+";"))
+	ui.Println("      The \033[1mstep\033[0m utility is not instrumented for usage statistics. It does not")
+	ui.Println("      phone home. But your feedback is extremely valuable. Any information you")
+	ui.Println("      can provide regarding how you’re using `step` helps. Please send us a")
+	ui.Println("      sentence or two, good or bad: \033[1mfeedback@smallstep.com\033[0m or join")
+	ui.Println("      \033[1mhttps://github.com/smallstep/certificates/discussions\033[0m.")
+}
+
+// TellPKI outputs the locations of public and private keys generated
+// generated for a new PKI. Generally this will consist of a root certificate
+// and key and an intermediate certificate and key.
+func (p *PKI) TellPKI() {
+	p.tellPKI()
+	p.askFeedback()
+}
+
+func (p *PKI) tellPKI() {
+	ui.Println()
+	if !p.isRegistrationAuthority() {
+		ui.PrintSelected("Root certificate", p.root)
+		if p.rootKeyURI != "" {
+			ui.PrintSelected("Root KMS key URI", p.rootKeyURI)
+		} else {
+			ui.PrintSelected("Root private key", p.rootKey)
+		}
+		ui.PrintSelected("Root fingerprint", p.rootFingerprint)
+		ui.PrintSelected("Intermediate certificate", p.intermediate)
+		ui.PrintSelected("Intermediate private key", p.intermediateKey)
+	} else if p.rootFingerprint != "" {
+		ui.PrintSelected("Root certificate", p.root)
+		ui.PrintSelected("Root fingerprint", p.rootFingerprint)
+		if p.intermediate != "" {
+			ui.PrintSelected("Intermediate certificate", p.intermediate)
+		}
+	} else {
+		ui.Printf(`{{ "%s" | red }} {{ "Root certificate:" | bold }} failed to retrieve it from RA`+"\n", ui.IconBad)
+	}
+	if p.enableSSH {
+		ui.PrintSelected("SSH user root certificate", p.sshUserPubKey)
+		ui.PrintSelected("SSH user root private key", p.sshUserKey)
+		ui.PrintSelected("SSH host root certificate", p.sshHostPubKey)
+		ui.PrintSelected("SSH host root private key", p.sshHostKey)
 	}
 }
 
@@ -482,19 +1797,47 @@ type caDefaults struct {
 	CAConfig    string `json:"ca-config"`
 	Fingerprint string `json:"fingerprint"`
 	Root        string `json:"root"`
+	Profile     string `json:"profile,omitempty"`
 }
 
 // Option is the type for modifiers over the auth config object.
 type Option func(c *authority.Config) error
 
 // WithDefaultDB is a configuration modifier that adds a default DB stanza to
-// the authority config.
+// the authority config. The data source is set by GenerateConfig to the
+// database folder of the PKI.
 func WithDefaultDB() Option {
 	return func(c *authority.Config) error {
 		c.DB = &db.Config{
-			Type:       "badger",
-			DataSource: GetDBPath(),
+			Type: "badger",
+		}
+		return nil
+	}
+}
+
+// WithBadgerOptions is a configuration modifier that sets the tuning options
+// of a badger DB. The valueDir is the directory of the value log files, by
+// default the same as the data source, and the fileLoadingMode is either
+// "mmap" or "MemoryMap", the default, or "fileio" to avoid memory-mapping the
+// value log files. Modes are not case sensitive. Empty values keep the
+// defaults.
+func WithBadgerOptions(valueDir, fileLoadingMode string) Option {
+	return func(c *authority.Config) error {
+		if c.DB == nil {
+			return errors.New("badger options require a database")
 		}
+		switch strings.ToLower(c.DB.Type) {
+		case nosql.BadgerDriver, nosql.BadgerV1Driver, nosql.BadgerV2Driver:
+		default:
+			return errors.Errorf("badger options are not supported by database type %s", c.DB.Type)
+		}
+		switch strings.ToLower(fileLoadingMode) {
+		case "", nosql.BadgerMemoryMap, "memorymap", nosql.BadgerFileIO:
+		default:
+			return errors.Errorf("unsupported badger file loading mode %s", fileLoadingMode)
+		}
+		c.DB.ValueDir = valueDir
+		c.DB.BadgerFileLoadingMode = fileLoadingMode
 		return nil
 	}
 }
@@ -508,8 +1851,362 @@ func WithoutDB() Option {
 	}
 }
 
+// WithAuthorityName is a configuration modifier that sets the common name of
+// the authority. It's used in the certificate of the CA server, if it's not
+// set the authority uses its default name.
+func WithAuthorityName(name string) Option {
+	return func(c *authority.Config) error {
+		if name == "" {
+			return errors.New("authority name cannot be empty")
+		}
+		c.CommonName = name
+		return nil
+	}
+}
+
+// WithoutSSHPOP is a configuration modifier that removes the SSHPOP provisioner
+// added by default when SSH is enabled. The SSH host and user keys are kept.
+func WithoutSSHPOP() Option {
+	return func(c *authority.Config) error {
+		if c.AuthorityConfig == nil {
+			return nil
+		}
+		provisioners := provisioner.List{}
+		for _, p := range c.AuthorityConfig.Provisioners {
+			if p.GetType() != provisioner.TypeSSHPOP {
+				provisioners = append(provisioners, p)
+			}
+		}
+		c.AuthorityConfig.Provisioners = provisioners
+		return nil
+	}
+}
+
+// WithX5CProvisioner is a configuration modifier that adds a X5C provisioner
+// with the given name. The provisioner will accept certificates signed by the
+// PEM encoded roots in rootsPEM, at least one of them must be a CA.
+func WithX5CProvisioner(name string, rootsPEM []byte) Option {
+	return func(c *authority.Config) error {
+		var found bool
+		rest := rootsPEM
+		for {
+			var block *pem.Block
+			if block, rest = pem.Decode(rest); block == nil {
+				break
+			}
+			if block.Type != "CERTIFICATE" {
+				continue
+			}
+			crt, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return errors.Wrap(err, "error parsing x5c roots")
+			}
+			if crt.IsCA {
+				found = true
+			}
+		}
+		if !found {
+			return errors.Errorf("x5c provisioner %s: roots do not contain any CA certificate", name)
+		}
+
+		c.AuthorityConfig.Provisioners = append(c.AuthorityConfig.Provisioners, &provisioner.X5C{
+			Type:  "X5C",
+			Name:  name,
+			Roots: rootsPEM,
+		})
+		return nil
+	}
+}
+
+// WithOIDCProvisioner is a configuration modifier that adds an OIDC
+// provisioner with the given name, client, configuration endpoint and list of
+// admins.
+func WithOIDCProvisioner(name, clientID, clientSecret, configurationEndpoint string, admins []string) Option {
+	return func(c *authority.Config) error {
+		switch {
+		case name == "":
+			return errors.New("oidc provisioner name cannot be empty")
+		case clientID == "":
+			return errors.Errorf("oidc provisioner %s: clientID cannot be empty", name)
+		case configurationEndpoint == "":
+			return errors.Errorf("oidc provisioner %s: configurationEndpoint cannot be empty", name)
+		}
+		u, err := url.Parse(configurationEndpoint)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return errors.Errorf("oidc provisioner %s: configurationEndpoint %s is not a valid url", name, configurationEndpoint)
+		}
+
+		c.AuthorityConfig.Provisioners = append(c.AuthorityConfig.Provisioners, &provisioner.OIDC{
+			Type:                  "OIDC",
+			Name:                  name,
+			ClientID:              clientID,
+			ClientSecret:          clientSecret,
+			ConfigurationEndpoint: configurationEndpoint,
+			Admins:                admins,
+		})
+		return nil
+	}
+}
+
+// WithProvisionersFromFile is a configuration modifier that appends the
+// provisioners defined in the given JSON file, a list with the same format as
+// authority.provisioners in ca.json. Provisioners with the name of one
+// already in the configuration are skipped. It returns an error if a
+// provisioner has no name, has an unsupported type, or if two of them in the
+// file have the same name.
+func WithProvisionersFromFile(path string) Option {
+	return func(c *authority.Config) error {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return errs.FileError(err, path)
+		}
+		var raws []json.RawMessage
+		if err := json.Unmarshal(b, &raws); err != nil {
+			return errors.Wrapf(err, "error parsing %s", path)
+		}
+
+		// Provisioners with an unknown type are skipped by provisioner.List,
+		// so they are parsed one by one to report them.
+		names := make(map[string]bool)
+		if c.AuthorityConfig == nil {
+			c.AuthorityConfig = &authority.AuthConfig{}
+		}
+		for _, p := range c.AuthorityConfig.Provisioners {
+			names[p.GetName()] = true
+		}
+		seen := make(map[string]bool)
+		for i, raw := range raws {
+			var list provisioner.List
+			if err := json.Unmarshal([]byte("["+string(raw)+"]"), &list); err != nil {
+				return errors.Wrapf(err, "error parsing provisioner %d in %s", i, path)
+			}
+			if len(list) != 1 {
+				return errors.Errorf("error parsing provisioner %d in %s: type is not supported", i, path)
+			}
+			prov := list[0]
+			name := prov.GetName()
+			switch {
+			case name == "":
+				return errors.Errorf("error parsing provisioner %d in %s: name cannot be empty", i, path)
+			case seen[name]:
+				return errors.Errorf("error parsing %s: provisioner %s is defined more than once", path, name)
+			}
+			seen[name] = true
+			if !names[name] {
+				c.AuthorityConfig.Provisioners = append(c.AuthorityConfig.Provisioners, prov)
+			}
+		}
+		return nil
+	}
+}
+
+// defaultLeafTemplateWithExtKeyUsage is x509util.DefaultLeafTemplate with a
+// placeholder for the list of extended key usages.
+const defaultLeafTemplateWithExtKeyUsage = `{
+	"subject": {{ toJson .Subject }},
+	"sans": {{ toJson .SANs }},
+{{- if typeIs "*rsa.PublicKey" .Insecure.CR.PublicKey }}
+	"keyUsage": ["keyEncipherment", "digitalSignature"],
+{{- else }}
+	"keyUsage": ["digitalSignature"],
+{{- end }}
+	"extKeyUsage": %s
+}`
+
+var extKeyUsageNames = map[x509.ExtKeyUsage]string{
+	x509.ExtKeyUsageAny:                            x509util.ExtKeyUsageAny,
+	x509.ExtKeyUsageServerAuth:                     x509util.ExtKeyUsageServerAuth,
+	x509.ExtKeyUsageClientAuth:                     x509util.ExtKeyUsageClientAuth,
+	x509.ExtKeyUsageCodeSigning:                    x509util.ExtKeyUsageCodeSigning,
+	x509.ExtKeyUsageEmailProtection:                x509util.ExtKeyUsageEmailProtection,
+	x509.ExtKeyUsageIPSECEndSystem:                 x509util.ExtKeyUsageIPSECEndSystem,
+	x509.ExtKeyUsageIPSECTunnel:                    x509util.ExtKeyUsageIPSECTunnel,
+	x509.ExtKeyUsageIPSECUser:                      x509util.ExtKeyUsageIPSECUser,
+	x509.ExtKeyUsageTimeStamping:                   x509util.ExtKeyUsageTimeStamping,
+	x509.ExtKeyUsageOCSPSigning:                    x509util.ExtKeyUsageOCSPSigning,
+	x509.ExtKeyUsageMicrosoftServerGatedCrypto:     x509util.ExtKeyUsageMicrosoftServerGatedCrypto,
+	x509.ExtKeyUsageNetscapeServerGatedCrypto:      x509util.ExtKeyUsageNetscapeServerGatedCrypto,
+	x509.ExtKeyUsageMicrosoftCommercialCodeSigning: x509util.ExtKeyUsageMicrosoftCommercialCodeSigning,
+	x509.ExtKeyUsageMicrosoftKernelCodeSigning:     x509util.ExtKeyUsageMicrosoftKernelCodeSigning,
+}
+
+// WithDefaultKeyUsages is a configuration modifier that sets an X.509 template
+// in the default JWK provisioner that restricts the extended key usages of
+// the issued certificates to the given ones.
+func WithDefaultKeyUsages(ekus []x509.ExtKeyUsage) Option {
+	return func(c *authority.Config) error {
+		if len(ekus) == 0 {
+			return errors.New("extended key usages cannot be empty")
+		}
+		names := make([]string, len(ekus))
+		for i, eku := range ekus {
+			name, ok := extKeyUsageNames[eku]
+			if !ok {
+				return errors.Errorf("unsupported extended key usage %d", eku)
+			}
+			names[i] = name
+		}
+		b, err := json.Marshal(names)
+		if err != nil {
+			return errors.Wrap(err, "error marshaling extended key usages")
+		}
+
+		// The default provisioner is the first one.
+		if c.AuthorityConfig == nil || len(c.AuthorityConfig.Provisioners) == 0 {
+			return errors.New("default provisioner not found")
+		}
+		prov, ok := c.AuthorityConfig.Provisioners[0].(*provisioner.JWK)
+		if !ok {
+			return errors.New("default provisioner not found")
+		}
+		if prov.Options == nil {
+			prov.Options = &provisioner.Options{}
+		}
+		prov.Options.X509 = &provisioner.X509Options{
+			Template: fmt.Sprintf(defaultLeafTemplateWithExtKeyUsage, b),
+		}
+		return nil
+	}
+}
+
+// WithDisableRenewal is a configuration modifier that sets the disableRenewal
+// claim in the default JWK provisioner, certificates issued by it cannot be
+// renewed. Other claims in the provisioner are kept.
+func WithDisableRenewal() Option {
+	return func(c *authority.Config) error {
+		// The default provisioner is the first one.
+		if c.AuthorityConfig == nil || len(c.AuthorityConfig.Provisioners) == 0 {
+			return errors.New("default provisioner not found")
+		}
+		prov, ok := c.AuthorityConfig.Provisioners[0].(*provisioner.JWK)
+		if !ok {
+			return errors.New("default provisioner not found")
+		}
+		disableRenewal := true
+		if prov.Claims == nil {
+			prov.Claims = &provisioner.Claims{}
+		}
+		prov.Claims.DisableRenewal = &disableRenewal
+		return nil
+	}
+}
+
+// WithProvisionerSSH is a configuration modifier that sets the enableSSHCA
+// claim of the provisioner with the given name, allowing or denying it to sign
+// SSH certificates regardless of the value used for the other provisioners.
+// The SSH keys must be generated for the CA to sign SSH certificates.
+func WithProvisionerSSH(name string, enable bool) Option {
+	return func(c *authority.Config) error {
+		if c.AuthorityConfig != nil {
+			for _, prov := range c.AuthorityConfig.Provisioners {
+				if prov.GetName() != name {
+					continue
+				}
+				claims, ok := provisionerClaims(prov)
+				if !ok {
+					return errors.Errorf("provisioner %s of type %s does not support claims", name, prov.GetType())
+				}
+				if *claims == nil {
+					*claims = &provisioner.Claims{}
+				}
+				enableSSHCA := enable
+				(*claims).EnableSSHCA = &enableSSHCA
+				return nil
+			}
+		}
+		return errors.Errorf("provisioner %s not found", name)
+	}
+}
+
+// provisionerClaims returns a pointer to the claims of the given provisioner.
+func provisionerClaims(prov provisioner.Interface) (**provisioner.Claims, bool) {
+	switch p := prov.(type) {
+	case *provisioner.JWK:
+		return &p.Claims, true
+	case *provisioner.OIDC:
+		return &p.Claims, true
+	case *provisioner.GCP:
+		return &p.Claims, true
+	case *provisioner.AWS:
+		return &p.Claims, true
+	case *provisioner.Azure:
+		return &p.Claims, true
+	case *provisioner.ACME:
+		return &p.Claims, true
+	case *provisioner.X5C:
+		return &p.Claims, true
+	case *provisioner.K8sSA:
+		return &p.Claims, true
+	case *provisioner.SSHPOP:
+		return &p.Claims, true
+	default:
+		return nil, false
+	}
+}
+
+// WithTLSCertDurations is a configuration modifier that sets the minimum,
+// maximum and default durations of the X.509 certificates issued by the
+// default JWK provisioner. The durations must be positive, and the default one
+// must be between the minimum and the maximum.
+func WithTLSCertDurations(min, max, def time.Duration) Option {
+	return func(c *authority.Config) error {
+		// The default provisioner is the first one.
+		if c.AuthorityConfig == nil || len(c.AuthorityConfig.Provisioners) == 0 {
+			return errors.New("default provisioner not found")
+		}
+		prov, ok := c.AuthorityConfig.Provisioners[0].(*provisioner.JWK)
+		if !ok {
+			return errors.New("default provisioner not found")
+		}
+		claims := &provisioner.Claims{}
+		if prov.Claims != nil {
+			*claims = *prov.Claims
+		}
+		claims.MinTLSDur = &provisioner.Duration{Duration: min}
+		claims.MaxTLSDur = &provisioner.Duration{Duration: max}
+		claims.DefaultTLSDur = &provisioner.Duration{Duration: def}
+		// All the TLS durations are set, so the claims can be validated
+		// without the global ones.
+		if _, err := provisioner.NewClaimer(claims, *claims); err != nil {
+			return err
+		}
+		prov.Claims = claims
+		return nil
+	}
+}
+
+// maxBackdate is the maximum backdate allowed by WithBackdate. Larger values
+// are more likely a mistake than real clock skew.
+const maxBackdate = time.Hour
+
+// WithBackdate is a configuration modifier that sets the duration subtracted to
+// the start of the validity of the issued certificates, to allow for clock
+// skew. By default it's one minute, and it cannot be greater than one hour.
+func WithBackdate(d time.Duration) Option {
+	return func(c *authority.Config) error {
+		if d < 0 {
+			return errors.New("backdate cannot be less than 0")
+		}
+		if d > maxBackdate {
+			return errors.Errorf("backdate cannot be greater than %s", maxBackdate)
+		}
+		if c.AuthorityConfig == nil {
+			c.AuthorityConfig = &authority.AuthConfig{}
+		}
+		c.AuthorityConfig.Backdate = &provisioner.Duration{Duration: d}
+		return nil
+	}
+}
+
 // GenerateConfig returns the step certificates configuration.
 func (p *PKI) GenerateConfig(opt ...Option) (*authority.Config, error) {
+	// The keys of the default provisioner are created by GenerateKeyPairs.
+	if p.ottPublicKey == nil || p.ottPrivateKey == nil {
+		return nil, errors.New("error generating configuration: call GenerateKeyPairs before GenerateConfig")
+	}
+	if p.provisioner == "" {
+		return nil, errors.New("error generating configuration: the provisioner name cannot be empty")
+	}
 	key, err := p.ottPrivateKey.CompactSerialize()
 	if err != nil {
 		return nil, errors.Wrap(err, "error serializing private key")
@@ -524,15 +2221,15 @@ func (p *PKI) GenerateConfig(opt ...Option) (*authority.Config, error) {
 
 	config := &authority.Config{
 		Root:             []string{p.root},
-		FederatedRoots:   []string{},
+		FederatedRoots:   append([]string{}, p.federatedRoots...),
 		IntermediateCert: p.intermediate,
 		IntermediateKey:  p.intermediateKey,
 		Address:          p.address,
-		DNSNames:         p.dnsNames,
+		DNSNames:         p.getDNSNames(),
 		Logger:           []byte(`{"format": "text"}`),
 		DB: &db.Config{
 			Type:       "badger",
-			DataSource: GetDBPath(),
+			DataSource: p.getDBPath(),
 		},
 		AuthorityConfig: &authority.AuthConfig{
 			Options:              p.authorityOptions,
@@ -547,6 +2244,12 @@ func (p *PKI) GenerateConfig(opt ...Option) (*authority.Config, error) {
 		},
 		Templates: p.getTemplates(),
 	}
+	// A registration authority does not sign X.509 certificates, the issuer
+	// and its key are in the remote CAS. The database is kept because it's
+	// used to avoid the reuse of tokens and to store revocations.
+	if p.isRegistrationAuthority() {
+		config.IntermediateKey = ""
+	}
 	if p.enableSSH {
 		enableSSHCA := true
 		config.SSH = &authority.SSHConfig{
@@ -557,6 +2260,23 @@ func (p *PKI) GenerateConfig(opt ...Option) (*authority.Config, error) {
 		prov.Claims = &provisioner.Claims{
 			EnableSSHCA: &enableSSHCA,
 		}
+		// Add default critical options and extensions
+		if len(p.sshCriticalOptions) > 0 || len(p.sshExtensions) > 0 {
+			data := sshutil.NewTemplateData()
+			if len(p.sshCriticalOptions) > 0 {
+				data[sshutil.CriticalOptionsKey] = p.sshCriticalOptions
+			}
+			if len(p.sshExtensions) > 0 {
+				data[sshutil.ExtensionsKey] = p.sshExtensions
+			}
+			b, err := json.Marshal(data)
+			if err != nil {
+				return nil, errors.Wrap(err, "error marshaling ssh template data")
+			}
+			prov.Options = &provisioner.Options{
+				SSH: &provisioner.SSHOptions{TemplateData: b},
+			}
+		}
 		// Add default SSHPOP provisioner
 		sshpop := &provisioner.SSHPOP{
 			Type: "SSHPOP",
@@ -575,13 +2295,120 @@ func (p *PKI) GenerateConfig(opt ...Option) (*authority.Config, error) {
 		}
 	}
 
+	// The default database added by WithDefaultDB is in the base directory
+	// of the PKI.
+	if config.DB != nil && config.DB.Type == "badger" && config.DB.DataSource == "" {
+		config.DB.DataSource = p.getDBPath()
+	}
+
+	// Provisioners are selected by name, names must be unique.
+	names := make(map[string]bool)
+	for _, p := range config.AuthorityConfig.Provisioners {
+		if names[p.GetName()] {
+			return nil, errors.Errorf("error generating configuration: there is more than one provisioner named %s", p.GetName())
+		}
+		names[p.GetName()] = true
+	}
+
 	return config, nil
 }
 
+// saveLocks contains a mutex per base directory, it is used to serialize
+// concurrent calls to Save writing in the same directory.
+var saveLocks sync.Map
+
+// lockBaseDir locks the mutex for the given directory and returns the function
+// to unlock it.
+func lockBaseDir(dir string) func() {
+	v, _ := saveLocks.LoadOrStore(dir, new(sync.Mutex))
+	mu := v.(*sync.Mutex)
+	mu.Lock()
+	return mu.Unlock
+}
+
+// SaveResult contains the files written by the PKI and the values required by
+// a client to connect to the CA.
+type SaveResult struct {
+	Root             string `json:"root"`
+	RootKey          string `json:"rootKey,omitempty"`
+	RootKeyURI       string `json:"rootKeyUri,omitempty"`
+	Intermediate     string `json:"intermediate,omitempty"`
+	IntermediateKey  string `json:"intermediateKey,omitempty"`
+	SSHHostPublicKey string `json:"sshHostPublicKey,omitempty"`
+	SSHHostKey       string `json:"sshHostKey,omitempty"`
+	SSHUserPublicKey string `json:"sshUserPublicKey,omitempty"`
+	SSHUserKey       string `json:"sshUserKey,omitempty"`
+	Config           string `json:"config"`
+	Defaults         string `json:"defaults,omitempty"`
+	Provenance       string `json:"provenance,omitempty"`
+	Fingerprint      string `json:"fingerprint"`
+	CAURL            string `json:"caUrl,omitempty"`
+}
+
 // Save stores the pki on a json file that will be used as the certificate
-// authority configuration.
+// authority configuration. Concurrent calls to Save using the same base
+// directory are serialized.
 func (p *PKI) Save(opt ...Option) error {
-	p.tellPKI()
+	_, err := p.SaveWithResult(opt...)
+	return err
+}
+
+// SaveWithResult is like Save, but it also returns the paths of the files of
+// the PKI, the root fingerprint and the CA URL. The CA URL is empty if the
+// defaults file is skipped and no URL has been set.
+func (p *PKI) SaveWithResult(opt ...Option) (*SaveResult, error) {
+	if err := p.save(opt...); err != nil {
+		return nil, err
+	}
+
+	res := &SaveResult{
+		Root:            p.root,
+		RootKey:         p.rootKey,
+		Intermediate:    p.intermediate,
+		IntermediateKey: p.intermediateKey,
+		Config:          p.config,
+		Fingerprint:     p.rootFingerprint,
+		CAURL:           p.caURL,
+	}
+	if !p.skipDefaults {
+		caURL, err := p.CAURL()
+		if err != nil {
+			return nil, err
+		}
+		res.CAURL = caURL
+	}
+	// A root key in a KMS is not written to disk.
+	if p.rootKeyURI != "" {
+		res.RootKey, res.RootKeyURI = "", p.rootKeyURI
+	}
+	if p.isRegistrationAuthority() {
+		res.RootKey, res.IntermediateKey = "", ""
+	}
+	if p.enableSSH {
+		res.SSHHostPublicKey, res.SSHHostKey = p.sshHostPubKey, p.sshHostKey
+		res.SSHUserPublicKey, res.SSHUserKey = p.sshUserPubKey, p.sshUserKey
+	}
+	if !p.skipDefaults {
+		res.Defaults = p.defaults
+	}
+	if p.writeProvenance {
+		res.Provenance = p.provenance
+	}
+	return res, nil
+}
+
+func (p *PKI) save(opt ...Option) error {
+	unlock := lockBaseDir(p.base)
+	defer unlock()
+
+	if err := p.checkAddress(); err != nil {
+		if p.strict {
+			return err
+		}
+		ui.Printf("\033[1mWARNING\033[0m %s\n", err)
+	}
+
+	p.tellPKI()
 
 	// Generate and write ca.json
 	config, err := p.GenerateConfig(opt...)
@@ -589,46 +2416,28 @@ func (p *PKI) Save(opt ...Option) error {
 		return err
 	}
 
-	b, err := json.MarshalIndent(config, "", "\t")
-	if err != nil {
-		return errors.Wrapf(err, "error marshaling %s", p.config)
-	}
-	if err = fileutil.WriteFile(p.config, b, 0644); err != nil {
-		return errs.FileError(err, p.config)
+	if err := p.writeConfig(config); err != nil {
+		return err
 	}
 
-	// Generate the CA URL.
-	if p.caURL == "" {
-		p.caURL = p.dnsNames[0]
-		var port string
-		_, port, err = net.SplitHostPort(p.address)
+	if p.writeProvenance {
+		b, err := p.Provenance()
 		if err != nil {
-			return errors.Wrapf(err, "error parsing %s", p.address)
+			return err
 		}
-		if port == "443" {
-			p.caURL = fmt.Sprintf("https://%s", p.caURL)
-		} else {
-			p.caURL = fmt.Sprintf("https://%s:%s", p.caURL, port)
+		if err := p.writeFile(p.provenance, b, 0644); err != nil {
+			return err
 		}
 	}
 
-	// Generate and write defaults.json
-	defaults := &caDefaults{
-		Root:        p.root,
-		CAConfig:    p.config,
-		CAUrl:       p.caURL,
-		Fingerprint: p.rootFingerprint,
-	}
-	b, err = json.MarshalIndent(defaults, "", "\t")
-	if err != nil {
-		return errors.Wrapf(err, "error marshaling %s", p.defaults)
-	}
-	if err = fileutil.WriteFile(p.defaults, b, 0644); err != nil {
-		return errs.FileError(err, p.defaults)
+	if !p.skipDefaults {
+		if err := p.saveDefaults(); err != nil {
+			return err
+		}
 	}
 
 	// Generate and write templates
-	if err := generateTemplates(config.Templates); err != nil {
+	if err := p.generateTemplates(config.Templates); err != nil {
 		return err
 	}
 
@@ -636,13 +2445,18 @@ func (p *PKI) Save(opt ...Option) error {
 		ui.PrintSelected("Database folder", config.DB.DataSource)
 	}
 	if config.Templates != nil {
-		ui.PrintSelected("Templates folder", GetTemplatesPath())
+		ui.PrintSelected("Templates folder", p.getTemplatesPath())
 	}
 
-	ui.PrintSelected("Default configuration", p.defaults)
+	if !p.skipDefaults {
+		ui.PrintSelected("Default configuration", p.defaults)
+	}
 	ui.PrintSelected("Certificate Authority configuration", p.config)
+	if p.writeProvenance {
+		ui.PrintSelected("Provenance", p.provenance)
+	}
 	ui.Println()
-	if p.authorityOptions == nil || p.authorityOptions.Is(apiv1.SoftCAS) {
+	if !p.isRegistrationAuthority() {
 		ui.Println("Your PKI is ready to go. To generate certificates for individual services see 'step help ca'.")
 	} else {
 		ui.Println("Your registration authority is ready to go. To generate certificates for individual services see 'step help ca'.")
@@ -650,5 +2464,689 @@ func (p *PKI) Save(opt ...Option) error {
 
 	p.askFeedback()
 
+	if p.hooks.OnSaved != nil {
+		p.hooks.OnSaved(config)
+	}
+
+	// The PKI is complete, there's nothing to clean up.
+	p.createdFiles = nil
+	return nil
+}
+
+// saveDefaults generates the CA URL, if necessary, and writes the defaults
+// file.
+func (p *PKI) saveDefaults() error {
+	// Generate the CA URL.
+	caURL, err := p.CAURL()
+	if err != nil {
+		return err
+	}
+
+	// Generate and write defaults.json
+	defaults := &caDefaults{
+		Root:        p.root,
+		CAConfig:    p.config,
+		CAUrl:       caURL,
+		Fingerprint: p.rootFingerprint,
+		Profile:     p.defaultsProfile,
+	}
+	if err := p.writeDefaults(p.defaults, defaults); err != nil {
+		return err
+	}
+
+	// Write the unnamed defaults.json used by default if it does not exist.
+	if p.defaultsProfile != "" {
+		filename := filepath.Join(filepath.Dir(p.defaults), defaultsFilename(""))
+		if _, err := os.Stat(filename); os.IsNotExist(err) {
+			unnamed := *defaults
+			unnamed.Profile = ""
+			if err := p.writeDefaults(filename, &unnamed); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Cleanup removes the files created by the PKI since the last successful Save,
+// like the certificates and private keys generated before a failure. Because
+// Save resets the list of created files, Cleanup can be deferred right after
+// creating the PKI.
+func (p *PKI) Cleanup() error {
+	var err error
+	for i := len(p.createdFiles) - 1; i >= 0; i-- {
+		name := p.createdFiles[i]
+		if e := os.Remove(name); e != nil && !os.IsNotExist(e) && err == nil {
+			err = errs.FileError(e, name)
+		}
+	}
+	p.createdFiles = nil
+	return err
+}
+
+// SelfTest loads the saved configuration in an in-process authority, without
+// starting the server, and signs a short-lived certificate using a token of
+// the default JWK provisioner. It returns an error if the certificate cannot
+// be signed or if it does not chain to the configured roots. The given
+// password is used to decrypt the provisioner key and, if no intermediate
+// password has been set, the intermediate key.
+func (p *PKI) SelfTest(pass []byte) error {
+	pass, err := promptPasswordIfNeeded(pass, "intermediate private key")
+	if err != nil {
+		return err
+	}
+
+	config, err := authority.LoadConfiguration(p.config)
+	if err != nil {
+		return err
+	}
+	// Do not open the database of the CA.
+	config.DB = nil
+	config.Password = string(pass)
+	if p.intermediatePassword != nil {
+		config.Password = string(p.intermediatePassword)
+	}
+
+	auth, err := authority.New(config)
+	if err != nil {
+		return errors.Wrap(err, "error initializing the authority")
+	}
+	defer auth.Shutdown()
+
+	// Create a token for the default provisioner.
+	var prov *provisioner.JWK
+	for _, pp := range config.AuthorityConfig.Provisioners {
+		if jwk, ok := pp.(*provisioner.JWK); ok && jwk.Name == p.provisioner {
+			prov = jwk
+			break
+		}
+	}
+	if prov == nil {
+		return errors.Errorf("provisioner %s was not found", p.provisioner)
+	}
+	b, err := jose.Decrypt([]byte(prov.EncryptedKey), jose.WithPassword(pass))
+	if err != nil {
+		return errors.Wrapf(err, "error decrypting provisioner %s key", prov.Name)
+	}
+	jwk, err := jose.ParseKey(b)
+	if err != nil {
+		return err
+	}
+	so := new(jose.SignerOptions)
+	so.WithType("JWT")
+	so.WithHeader("kid", jwk.KeyID)
+	signer, err := jose.NewSigner(jose.SigningKey{
+		Algorithm: jose.SignatureAlgorithm(jwk.Algorithm),
+		Key:       jwk.Key,
+	}, so)
+	if err != nil {
+		return errors.Wrap(err, "error creating token signer")
+	}
+
+	const commonName = "self-test.step-ca.local"
+	now := time.Now()
+	token, err := jose.Signed(signer).Claims(struct {
+		jose.Claims
+		SANs []string `json:"sans"`
+	}{
+		Claims: jose.Claims{
+			Subject:   commonName,
+			Issuer:    prov.Name,
+			NotBefore: jose.NewNumericDate(now),
+			Expiry:    jose.NewNumericDate(now.Add(5 * time.Minute)),
+			Audience:  []string{"https://" + config.DNSNames[0] + "/1.0/sign"},
+		},
+		SANs: []string{commonName},
+	}).CompactSerialize()
+	if err != nil {
+		return errors.Wrap(err, "error signing token")
+	}
+
+	// Sign a short-lived certificate.
+	key, err := generateDefaultKey()
+	if err != nil {
+		return err
+	}
+	cr, err := x509util.CreateCertificateRequest(commonName, []string{commonName}, key)
+	if err != nil {
+		return err
+	}
+	ctx := provisioner.NewContextWithMethod(context.Background(), provisioner.SignMethod)
+	signOpts, err := auth.Authorize(ctx, token)
+	if err != nil {
+		return errors.Wrap(err, "error authorizing token")
+	}
+	certs, err := auth.Sign(cr, provisioner.SignOptions{
+		NotAfter: provisioner.NewTimeDuration(now.Add(10 * time.Minute)),
+	}, signOpts...)
+	if err != nil {
+		return errors.Wrap(err, "error signing certificate")
+	}
+
+	// Verify the certificate with the roots on disk.
+	roots := x509.NewCertPool()
+	for _, filename := range config.Root {
+		crts, err := pemutil.ReadCertificateBundle(filename)
+		if err != nil {
+			return err
+		}
+		for _, crt := range crts {
+			roots.AddCert(crt)
+		}
+	}
+	intermediates := x509.NewCertPool()
+	for _, crt := range certs[1:] {
+		intermediates.AddCert(crt)
+	}
+	if _, err := certs[0].Verify(x509.VerifyOptions{
+		DNSName:       commonName,
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}); err != nil {
+		return errors.Wrap(err, "error verifying certificate")
+	}
+	return nil
+}
+
+// readIntermediate reads the intermediate certificate and key from disk. The
+// given password is used to decrypt the key if no intermediate password has
+// been set.
+func (p *PKI) readIntermediate(pass []byte) (*x509.Certificate, crypto.Signer, error) {
+	if p.intermediateKey == "" {
+		return nil, nil, errors.New("the intermediate key is not available, it's managed by the registration authority")
+	}
+	crt, err := pemutil.ReadCertificate(p.intermediate)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPass := pass
+	if p.intermediatePassword != nil {
+		keyPass = p.intermediatePassword
+	}
+	key, err := pemutil.Read(p.intermediateKey, pemutil.WithPassword(keyPass))
+	if err != nil {
+		return nil, nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, nil, errors.Errorf("intermediate key %s is not a signer", p.intermediateKey)
+	}
+	return crt, signer, nil
+}
+
+// GenerateCRLSigner creates a key and a certificate, issued by the
+// intermediate, that can only be used to sign CRLs on its behalf. They are
+// written to crl_signer.crt and crl_signer_key, the key is encrypted with the
+// given password, that is also used to decrypt the intermediate key if no
+// intermediate password has been set. The certificate expires with the
+// intermediate.
+//
+// The authority does not sign CRLs, so the files are not added to ca.json.
+func (p *PKI) GenerateCRLSigner(pass []byte) (*x509.Certificate, error) {
+	pass, err := promptPasswordIfNeeded(pass, "CRL signer private key")
+	if err != nil {
+		return nil, err
+	}
+	issuer, issuerSigner, err := p.readIntermediate(pass)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := generateDefaultKey()
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		Subject: pkix.Name{
+			CommonName: issuer.Subject.CommonName + " CRL Signer",
+		},
+		NotBefore:             time.Now(),
+		NotAfter:              issuer.NotAfter,
+		KeyUsage:              x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+	}
+	if template.SerialNumber, err = p.nextSerialNumber(issuer); err != nil {
+		return nil, err
+	}
+	if template.SubjectKeyId, err = p.subjectKeyID(key.Public()); err != nil {
+		return nil, err
+	}
+	crt, err := x509util.CreateCertificate(template, issuer, key.Public(), issuerSigner)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := encode(func(w io.Writer) error {
+		return writeCertificates(w, crt)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := p.writeFile(p.crlSigner, b, 0600); err != nil {
+		return nil, err
+	}
+	if err := p.writeKey(p.crlSignerKey, key, pass); err != nil {
+		return nil, err
+	}
+	return crt, nil
+}
+
+// IssueTestLeaf signs a certificate valid for five minutes directly with the
+// intermediate key on disk, without the authority or its provisioners. It's
+// meant to test the generated PKI. The certificate uses the given extended key
+// usages, or server and client authentication if none is given. The password
+// is used to decrypt the intermediate key if no intermediate password has been
+// set.
+func (p *PKI) IssueTestLeaf(cn string, sans []string, pass []byte, extKeyUsages ...x509.ExtKeyUsage) (*x509.Certificate, crypto.Signer, error) {
+	if len(extKeyUsages) == 0 {
+		extKeyUsages = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+	}
+
+	issuer, issuerSigner, err := p.readIntermediate(pass)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	key, err := generateDefaultKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	cr, err := x509util.CreateCertificateRequest(cn, sans, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509util.NewCertificate(cr, x509util.WithTemplate(x509util.DefaultLeafTemplate, x509util.CreateTemplateData(cn, sans)))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now()
+	template := cert.GetCertificate()
+	template.NotBefore = now.Add(-time.Minute)
+	template.NotAfter = now.Add(5 * time.Minute)
+	template.ExtKeyUsage = extKeyUsages
+	if template.SerialNumber, err = p.nextSerialNumber(issuer); err != nil {
+		return nil, nil, err
+	}
+	crt, err := x509util.CreateCertificate(template, issuer, key.Public(), issuerSigner)
+	if err != nil {
+		return nil, nil, err
+	}
+	return crt, key, nil
+}
+
+// ReconfigureOption is the type for modifiers over an existing auth config
+// object.
+type ReconfigureOption func(c *authority.Config) error
+
+// WithAddress is a ReconfigureOption that sets the address the CA listens on.
+func WithAddress(address string) ReconfigureOption {
+	return func(c *authority.Config) error {
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			return errors.Errorf("invalid address %s", address)
+		}
+		c.Address = address
+		return nil
+	}
+}
+
+// WithDNSNames is a ReconfigureOption that sets the DNS names of the CA.
+func WithDNSNames(dnsNames []string) ReconfigureOption {
+	return func(c *authority.Config) error {
+		if len(dnsNames) == 0 {
+			return errors.New("dnsNames cannot be empty")
+		}
+		for _, name := range dnsNames {
+			if strings.TrimSpace(name) == "" {
+				return errors.New("dnsNames cannot contain empty values")
+			}
+		}
+		c.DNSNames = dnsNames
+		return nil
+	}
+}
+
+// Reconfigure updates the existing ca.json and, if it exists, defaults.json
+// using the given options. It does not generate new keys or certificates. The
+// files are replaced atomically, without asking for confirmation.
+func (p *PKI) Reconfigure(opts ...ReconfigureOption) error {
+	unlock := lockBaseDir(p.base)
+	defer unlock()
+
+	config, err := authority.LoadConfiguration(p.config)
+	if err != nil {
+		return err
+	}
+	for _, o := range opts {
+		if err := o(config); err != nil {
+			return err
+		}
+	}
+
+	// Only the address and the dns names are replaced in the raw JSON, so the
+	// provisioners and the fields unknown to this version are not lost.
+	raw, err := readRawJSON(p.config)
+	if err != nil {
+		return err
+	}
+	if err := raw.set("address", config.Address); err != nil {
+		return err
+	}
+	if err := raw.set("dnsNames", config.DNSNames); err != nil {
+		return err
+	}
+
+	// Prepare defaults.json before modifying ca.json, so an error does not
+	// leave the files out of sync. The dns names in ca.json already include
+	// the IP addresses.
+	var defaults rawJSON
+	switch _, err := os.Stat(p.defaults); {
+	case os.IsNotExist(err):
+	case err != nil:
+		return errs.FileError(err, p.defaults)
+	default:
+		if defaults, err = readRawJSON(p.defaults); err != nil {
+			return err
+		}
+		caURL, err := p.caURLFor(config.DNSNames, config.Address)
+		if err != nil {
+			return err
+		}
+		if err := defaults.set("ca-url", caURL); err != nil {
+			return err
+		}
+	}
+
+	if err := updateJSONFile(p.config, raw); err != nil {
+		return err
+	}
+	if defaults != nil {
+		if err := updateJSONFile(p.defaults, defaults); err != nil {
+			return err
+		}
+	}
+
+	p.address = config.Address
+	p.dnsNames = config.DNSNames
+	p.ipAddresses = nil
+	return nil
+}
+
+// RotateProvisionerKey replaces the key of the JWK provisioner with the given
+// name in the existing ca.json with a new key pair encrypted with pass. Other
+// provisioners are not modified. The configuration is replaced atomically,
+// without asking for confirmation.
+func (p *PKI) RotateProvisionerKey(name string, pass []byte) error {
+	unlock := lockBaseDir(p.base)
+	defer unlock()
+
+	// Only the key of the provisioner is replaced in the raw JSON, so the
+	// provisioners and the fields unknown to this version are not lost.
+	config, err := readRawJSON(p.config)
+	if err != nil {
+		return err
+	}
+	auth, provs, err := p.rawProvisioners(config)
+	if err != nil {
+		return err
+	}
+	index := -1
+	for i, b := range provs {
+		id, err := p.rawProvisionerID(b)
+		if err != nil {
+			return err
+		}
+		if strings.EqualFold(id.Type, "jwk") && id.Name == name {
+			if index >= 0 {
+				return errors.Errorf("error rotating key: multiple JWK provisioners named %s", name)
+			}
+			index = i
+		}
+	}
+	if index < 0 {
+		return errors.Errorf("error rotating key: JWK provisioner %s not found in %s", name, p.config)
+	}
+	var prov rawJSON
+	if err := json.Unmarshal(provs[index], &prov); err != nil {
+		return errors.Wrapf(err, "error parsing %s", p.config)
+	}
+
+	pass, err = promptPasswordIfNeeded(pass, "provisioner key")
+	if err != nil {
+		return err
+	}
+	pub, priv, err := jose.GenerateDefaultKeyPair(pass)
+	if err != nil {
+		return err
+	}
+	key, err := priv.CompactSerialize()
+	if err != nil {
+		return errors.Wrap(err, "error serializing private key")
+	}
+	if err := prov.set("key", pub); err != nil {
+		return err
+	}
+	if err := prov.set("encryptedKey", key); err != nil {
+		return err
+	}
+	if provs[index], err = json.Marshal(prov); err != nil {
+		return errors.Wrapf(err, "error marshaling provisioner %s", name)
+	}
+	if err := p.setRawProvisioners(config, auth, provs); err != nil {
+		return err
+	}
+	if err := updateJSONFile(p.config, config); err != nil {
+		return err
+	}
+	if name == p.provisioner {
+		p.ottPublicKey, p.ottPrivateKey = pub, priv
+	}
+	return nil
+}
+
+// AddProvisioner adds the given provisioner to the existing ca.json. It
+// returns an error if a provisioner with the same name already exists. The
+// configuration is replaced atomically, without asking for confirmation.
+func (p *PKI) AddProvisioner(prov provisioner.Interface) error {
+	if prov == nil {
+		return errors.New("error adding provisioner: provisioner cannot be nil")
+	}
+	name := prov.GetName()
+	if name == "" {
+		return errors.New("error adding provisioner: provisioner name cannot be empty")
+	}
+
+	// Provisioners with an unknown type are skipped when ca.json is loaded, make
+	// sure that the provisioner can be read back.
+	b, err := json.Marshal(provisioner.List{prov})
+	if err != nil {
+		return errors.Wrapf(err, "error marshaling provisioner %s", name)
+	}
+	var list provisioner.List
+	if err := json.Unmarshal(b, &list); err != nil {
+		return errors.Wrapf(err, "error adding provisioner %s", name)
+	}
+	if len(list) != 1 {
+		return errors.Errorf("error adding provisioner %s: type %q is not supported", name, prov.GetType())
+	}
+
+	unlock := lockBaseDir(p.base)
+	defer unlock()
+
+	// Edit the raw JSON, so the provisioners and the fields unknown to this
+	// version are not lost.
+	config, err := readRawJSON(p.config)
+	if err != nil {
+		return err
+	}
+	auth, provs, err := p.rawProvisioners(config)
+	if err != nil {
+		return err
+	}
+	for _, b := range provs {
+		if id, err := p.rawProvisionerID(b); err != nil {
+			return err
+		} else if id.Name == name {
+			return errors.Errorf("error adding provisioner: a provisioner named %s already exists in %s", name, p.config)
+		}
+	}
+	if b, err = json.Marshal(prov); err != nil {
+		return errors.Wrapf(err, "error marshaling provisioner %s", name)
+	}
+	if err := p.setRawProvisioners(config, auth, append(provs, b)); err != nil {
+		return err
+	}
+	return updateJSONFile(p.config, config)
+}
+
+// rawJSON is a JSON object with its values not decoded. Files are updated
+// through it to keep the fields unknown to this version.
+type rawJSON map[string]json.RawMessage
+
+// readRawJSON reads the JSON object in filename.
+func readRawJSON(filename string) (rawJSON, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, errs.FileError(err, filename)
+	}
+	var m rawJSON
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, errors.Wrapf(err, "error parsing %s", filename)
+	}
+	if m == nil {
+		m = rawJSON{}
+	}
+	return m, nil
+}
+
+// set replaces the value of key with the JSON encoding of v.
+func (m rawJSON) set(key string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return errors.Wrapf(err, "error marshaling %s", key)
+	}
+	m[key] = b
 	return nil
 }
+
+// rawProvisionerID are the fields that identify a provisioner in ca.json.
+type rawProvisionerID struct {
+	Type string `json:"type"`
+	Name string `json:"name"`
+}
+
+// rawProvisioners returns the authority section of the given ca.json and its
+// provisioners, including the ones with a type unknown to this version.
+func (p *PKI) rawProvisioners(config rawJSON) (rawJSON, []json.RawMessage, error) {
+	auth := rawJSON{}
+	if b, ok := config["authority"]; ok {
+		if err := json.Unmarshal(b, &auth); err != nil {
+			return nil, nil, errors.Wrapf(err, "error parsing %s", p.config)
+		}
+		if auth == nil {
+			auth = rawJSON{}
+		}
+	}
+	var provs []json.RawMessage
+	if b, ok := auth["provisioners"]; ok {
+		if err := json.Unmarshal(b, &provs); err != nil {
+			return nil, nil, errors.Wrapf(err, "error parsing %s", p.config)
+		}
+	}
+	return auth, provs, nil
+}
+
+// rawProvisionerID returns the type and name of the given raw provisioner.
+func (p *PKI) rawProvisionerID(b json.RawMessage) (*rawProvisionerID, error) {
+	id := new(rawProvisionerID)
+	if err := json.Unmarshal(b, id); err != nil {
+		return nil, errors.Wrapf(err, "error parsing %s", p.config)
+	}
+	return id, nil
+}
+
+// setRawProvisioners replaces the provisioners in the authority section of the
+// given ca.json.
+func (p *PKI) setRawProvisioners(config, auth rawJSON, provs []json.RawMessage) error {
+	if err := auth.set("provisioners", provs); err != nil {
+		return err
+	}
+	return config.set("authority", auth)
+}
+
+// updateJSONFile replaces the existing filename with the JSON encoding of v.
+// The file is written atomically and, unlike writeFile, it never asks for
+// confirmation and it's not removed by Cleanup.
+func updateJSONFile(filename string, v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "\t")
+	if err != nil {
+		return errors.Wrapf(err, "error marshaling %s", filename)
+	}
+	return writeFileAtomic(filename, b, 0644)
+}
+
+// writeConfig writes the given configuration in the ca.json file.
+func (p *PKI) writeConfig(config *authority.Config) error {
+	b, err := json.MarshalIndent(config, "", "\t")
+	if err != nil {
+		return errors.Wrapf(err, "error marshaling %s", p.config)
+	}
+	return p.writeFile(p.config, b, 0644)
+}
+
+// writeDefaults writes the given defaults in filename.
+func (p *PKI) writeDefaults(filename string, defaults *caDefaults) error {
+	b, err := json.MarshalIndent(defaults, "", "\t")
+	if err != nil {
+		return errors.Wrapf(err, "error marshaling %s", filename)
+	}
+	return p.writeFile(filename, b, 0644)
+}
+
+// CAURL returns the URL of the CA that Save writes in the defaults file. It's
+// the one set with SetCAURL, or one generated from the primary DNS name, by
+// default the first one, and the port of the address.
+func (p *PKI) CAURL() (string, error) {
+	return p.caURLFor(p.getDNSNames(), p.address)
+}
+
+// caURLFor returns the CA URL for the given dns names and address.
+func (p *PKI) caURLFor(dnsNames []string, address string) (string, error) {
+	if p.caURL != "" {
+		return p.caURL, nil
+	}
+	if p.primaryDNSName != "" {
+		if !containsString(dnsNames, p.primaryDNSName) {
+			return "", errors.Errorf("error generating the CA URL: primary dns name %s is not one of the dns names", p.primaryDNSName)
+		}
+		return generateCAURL(p.primaryDNSName, address)
+	}
+	if len(dnsNames) == 0 {
+		return "", errors.New("error generating the CA URL: dns names cannot be empty")
+	}
+	return generateCAURL(dnsNames[0], address)
+}
+
+// SetPrimaryDNSName sets the dns name used to generate the CA URL written in
+// the defaults file, by default the first dns name is used. The name must be
+// one of the dns names or IP addresses of the CA.
+func (p *PKI) SetPrimaryDNSName(name string) error {
+	if name != "" && !containsString(p.getDNSNames(), name) {
+		return errors.Errorf("primary dns name %s is not one of the dns names %v", name, p.getDNSNames())
+	}
+	p.primaryDNSName = name
+	return nil
+}
+
+// generateCAURL returns the CA URL for the given DNS name and listen address.
+func generateCAURL(dnsName, address string) (string, error) {
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", errors.Wrapf(err, "error parsing %s", address)
+	}
+	if port == "443" {
+		return fmt.Sprintf("https://%s", dnsName), nil
+	}
+	return fmt.Sprintf("https://%s:%s", dnsName, port), nil
+}
@@ -0,0 +1,4313 @@
+package pki
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/smallstep/certificates/authority"
+	"github.com/smallstep/certificates/authority/provisioner"
+	"github.com/smallstep/certificates/cas/apiv1"
+	apierrs "github.com/smallstep/certificates/errs"
+	kmsapi "github.com/smallstep/certificates/kms/apiv1"
+	"github.com/smallstep/certificates/templates"
+	"github.com/urfave/cli"
+	"go.step.sm/cli-utils/command"
+	"go.step.sm/crypto/jose"
+	"go.step.sm/crypto/pemutil"
+	"go.step.sm/crypto/x509util"
+	"golang.org/x/crypto/ssh"
+	"software.sslmate.com/src/go-pkcs12"
+
+	// Enable cloudcas in ca.json validation.
+	_ "github.com/smallstep/certificates/cas/cloudcas"
+)
+
+// tempDir creates a temporary directory that is removed when the test and
+// its subtests complete.
+func tempDir(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "pki-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.RemoveAll(dir)
+	})
+	return dir
+}
+
+func newTestPKI(t *testing.T) *PKI {
+	t.Helper()
+	p := &PKI{
+		provisioner: "step-cli",
+		address:     "127.0.0.1:9000",
+		dnsNames:    []string{"127.0.0.1"},
+	}
+	if err := p.SetBaseDir(tempDir(t)); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.GenerateKeyPairs([]byte("password")); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func mustCertificatePEM(t *testing.T, name string, isCA bool) []byte {
+	t.Helper()
+	signer, err := generateDefaultKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cr, err := x509util.CreateCertificateRequest(name, []string{}, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tpl := x509util.DefaultLeafTemplate
+	if isCA {
+		tpl = x509util.DefaultRootTemplate
+	}
+	cert, err := x509util.NewCertificate(cr, x509util.WithTemplate(tpl, x509util.CreateTemplateData(name, []string{name})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := cert.GetCertificate()
+	crt, err := x509util.CreateCertificate(template, template, signer.Public(), signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: crt.Raw})
+}
+
+// setForce sets the force flag used by fileutil.WriteFile to overwrite
+// existing files without prompting.
+func setForce(t *testing.T) {
+	t.Helper()
+	newContext := func(force bool) *cli.Context {
+		set := flag.NewFlagSet("test", flag.ContinueOnError)
+		set.Bool("force", force, "")
+		return cli.NewContext(nil, set, nil)
+	}
+	noop := command.ActionFunc(func(*cli.Context) error { return nil })
+	noop(newContext(true))
+	t.Cleanup(func() {
+		noop(newContext(false))
+	})
+}
+
+func mockPrompt(t *testing.T, tty bool, pass []byte, err error) {
+	t.Helper()
+	tmpIsTerminal, tmpPromptPassword := isTerminal, promptPassword
+	t.Cleanup(func() {
+		isTerminal, promptPassword = tmpIsTerminal, tmpPromptPassword
+	})
+	isTerminal = func() bool {
+		return tty
+	}
+	promptPassword = func(label string) ([]byte, error) {
+		return pass, err
+	}
+}
+
+func Test_promptPasswordIfNeeded(t *testing.T) {
+	type args struct {
+		pass []byte
+		name string
+	}
+	tests := []struct {
+		name      string
+		tty       bool
+		prompted  []byte
+		promptErr error
+		args      args
+		want      []byte
+		wantErr   bool
+	}{
+		{"ok password", false, nil, nil, args{[]byte("password"), "root private key"}, []byte("password"), false},
+		{"ok empty password", false, nil, nil, args{[]byte{}, "root private key"}, []byte{}, false},
+		{"ok prompt", true, []byte("prompted"), nil, args{nil, "root private key"}, []byte("prompted"), false},
+		{"fail prompt", true, nil, errors.New("an error"), args{nil, "root private key"}, nil, true},
+		{"fail not a terminal", false, []byte("prompted"), nil, args{nil, "root private key"}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockPrompt(t, tt.tty, tt.prompted, tt.promptErr)
+			got, err := promptPasswordIfNeeded(tt.args.pass, tt.args.name)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("promptPasswordIfNeeded() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("promptPasswordIfNeeded() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPKI_GenerateKeyPairs_notTerminal(t *testing.T) {
+	mockPrompt(t, false, nil, nil)
+	p := &PKI{}
+	if err := p.GenerateKeyPairs(nil); err == nil {
+		t.Error("PKI.GenerateKeyPairs() error = nil, wantErr true")
+	}
+	if p.ottPrivateKey != nil {
+		t.Error("PKI.GenerateKeyPairs() should not have generated a key")
+	}
+}
+
+func TestWithX5CProvisioner(t *testing.T) {
+	rootPEM := mustCertificatePEM(t, "X5C Root", true)
+	leafPEM := mustCertificatePEM(t, "leaf.smallstep.com", false)
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: []byte("not a key")})
+
+	type args struct {
+		name     string
+		rootsPEM []byte
+	}
+	tests := []struct {
+		name    string
+		args    args
+		wantErr bool
+	}{
+		{"ok", args{"x5c", rootPEM}, false},
+		{"ok bundle", args{"x5c", append(append(leafPEM, keyPEM...), rootPEM...)}, false},
+		{"fail empty", args{"x5c", nil}, true},
+		{"fail not pem", args{"x5c", []byte("not a pem")}, true},
+		{"fail leaf", args{"x5c", leafPEM}, true},
+		{"fail bad certificate", args{"x5c", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte("foo")})}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestPKI(t)
+			config, err := p.GenerateConfig(WithX5CProvisioner(tt.args.name, tt.args.rootsPEM))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("GenerateConfig() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if tt.wantErr {
+				return
+			}
+
+			provs := config.AuthorityConfig.Provisioners
+			if len(provs) != 2 {
+				t.Fatalf("GenerateConfig() provisioners = %d, want 2", len(provs))
+			}
+			x5c, ok := provs[1].(*provisioner.X5C)
+			if !ok {
+				t.Fatalf("GenerateConfig() provisioner type = %T, want *provisioner.X5C", provs[1])
+			}
+			if x5c.Type != "X5C" || x5c.Name != tt.args.name || !reflect.DeepEqual(x5c.Roots, tt.args.rootsPEM) {
+				t.Errorf("GenerateConfig() provisioner = %v", x5c)
+			}
+
+			b, err := json.Marshal(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(string(b), `"roots":"`+base64.StdEncoding.EncodeToString(tt.args.rootsPEM)+`"`) {
+				t.Errorf("json.Marshal() = %s does not contain the x5c roots", b)
+			}
+		})
+	}
+}
+
+func TestWithProvisionersFromFile(t *testing.T) {
+	dir := tempDir(t)
+	write := func(name, content string) string {
+		filename := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(filename, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return filename
+	}
+
+	tests := []struct {
+		name      string
+		path      string
+		wantNames []string
+		wantErr   bool
+	}{
+		{"ok", write("ok.json", `[{"type":"ACME","name":"acme"},{"type":"SSHPOP","name":"sshpop-extra"}]`), []string{"step-cli", "acme", "sshpop-extra"}, false},
+		{"ok duplicate default", write("duplicate-default.json", `[{"type":"ACME","name":"step-cli"},{"type":"ACME","name":"acme"}]`), []string{"step-cli", "acme"}, false},
+		{"ok empty", write("empty.json", `[]`), []string{"step-cli"}, false},
+		{"fail missing", filepath.Join(dir, "missing.json"), nil, true},
+		{"fail json", write("bad.json", `{"type":"ACME","name":"acme"}`), nil, true},
+		{"fail type", write("type.json", `[{"type":"ACME","name":"acme"},{"type":"FOO","name":"foo"}]`), nil, true},
+		{"fail name", write("name.json", `[{"type":"ACME"}]`), nil, true},
+		{"fail duplicate", write("duplicate.json", `[{"type":"ACME","name":"acme"},{"type":"SSHPOP","name":"acme"}]`), nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestPKI(t)
+			config, err := p.GenerateConfig(WithProvisionersFromFile(tt.path))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("PKI.GenerateConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			var names []string
+			for _, prov := range config.AuthorityConfig.Provisioners {
+				names = append(names, prov.GetName())
+			}
+			if !reflect.DeepEqual(names, tt.wantNames) {
+				t.Errorf("PKI.GenerateConfig() provisioners = %v, want %v", names, tt.wantNames)
+			}
+			if _, ok := config.AuthorityConfig.Provisioners[0].(*provisioner.JWK); !ok {
+				t.Errorf("PKI.GenerateConfig() default provisioner = %T, want *provisioner.JWK", config.AuthorityConfig.Provisioners[0])
+			}
+		})
+	}
+}
+
+func TestPKI_loadEnv(t *testing.T) {
+	setenv := func(t *testing.T, key, value string) {
+		t.Helper()
+		old, ok := os.LookupEnv(key)
+		if err := os.Setenv(key, value); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			if ok {
+				os.Setenv(key, old)
+			} else {
+				os.Unsetenv(key)
+			}
+		})
+	}
+
+	tests := []struct {
+		name         string
+		address      string
+		dnsNames     string
+		wantAddress  string
+		wantDNSNames []string
+		wantErr      bool
+	}{
+		{"ok defaults", "", "", "127.0.0.1:9000", []string{"127.0.0.1"}, false},
+		{"ok address", ":443", "", ":443", []string{"127.0.0.1"}, false},
+		{"ok dns names", "", "ca.example.com, 10.0.0.1,,", "127.0.0.1:9000", []string{"ca.example.com", "10.0.0.1"}, false},
+		{"ok both", "10.0.0.1:8443", "ca.example.com", "10.0.0.1:8443", []string{"ca.example.com"}, false},
+		{"fail address", "ca.example.com", "", "", nil, true},
+		{"fail dns names", "", " , ", "", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setenv(t, addressEnv, tt.address)
+			setenv(t, dnsNamesEnv, tt.dnsNames)
+			p := &PKI{
+				address:  "127.0.0.1:9000",
+				dnsNames: []string{"127.0.0.1"},
+			}
+			if err := p.loadEnv(); (err != nil) != tt.wantErr {
+				t.Fatalf("PKI.loadEnv() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if p.address != tt.wantAddress {
+				t.Errorf("PKI.address = %s, want %s", p.address, tt.wantAddress)
+			}
+			if !reflect.DeepEqual(p.dnsNames, tt.wantDNSNames) {
+				t.Errorf("PKI.dnsNames = %v, want %v", p.dnsNames, tt.wantDNSNames)
+			}
+
+			// Setters take precedence over the environment.
+			p.SetAddress(":9443")
+			p.SetDNSNames([]string{"ca.internal"})
+			if p.address != ":9443" || !reflect.DeepEqual(p.dnsNames, []string{"ca.internal"}) {
+				t.Errorf("PKI address and dns names = %s, %v, want :9443, [ca.internal]", p.address, p.dnsNames)
+			}
+		})
+	}
+}
+
+func TestPKI_SetBaseDir(t *testing.T) {
+	dir := tempDir(t)
+	p := &PKI{}
+	if err := p.SetBaseDir(dir); err != nil {
+		t.Fatalf("PKI.SetBaseDir() error = %v", err)
+	}
+	for _, name := range []string{"certs", "secrets", "config", "templates"} {
+		if fi, err := os.Stat(filepath.Join(dir, name)); err != nil || !fi.IsDir() {
+			t.Errorf("PKI.SetBaseDir() did not create %s", name)
+		}
+	}
+	for _, fn := range []string{p.root, p.rootKey, p.intermediate, p.intermediateKey, p.sshHostKey, p.sshHostPubKey, p.sshUserKey, p.sshUserPubKey, p.config, p.defaults} {
+		if !strings.HasPrefix(fn, dir) {
+			t.Errorf("PKI.SetBaseDir() path %s is not in %s", fn, dir)
+		}
+	}
+
+	// Templates must be in the base directory
+	p.enableSSH = true
+	for _, tt := range p.getTemplates().SSH.User {
+		if !strings.HasPrefix(tt.TemplatePath, dir) {
+			t.Errorf("PKI.getTemplates() path %s is not in %s", tt.TemplatePath, dir)
+		}
+	}
+}
+
+func TestPKI_SetBaseDir_notWritable(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("root can write in read-only directories")
+	}
+	dir := tempDir(t)
+	if err := os.Chmod(dir, 0500); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.Chmod(dir, 0700)
+	})
+
+	base := filepath.Join(dir, "step")
+	err := new(PKI).SetBaseDir(base)
+	if err == nil {
+		t.Fatal("PKI.SetBaseDir() error = nil, wantErr true")
+	}
+	if !strings.Contains(err.Error(), "the STEPPATH "+base+" is not writable") {
+		t.Errorf("PKI.SetBaseDir() error = %v, want STEPPATH is not writable", err)
+	}
+}
+
+func TestPKI_SetBaseDir_notDirectory(t *testing.T) {
+	tests := []struct {
+		name     string
+		dirs     []string
+		file     string
+		conflict string
+	}{
+		{"ok partial", []string{"certs", "config"}, "", ""},
+		{"fail config", []string{"certs"}, "config", "config"},
+		{"fail templates", nil, "templates", "templates"},
+		{"fail base", nil, ".", "."},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base := filepath.Join(tempDir(t), "step")
+			for _, dir := range tt.dirs {
+				if err := os.MkdirAll(filepath.Join(base, dir), 0700); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.file != "" {
+				filename := filepath.Join(base, tt.file)
+				if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+					t.Fatal(err)
+				}
+				if err := ioutil.WriteFile(filename, []byte("not a directory"), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err := new(PKI).SetBaseDir(base)
+			if tt.conflict == "" {
+				if err != nil {
+					t.Fatalf("PKI.SetBaseDir() error = %v", err)
+				}
+				// It can be called again.
+				if err := new(PKI).SetBaseDir(base); err != nil {
+					t.Fatalf("PKI.SetBaseDir() error = %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("PKI.SetBaseDir() error = nil, wantErr true")
+			}
+			if want := filepath.Join(base, tt.conflict) + " exists but it is not a directory"; !strings.HasPrefix(err.Error(), want) {
+				t.Errorf("PKI.SetBaseDir() error = %v, want %s", err, want)
+			}
+		})
+	}
+}
+
+func Test_baseDirError(t *testing.T) {
+	tests := []struct {
+		name        string
+		err         error
+		notWritable bool
+	}{
+		{"permission denied", &os.PathError{Op: "mkdir", Path: "/step/certs", Err: syscall.EACCES}, true},
+		{"read-only file system", &os.PathError{Op: "mkdir", Path: "/step/certs", Err: syscall.EROFS}, true},
+		{"other", &os.PathError{Op: "mkdir", Path: "/step/certs", Err: syscall.ENOSPC}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := baseDirError(tt.err, "/step", "/step/certs")
+			if got := strings.Contains(err.Error(), "the STEPPATH /step is not writable"); got != tt.notWritable {
+				t.Errorf("baseDirError() = %v, want not writable error %v", err, tt.notWritable)
+			}
+		})
+	}
+}
+
+func TestPlan(t *testing.T) {
+	setForce(t)
+	pass := []byte("password")
+	dir := filepath.Join(tempDir(t), "step")
+
+	planned, err := Plan(dir, true)
+	if err != nil {
+		t.Fatalf("Plan() error = %v", err)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Fatalf("Plan() created %s", dir)
+	}
+	for _, f := range planned {
+		if f.Exists {
+			t.Errorf("Plan() file %s exists", f.Path)
+		}
+	}
+
+	p := newTestPKI(t)
+	if err := p.SetBaseDir(dir); err != nil {
+		t.Fatal(err)
+	}
+	root, rootKey, err := p.GenerateRootCertificate("Test Root", pass)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.GenerateIntermediateCertificate("Test Intermediate", root, rootKey, pass); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.GenerateSSHSigningKeys(pass); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The database is created by the CA.
+	want := map[string]os.FileMode{}
+	for _, f := range planned {
+		if f.Path != p.getDBPath() {
+			want[f.Path] = f.Mode
+		}
+	}
+	got := map[string]os.FileMode{}
+	if err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || path == dir {
+			return err
+		}
+		got[path] = info.Mode().Perm()
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Plan() = %v, want %v", want, got)
+	}
+
+	planned, err = Plan(dir, true)
+	if err != nil {
+		t.Fatalf("Plan() error = %v", err)
+	}
+	for _, f := range planned {
+		if f.Exists != (f.Path != p.getDBPath()) {
+			t.Errorf("Plan() file %s exists = %v", f.Path, f.Exists)
+		}
+	}
+}
+
+func TestPKI_Cleanup(t *testing.T) {
+	setForce(t)
+	pass := []byte("password")
+	generate := func(t *testing.T) *PKI {
+		t.Helper()
+		p := newTestPKI(t)
+		root, rootKey, err := p.GenerateRootCertificate("Test Root", pass)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := p.GenerateIntermediateCertificate("Test Intermediate", root, rootKey, pass); err != nil {
+			t.Fatal(err)
+		}
+		if err := p.GenerateSSHSigningKeys(pass); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	exists := func(name string) bool {
+		_, err := os.Stat(name)
+		return err == nil
+	}
+
+	t.Run("ok failed save", func(t *testing.T) {
+		p := generate(t)
+		// An existing ca.json must be kept.
+		if err := ioutil.WriteFile(p.config, []byte("{}"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		// Writing the defaults will fail.
+		if err := os.Mkdir(p.defaults, 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := p.Save(); err == nil {
+			t.Fatal("PKI.Save() error = nil, wantErr true")
+		}
+		if err := p.Cleanup(); err != nil {
+			t.Fatalf("PKI.Cleanup() error = %v", err)
+		}
+
+		for _, name := range []string{p.root, p.rootKey, p.intermediate, p.intermediateKey, p.sshHostKey, p.sshHostPubKey, p.sshUserKey, p.sshUserPubKey} {
+			if exists(name) {
+				t.Errorf("PKI.Cleanup() did not remove %s", name)
+			}
+		}
+		secrets, err := ioutil.ReadDir(filepath.Join(p.base, privatePath))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(secrets) != 0 {
+			t.Errorf("PKI.Cleanup() left %d files in %s", len(secrets), privatePath)
+		}
+		if !exists(p.config) {
+			t.Errorf("PKI.Cleanup() removed the existing %s", p.config)
+		}
+	})
+
+	t.Run("ok successful save", func(t *testing.T) {
+		p := generate(t)
+		if err := p.Save(); err != nil {
+			t.Fatal(err)
+		}
+		if err := p.Cleanup(); err != nil {
+			t.Fatalf("PKI.Cleanup() error = %v", err)
+		}
+		for _, name := range []string{p.root, p.rootKey, p.intermediate, p.intermediateKey, p.config, p.defaults} {
+			if !exists(name) {
+				t.Errorf("PKI.Cleanup() removed %s", name)
+			}
+		}
+	})
+}
+
+func TestPKI_SelfTest(t *testing.T) {
+	setForce(t)
+	pass := []byte("password")
+	generate := func(t *testing.T) *PKI {
+		t.Helper()
+		p := newTestPKI(t)
+		root, rootKey, err := p.GenerateRootCertificate("Test Root", pass)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := p.GenerateIntermediateCertificate("Test Intermediate", root, rootKey, pass); err != nil {
+			t.Fatal(err)
+		}
+		if err := p.Save(); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	t.Run("ok", func(t *testing.T) {
+		if err := generate(t).SelfTest(pass); err != nil {
+			t.Errorf("PKI.SelfTest() error = %v", err)
+		}
+	})
+
+	t.Run("fail password", func(t *testing.T) {
+		if err := generate(t).SelfTest([]byte("bad-password")); err == nil {
+			t.Error("PKI.SelfTest() error = nil, wantErr true")
+		}
+	})
+
+	t.Run("fail tampered root", func(t *testing.T) {
+		p := generate(t)
+		if err := ioutil.WriteFile(p.root, mustCertificatePEM(t, "Other Root", true), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := p.SelfTest(pass); err == nil {
+			t.Error("PKI.SelfTest() error = nil, wantErr true")
+		}
+	})
+
+	t.Run("fail tampered provisioner", func(t *testing.T) {
+		p := generate(t)
+		config, err := authority.LoadConfiguration(p.config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Use the encrypted key of a different provisioner.
+		other := newTestPKI(t)
+		prov := config.AuthorityConfig.Provisioners[0].(*provisioner.JWK)
+		if prov.EncryptedKey, err = other.ottPrivateKey.CompactSerialize(); err != nil {
+			t.Fatal(err)
+		}
+		if err := p.writeConfig(config); err != nil {
+			t.Fatal(err)
+		}
+		if err := p.SelfTest(pass); err == nil {
+			t.Error("PKI.SelfTest() error = nil, wantErr true")
+		}
+	})
+}
+
+func TestPKI_SetSubjectKeyIDMethod(t *testing.T) {
+	setForce(t)
+	publicKeyHash := func(t *testing.T, pub crypto.PublicKey) [20]byte {
+		t.Helper()
+		b, err := x509.MarshalPKIXPublicKey(pub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var info struct {
+			Algorithm        pkix.AlgorithmIdentifier
+			SubjectPublicKey asn1.BitString
+		}
+		if _, err := asn1.Unmarshal(b, &info); err != nil {
+			t.Fatal(err)
+		}
+		return sha1.Sum(info.SubjectPublicKey.Bytes)
+	}
+
+	tests := []struct {
+		name    string
+		method  SubjectKeyIDMethod
+		want    func(hash [20]byte) []byte
+		wantErr bool
+	}{
+		{"ok sha1", SubjectKeyIDSHA1, func(hash [20]byte) []byte {
+			return hash[:]
+		}, false},
+		{"ok truncated sha1", SubjectKeyIDTruncatedSHA1, func(hash [20]byte) []byte {
+			id := hash[12:]
+			id[0] = 0x40 | (id[0] & 0x0f)
+			return id
+		}, false},
+		{"fail method", SubjectKeyIDMethod(2), nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestPKI(t)
+			if err := p.SetSubjectKeyIDMethod(tt.method); (err != nil) != tt.wantErr {
+				t.Fatalf("PKI.SetSubjectKeyIDMethod() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			root, rootKey, err := p.GenerateRootCertificate("Test Root", []byte("password"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := p.GenerateIntermediateCertificate("Test Intermediate", root, rootKey, []byte("password")); err != nil {
+				t.Fatal(err)
+			}
+			intermediate, err := pemutil.ReadCertificate(p.intermediate)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if want := tt.want(publicKeyHash(t, root.PublicKey)); !bytes.Equal(root.SubjectKeyId, want) {
+				t.Errorf("root SubjectKeyId = %x, want %x", root.SubjectKeyId, want)
+			}
+			if want := tt.want(publicKeyHash(t, intermediate.PublicKey)); !bytes.Equal(intermediate.SubjectKeyId, want) {
+				t.Errorf("intermediate SubjectKeyId = %x, want %x", intermediate.SubjectKeyId, want)
+			}
+			if !bytes.Equal(intermediate.AuthorityKeyId, root.SubjectKeyId) {
+				t.Errorf("intermediate AuthorityKeyId = %x, want %x", intermediate.AuthorityKeyId, root.SubjectKeyId)
+			}
+		})
+	}
+}
+
+func TestPKI_IssueTestLeaf(t *testing.T) {
+	setForce(t)
+	pass := []byte("password")
+	p := newTestPKI(t)
+	root, rootKey, err := p.GenerateRootCertificate("Test Root", pass)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.GenerateIntermediateCertificate("Test Intermediate", root, rootKey, pass); err != nil {
+		t.Fatal(err)
+	}
+	intermediate, err := pemutil.ReadCertificate(p.intermediate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(root)
+	intermediates := x509.NewCertPool()
+	intermediates.AddCert(intermediate)
+
+	tests := []struct {
+		name         string
+		pass         []byte
+		extKeyUsages []x509.ExtKeyUsage
+		want         []x509.ExtKeyUsage
+		wantErr      bool
+	}{
+		{"ok", pass, nil, []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}, false},
+		{"ok client", pass, []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}, []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}, false},
+		{"ok code signing", pass, []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning}, []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning}, false},
+		{"fail password", []byte("bad-password"), nil, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			crt, key, err := p.IssueTestLeaf("test.smallstep.com", []string{"test.smallstep.com", "127.0.0.1"}, tt.pass, tt.extKeyUsages...)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("PKI.IssueTestLeaf() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if crt.IsCA {
+				t.Error("PKI.IssueTestLeaf() IsCA = true, want false")
+			}
+			if !reflect.DeepEqual(crt.ExtKeyUsage, tt.want) {
+				t.Errorf("PKI.IssueTestLeaf() ExtKeyUsage = %v, want %v", crt.ExtKeyUsage, tt.want)
+			}
+			if !reflect.DeepEqual(crt.PublicKey, key.Public()) {
+				t.Error("PKI.IssueTestLeaf() public key does not match the signer")
+			}
+			if crt.NotAfter.Sub(crt.NotBefore) > 10*time.Minute {
+				t.Errorf("PKI.IssueTestLeaf() validity = %s, want a short-lived certificate", crt.NotAfter.Sub(crt.NotBefore))
+			}
+			if _, err := crt.Verify(x509.VerifyOptions{
+				DNSName:       "test.smallstep.com",
+				Roots:         roots,
+				Intermediates: intermediates,
+				KeyUsages:     tt.want,
+			}); err != nil {
+				t.Errorf("Certificate.Verify() error = %v", err)
+			}
+		})
+	}
+
+	t.Run("fail registration authority", func(t *testing.T) {
+		p := newTestPKI(t)
+		p.intermediateKey = ""
+		if _, _, err := p.IssueTestLeaf("test.smallstep.com", nil, pass); err == nil {
+			t.Error("PKI.IssueTestLeaf() error = nil, wantErr true")
+		}
+	})
+}
+
+func TestPKI_GenerateCRLSigner(t *testing.T) {
+	setForce(t)
+	pass := []byte("password")
+	generate := func(t *testing.T) *PKI {
+		t.Helper()
+		p := newTestPKI(t)
+		root, rootKey, err := p.GenerateRootCertificate("Test Root", pass)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := p.GenerateIntermediateCertificate("Test Intermediate", root, rootKey, pass); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	t.Run("ok", func(t *testing.T) {
+		p := generate(t)
+		crt, err := p.GenerateCRLSigner(pass)
+		if err != nil {
+			t.Fatalf("PKI.GenerateCRLSigner() error = %v", err)
+		}
+		intermediate, err := pemutil.ReadCertificate(p.intermediate)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if crt.KeyUsage != x509.KeyUsageCRLSign {
+			t.Errorf("PKI.GenerateCRLSigner() KeyUsage = %v, want %v", crt.KeyUsage, x509.KeyUsageCRLSign)
+		}
+		if crt.IsCA || !crt.BasicConstraintsValid {
+			t.Errorf("PKI.GenerateCRLSigner() IsCA = %v, BasicConstraintsValid = %v, want false, true", crt.IsCA, crt.BasicConstraintsValid)
+		}
+		if err := crt.CheckSignatureFrom(intermediate); err != nil {
+			t.Errorf("Certificate.CheckSignatureFrom() error = %v", err)
+		}
+		if !bytes.Equal(crt.AuthorityKeyId, intermediate.SubjectKeyId) {
+			t.Errorf("PKI.GenerateCRLSigner() AuthorityKeyId = %x, want %x", crt.AuthorityKeyId, intermediate.SubjectKeyId)
+		}
+		if !crt.NotAfter.Equal(intermediate.NotAfter) {
+			t.Errorf("PKI.GenerateCRLSigner() NotAfter = %v, want %v", crt.NotAfter, intermediate.NotAfter)
+		}
+
+		// Check the files written.
+		got, err := pemutil.ReadCertificate(p.crlSigner)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !got.Equal(crt) {
+			t.Errorf("%s does not contain the CRL signer certificate", p.crlSigner)
+		}
+		key, err := pemutil.Read(p.crlSignerKey, pemutil.WithPassword(pass))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(key.(crypto.Signer).Public(), crt.PublicKey) {
+			t.Errorf("%s does not match the CRL signer certificate", p.crlSignerKey)
+		}
+	})
+
+	t.Run("fail password", func(t *testing.T) {
+		if _, err := generate(t).GenerateCRLSigner([]byte("bad-password")); err == nil {
+			t.Error("PKI.GenerateCRLSigner() error = nil, wantErr true")
+		}
+	})
+
+	t.Run("fail registration authority", func(t *testing.T) {
+		p := newTestPKI(t)
+		p.intermediateKey = ""
+		if _, err := p.GenerateCRLSigner(pass); err == nil {
+			t.Error("PKI.GenerateCRLSigner() error = nil, wantErr true")
+		}
+	})
+}
+
+func TestPKI_RegenerateTemplates(t *testing.T) {
+	setForce(t)
+	p := newTestPKI(t)
+	if err := p.GenerateSSHSigningKeys([]byte("password")); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	tpls := p.getTemplates().SSH
+	edited, removed := tpls.User[0], tpls.Host[0]
+	readTemplate := func(t *testing.T, tpl templates.Template) string {
+		t.Helper()
+		b, err := ioutil.ReadFile(tpl.TemplatePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+	if err := ioutil.WriteFile(edited.TemplatePath, []byte("edited"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(removed.TemplatePath); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without force only missing templates are written
+	if err := p.RegenerateTemplates(false); err != nil {
+		t.Fatalf("PKI.RegenerateTemplates() error = %v", err)
+	}
+	if got := readTemplate(t, edited); got != "edited" {
+		t.Errorf("template %s = %q, want %q", edited.Name, got, "edited")
+	}
+	if got, want := readTemplate(t, removed), templates.DefaultSSHTemplateData[removed.Name]; got != want {
+		t.Errorf("template %s = %q, want %q", removed.Name, got, want)
+	}
+
+	// With force all templates are overwritten
+	if err := p.RegenerateTemplates(true); err != nil {
+		t.Fatalf("PKI.RegenerateTemplates() error = %v", err)
+	}
+	if got, want := readTemplate(t, edited), templates.DefaultSSHTemplateData[edited.Name]; got != want {
+		t.Errorf("template %s = %q, want %q", edited.Name, got, want)
+	}
+
+	t.Run("fail no config", func(t *testing.T) {
+		if err := newTestPKI(t).RegenerateTemplates(true); err == nil {
+			t.Error("PKI.RegenerateTemplates() error = nil, wantErr true")
+		}
+	})
+}
+
+func TestPKI_Save_concurrent(t *testing.T) {
+	setForce(t)
+	dir := tempDir(t)
+	newPKI := func(address string) *PKI {
+		p := newTestPKI(t)
+		if err := p.SetBaseDir(dir); err != nil {
+			t.Fatal(err)
+		}
+		if err := p.GenerateSSHSigningKeys([]byte("password")); err != nil {
+			t.Fatal(err)
+		}
+		p.SetAddress(address)
+		return p
+	}
+
+	pkis := []*PKI{newPKI("127.0.0.1:9000"), newPKI("127.0.0.1:9001")}
+	errs := make([]error, len(pkis))
+
+	var wg sync.WaitGroup
+	for i := range pkis {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = pkis[i].Save()
+		}(i)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("PKI.Save() %d error = %v", i, err)
+		}
+	}
+
+	// The files must be consistent with one of the two PKIs
+	config, err := authority.LoadConfiguration(pkis[0].config)
+	if err != nil {
+		t.Fatalf("authority.LoadConfiguration() error = %v", err)
+	}
+	b, err := ioutil.ReadFile(pkis[0].defaults)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var defaults caDefaults
+	if err := json.Unmarshal(b, &defaults); err != nil {
+		t.Fatalf("json.Unmarshal() error = %v", err)
+	}
+	_, port, _ := net.SplitHostPort(config.Address)
+	if want := "https://127.0.0.1:" + port; defaults.CAUrl != want {
+		t.Errorf("defaults.json ca-url = %s, want %s", defaults.CAUrl, want)
+	}
+}
+
+func TestPKI_SetSSHOrganization(t *testing.T) {
+	tests := []struct {
+		name     string
+		org      string
+		wantHost string
+		wantUser string
+	}{
+		{"ok default", "", "step-ca host CA", "step-ca user CA"},
+		{"ok organization", "Smallstep Labs", "step-ca host CA Smallstep Labs", "step-ca user CA Smallstep Labs"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestPKI(t)
+			p.SetSSHOrganization(tt.org)
+			if err := p.GenerateSSHSigningKeys([]byte("password")); err != nil {
+				t.Fatal(err)
+			}
+			for filename, want := range map[string]string{p.sshHostPubKey: tt.wantHost, p.sshUserPubKey: tt.wantUser} {
+				b, err := ioutil.ReadFile(filename)
+				if err != nil {
+					t.Fatal(err)
+				}
+				_, comment, _, rest, err := ssh.ParseAuthorizedKey(b)
+				if err != nil {
+					t.Fatalf("ssh.ParseAuthorizedKey() error = %v", err)
+				}
+				if comment != want {
+					t.Errorf("%s comment = %q, want %q", filepath.Base(filename), comment, want)
+				}
+				if len(rest) != 0 || !bytes.HasSuffix(b, []byte(want+"\n")) {
+					t.Errorf("%s = %q, want a single line ending with %q", filepath.Base(filename), b, want)
+				}
+			}
+		})
+	}
+}
+
+func TestPKI_GenerateConfig_withoutKeyPairs(t *testing.T) {
+	p := &PKI{
+		provisioner: "step-cli",
+		address:     "127.0.0.1:9000",
+		dnsNames:    []string{"127.0.0.1"},
+	}
+	if err := p.SetBaseDir(tempDir(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "call GenerateKeyPairs before GenerateConfig"
+	if _, err := p.GenerateConfig(); err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("PKI.GenerateConfig() error = %v, want %q", err, want)
+	}
+	setForce(t)
+	if err := p.Save(); err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("PKI.Save() error = %v, want %q", err, want)
+	}
+	if _, err := os.Stat(p.config); !os.IsNotExist(err) {
+		t.Errorf("PKI.Save() wrote %s", p.config)
+	}
+}
+
+func TestPKI_GenerateConfig_provisionerNames(t *testing.T) {
+	tests := []struct {
+		name        string
+		provisioner string
+		enableSSH   bool
+		opts        []Option
+		wantErr     string
+	}{
+		{"ok", "step-cli", true, nil, ""},
+		{"ok sshpop without ssh", "sshpop", false, nil, ""},
+		{"fail empty", "", false, nil, "the provisioner name cannot be empty"},
+		{"fail sshpop", "sshpop", true, nil, "there is more than one provisioner named sshpop"},
+		{"fail option", "step-cli", false, []Option{WithX5CProvisioner("step-cli", mustCertificatePEM(t, "X5C Root", true))}, "there is more than one provisioner named step-cli"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestPKI(t)
+			p.SetProvisioner(tt.provisioner)
+			p.enableSSH = tt.enableSSH
+			_, err := p.GenerateConfig(tt.opts...)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("PKI.GenerateConfig() error = %v", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Errorf("PKI.GenerateConfig() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPKI_GenerateConfig_registrationAuthority(t *testing.T) {
+	tests := []struct {
+		name    string
+		options *apiv1.Options
+		wantRA  bool
+	}{
+		{"softcas default", nil, false},
+		{"softcas", &apiv1.Options{Type: "softcas"}, false},
+		{"cloudcas", &apiv1.Options{Type: "cloudcas", CertificateAuthority: "projects/test/locations/us-west1/certificateAuthorities/test-ca"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestPKI(t)
+			p.SetAuthorityOptions(tt.options)
+			config, err := p.GenerateConfig()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Common configuration
+			if len(config.Root) != 1 || config.Root[0] != p.root || config.IntermediateCert != p.intermediate {
+				t.Errorf("Config root = %v, crt = %s, want %s and %s", config.Root, config.IntermediateCert, p.root, p.intermediate)
+			}
+			if config.DB == nil || config.TLS == nil {
+				t.Errorf("Config db = %v, tls = %v, want both set", config.DB, config.TLS)
+			}
+			if config.AuthorityConfig.Options != tt.options {
+				t.Errorf("Config authority options = %v, want %v", config.AuthorityConfig.Options, tt.options)
+			}
+
+			// Local signing keys
+			if tt.wantRA {
+				if config.IntermediateKey != "" || config.KMS != nil {
+					t.Errorf("Config key = %s, kms = %v, want empty", config.IntermediateKey, config.KMS)
+				}
+			} else {
+				if config.IntermediateKey != p.intermediateKey || config.KMS != nil {
+					t.Errorf("Config key = %s, kms = %v, want %s and empty", config.IntermediateKey, config.KMS, p.intermediateKey)
+				}
+			}
+			if err := config.Validate(); err != nil {
+				t.Errorf("Config.Validate() error = %v", err)
+			}
+		})
+	}
+}
+
+func TestPKI_GenerateConfig_sshOptions(t *testing.T) {
+	p := newTestPKI(t)
+	if err := p.GenerateSSHSigningKeys([]byte("password")); err != nil {
+		t.Fatal(err)
+	}
+	p.SetSSHCriticalOptions(map[string]string{
+		"force-command":  "/usr/bin/true",
+		"source-address": "10.0.0.0/8",
+	})
+	p.SetSSHExtensions(map[string]string{
+		"permit-pty": "",
+	})
+
+	config, err := p.GenerateConfig()
+	if err != nil {
+		t.Fatalf("PKI.GenerateConfig() error = %v", err)
+	}
+	if config.SSH == nil {
+		t.Fatal("PKI.GenerateConfig() ssh config is nil")
+	}
+
+	opts := config.AuthorityConfig.Provisioners[0].(*provisioner.JWK).Options.GetSSHOptions()
+	if opts == nil {
+		t.Fatal("PKI.GenerateConfig() ssh options are nil")
+	}
+	var data map[string]map[string]string
+	if err := json.Unmarshal(opts.TemplateData, &data); err != nil {
+		t.Fatalf("json.Unmarshal() error = %v", err)
+	}
+	want := map[string]map[string]string{
+		"CriticalOptions": {"force-command": "/usr/bin/true", "source-address": "10.0.0.0/8"},
+		"Extensions":      {"permit-pty": ""},
+	}
+	if !reflect.DeepEqual(data, want) {
+		t.Errorf("PKI.GenerateConfig() templateData = %v, want %v", data, want)
+	}
+
+	// Without options the provisioner should not have any
+	p.SetSSHCriticalOptions(nil)
+	p.SetSSHExtensions(nil)
+	if config, err = p.GenerateConfig(); err != nil {
+		t.Fatalf("PKI.GenerateConfig() error = %v", err)
+	}
+	if opts := config.AuthorityConfig.Provisioners[0].(*provisioner.JWK).Options; opts != nil {
+		t.Errorf("PKI.GenerateConfig() options = %v, want nil", opts)
+	}
+}
+
+func TestPKI_SetTemplateData(t *testing.T) {
+	data := map[string]interface{}{
+		"organization": "Acme Corp",
+		"environment":  "prod",
+	}
+	tests := []struct {
+		name      string
+		data      map[string]interface{}
+		enableSSH bool
+		want      map[string]interface{}
+		wantErr   bool
+	}{
+		{"ok", data, false, data, false},
+		{"ok with ssh", data, true, data, false},
+		{"ok empty", nil, false, nil, false},
+		{"ok empty with ssh", nil, true, map[string]interface{}{}, false},
+		{"fail not serializable", map[string]interface{}{"fn": func() {}}, false, nil, true},
+		{"fail reserved name", map[string]interface{}{"Step": "foo"}, false, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestPKI(t)
+			if tt.enableSSH {
+				if err := p.GenerateSSHSigningKeys([]byte("password")); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := p.SetTemplateData(tt.data); (err != nil) != tt.wantErr {
+				t.Fatalf("PKI.SetTemplateData() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			config, err := p.GenerateConfig()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.want == nil {
+				if config.Templates != nil {
+					t.Errorf("Config.Templates = %v, want nil", config.Templates)
+				}
+				return
+			}
+			if !reflect.DeepEqual(config.Templates.Data, tt.want) {
+				t.Errorf("Config.Templates.Data = %v, want %v", config.Templates.Data, tt.want)
+			}
+			if (config.Templates.SSH != nil) != tt.enableSSH {
+				t.Errorf("Config.Templates.SSH = %v, want ssh templates %v", config.Templates.SSH, tt.enableSSH)
+			}
+		})
+	}
+}
+
+func TestWithAuthorityName(t *testing.T) {
+	pass := []byte("password")
+	p := newTestPKI(t)
+	assertCommonName := func(t *testing.T, want string, opts ...Option) {
+		t.Helper()
+		config, err := p.GenerateConfig(opts...)
+		if err != nil {
+			t.Fatalf("PKI.GenerateConfig() error = %v", err)
+		}
+		if config.CommonName != want {
+			t.Errorf("Config.CommonName = %s, want %s", config.CommonName, want)
+		}
+		b, err := json.Marshal(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var v struct {
+			CommonName *string `json:"commonName"`
+		}
+		if err := json.Unmarshal(b, &v); err != nil {
+			t.Fatal(err)
+		}
+		switch {
+		case want == "" && v.CommonName != nil:
+			t.Errorf("ca.json commonName = %s, want omitted", *v.CommonName)
+		case want != "" && (v.CommonName == nil || *v.CommonName != want):
+			t.Errorf("ca.json commonName = %v, want %s", v.CommonName, want)
+		}
+	}
+
+	assertCommonName(t, "")
+	root, rootKey, err := p.GenerateRootCertificate("Test Root", pass)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertCommonName(t, "")
+	if err := p.GenerateIntermediateCertificate("Test Intermediate", root, rootKey, pass); err != nil {
+		t.Fatal(err)
+	}
+	assertCommonName(t, "")
+	assertCommonName(t, "Test Online CA", WithAuthorityName("Test Online CA"))
+
+	if _, err := p.GenerateConfig(WithAuthorityName("")); err == nil {
+		t.Error("PKI.GenerateConfig() error = nil, wantErr true")
+	}
+
+	// A default ca.json does not set the common name.
+	if err := p.Save(); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(p.config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v map[string]interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		t.Fatal(err)
+	}
+	if cn, ok := v["commonName"]; ok {
+		t.Errorf("ca.json commonName = %v, want omitted", cn)
+	}
+}
+
+func TestWithDefaultDB(t *testing.T) {
+	p := newTestPKI(t)
+	config, err := p.GenerateConfig(WithoutDB(), WithDefaultDB())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The database is in the base directory of the PKI, not in STEPPATH.
+	if config.DB == nil || config.DB.Type != "badger" || config.DB.DataSource != p.getDBPath() {
+		t.Errorf("PKI.GenerateConfig() db = %+v, want badger in %s", config.DB, p.getDBPath())
+	}
+	if config.DB.DataSource == GetDBPath() {
+		t.Errorf("PKI.GenerateConfig() db.dataSource = %s, want a path in %s", config.DB.DataSource, p.base)
+	}
+}
+
+func TestWithBadgerOptions(t *testing.T) {
+	withType := func(typ string) Option {
+		return func(c *authority.Config) error {
+			c.DB.Type = typ
+			return nil
+		}
+	}
+	tests := []struct {
+		name                string
+		opts                []Option
+		wantValueDir        string
+		wantFileLoadingMode string
+		wantErr             bool
+	}{
+		{"ok", []Option{WithBadgerOptions("/var/lib/step/values", "fileio")}, "/var/lib/step/values", "fileio", false},
+		{"ok mmap", []Option{WithBadgerOptions("", "mmap")}, "", "mmap", false},
+		{"ok MemoryMap", []Option{WithBadgerOptions("", "MemoryMap")}, "", "MemoryMap", false},
+		{"ok memorymap", []Option{WithBadgerOptions("", "memorymap")}, "", "memorymap", false},
+		{"ok defaults", []Option{WithBadgerOptions("", "")}, "", "", false},
+		{"ok badgerv2", []Option{withType("badgerv2"), WithBadgerOptions("/var/lib/step/values", "FileIO")}, "/var/lib/step/values", "FileIO", false},
+		{"fail mode", []Option{WithBadgerOptions("", "foo")}, "", "", true},
+		{"fail without db", []Option{WithoutDB(), WithBadgerOptions("", "fileio")}, "", "", true},
+		{"fail type", []Option{withType("mysql"), WithBadgerOptions("", "fileio")}, "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestPKI(t)
+			config, err := p.GenerateConfig(tt.opts...)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("PKI.GenerateConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			b, err := json.Marshal(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var v struct {
+				DB map[string]interface{} `json:"db"`
+			}
+			if err := json.Unmarshal(b, &v); err != nil {
+				t.Fatal(err)
+			}
+			if got, _ := v.DB["valueDir"].(string); got != tt.wantValueDir {
+				t.Errorf("ca.json db.valueDir = %q, want %q", got, tt.wantValueDir)
+			}
+			if got, _ := v.DB["badgerFileLoadingMode"].(string); got != tt.wantFileLoadingMode {
+				t.Errorf("ca.json db.badgerFileLoadingMode = %q, want %q", got, tt.wantFileLoadingMode)
+			}
+			if got := v.DB["dataSource"]; got != p.getDBPath() {
+				t.Errorf("ca.json db.dataSource = %v, want %s", got, p.getDBPath())
+			}
+		})
+	}
+}
+
+func TestWithoutSSHPOP(t *testing.T) {
+	p := newTestPKI(t)
+	if err := p.GenerateSSHSigningKeys([]byte("password")); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := p.GenerateConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(config.AuthorityConfig.Provisioners); n != 2 {
+		t.Fatalf("PKI.GenerateConfig() provisioners = %d, want 2", n)
+	}
+	if typ := config.AuthorityConfig.Provisioners[1].GetType(); typ != provisioner.TypeSSHPOP {
+		t.Errorf("PKI.GenerateConfig() provisioner type = %s, want %s", typ, provisioner.TypeSSHPOP)
+	}
+
+	config, err = p.GenerateConfig(WithoutSSHPOP())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, prov := range config.AuthorityConfig.Provisioners {
+		if prov.GetType() == provisioner.TypeSSHPOP {
+			t.Errorf("PKI.GenerateConfig() provisioners = %v, want no SSHPOP", config.AuthorityConfig.Provisioners)
+		}
+	}
+	if n := len(config.AuthorityConfig.Provisioners); n != 1 {
+		t.Errorf("PKI.GenerateConfig() provisioners = %d, want 1", n)
+	}
+	if config.SSH == nil || config.SSH.HostKey != p.sshHostKey || config.SSH.UserKey != p.sshUserKey {
+		t.Errorf("PKI.GenerateConfig() ssh = %v, want host and user keys", config.SSH)
+	}
+}
+
+func TestPKI_SetExtraExtensions(t *testing.T) {
+	exts := []pkix.Extension{
+		{Id: asn1.ObjectIdentifier{1, 2, 3, 4}, Value: []byte{0x05, 0x00}},
+		{Id: asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 21, 7}, Critical: true, Value: []byte{0x30, 0x00}},
+	}
+
+	p := newTestPKI(t)
+	p.SetExtraExtensions(exts)
+	pass := []byte("password")
+	root, rootKey, err := p.GenerateRootCertificate("Test Root", pass)
+	if err != nil {
+		t.Fatalf("PKI.GenerateRootCertificate() error = %v", err)
+	}
+	if err := p.GenerateIntermediateCertificate("Test Intermediate", root, rootKey, pass); err != nil {
+		t.Fatalf("PKI.GenerateIntermediateCertificate() error = %v", err)
+	}
+	intermediate, err := pemutil.ReadCertificate(p.intermediate)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, crt := range []*x509.Certificate{root, intermediate} {
+		for _, want := range exts {
+			var found bool
+			for _, ext := range crt.Extensions {
+				if ext.Id.Equal(want.Id) {
+					found = true
+					if !reflect.DeepEqual(ext, want) {
+						t.Errorf("%s extension = %v, want %v", crt.Subject.CommonName, ext, want)
+					}
+				}
+			}
+			if !found {
+				t.Errorf("%s extension %s not found", crt.Subject.CommonName, want.Id)
+			}
+		}
+	}
+}
+
+func Test_writeFile(t *testing.T) {
+	setForce(t)
+	dir := tempDir(t)
+	filename := filepath.Join(dir, "ca.json")
+	if err := ioutil.WriteFile(filename, []byte("previous"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate a failure after writing some data.
+	tmp := writeData
+	t.Cleanup(func() {
+		writeData = tmp
+	})
+	writeData = func(w io.Writer, data []byte) error {
+		w.Write(data[:len(data)/2])
+		return errors.New("disk full")
+	}
+	if err := writeFile(filename, []byte("new contents"), 0644); err == nil {
+		t.Fatal("writeFile() error = nil, wantErr true")
+	}
+	assertFiles := func(want string) {
+		t.Helper()
+		if b, err := ioutil.ReadFile(filename); err != nil || string(b) != want {
+			t.Errorf("ioutil.ReadFile() = %s, %v, want %s", b, err, want)
+		}
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) != 1 {
+			t.Errorf("ioutil.ReadDir() found %d files, want 1", len(files))
+		}
+	}
+	assertFiles("previous")
+
+	// Save must fail without modifying the previous config.
+	p := newTestPKI(t)
+	p.config = filename
+	if err := p.Save(); err == nil {
+		t.Fatal("PKI.Save() error = nil, wantErr true")
+	}
+	assertFiles("previous")
+
+	// Without failures the file is replaced.
+	writeData = tmp
+	if err := writeFile(filename, []byte("new contents"), 0644); err != nil {
+		t.Fatalf("writeFile() error = %v", err)
+	}
+	assertFiles("new contents")
+	if st, err := os.Stat(filename); err != nil || st.Mode().Perm() != 0644 {
+		t.Errorf("os.Stat() = %v, %v, want mode 0644", st.Mode(), err)
+	}
+}
+
+func TestPKI_SetRootPassword(t *testing.T) {
+	common := []byte("common-password")
+	rootPass := []byte("root-password")
+	intermediatePass := []byte("intermediate-password")
+	passwords := [][]byte{common, rootPass, intermediatePass, nil}
+
+	tests := []struct {
+		name                 string
+		rootPassword         []byte
+		intermediatePassword []byte
+		wantRoot             []byte
+		wantIntermediate     []byte
+	}{
+		{"ok common", nil, nil, common, common},
+		{"ok distinct", rootPass, intermediatePass, rootPass, intermediatePass},
+		{"ok root only", rootPass, nil, rootPass, common},
+		{"ok intermediate only", nil, intermediatePass, common, intermediatePass},
+		{"ok unencrypted intermediate", rootPass, []byte{}, rootPass, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestPKI(t)
+			p.SetRootPassword(tt.rootPassword)
+			p.SetIntermediatePassword(tt.intermediatePassword)
+			p.SetInsecureNoPassword(tt.wantIntermediate == nil)
+			root, rootKey, err := p.GenerateRootCertificate("Test Root", common)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := p.GenerateIntermediateCertificate("Test Intermediate", root, rootKey, common); err != nil {
+				t.Fatal(err)
+			}
+
+			check := func(filename string, want []byte) {
+				t.Helper()
+				for _, pass := range passwords {
+					var opts []pemutil.Options
+					if pass != nil {
+						opts = append(opts, pemutil.WithPassword(pass))
+					}
+					_, err := pemutil.Read(filename, opts...)
+					// Unencrypted keys can be read with any password.
+					if want == nil || bytes.Equal(pass, want) {
+						if err != nil {
+							t.Errorf("pemutil.Read(%s) with password %q error = %v", filename, pass, err)
+						}
+					} else if err == nil {
+						t.Errorf("pemutil.Read(%s) with password %q did not fail", filename, pass)
+					}
+				}
+			}
+			check(p.rootKey, tt.wantRoot)
+			check(p.intermediateKey, tt.wantIntermediate)
+		})
+	}
+}
+
+func TestPKI_SetIntermediateLifetime(t *testing.T) {
+	pass := []byte("password")
+	tests := []struct {
+		name       string
+		lifetime   time.Duration
+		wantAsRoot bool
+		wantErr    bool
+	}{
+		{"ok default", 0, true, false},
+		{"ok shorter", 24 * time.Hour, false, false},
+		{"ok clamped", 20 * 365 * 24 * time.Hour, false, false},
+		{"fail negative", -time.Hour, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestPKI(t)
+			if err := p.SetIntermediateLifetime(tt.lifetime); (err != nil) != tt.wantErr {
+				t.Fatalf("PKI.SetIntermediateLifetime() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			root, rootKey, err := p.GenerateRootCertificate("Test Root", pass)
+			if err != nil {
+				t.Fatal(err)
+			}
+			now := time.Now()
+			if err := p.GenerateIntermediateCertificate("Test Intermediate", root, rootKey, pass); err != nil {
+				t.Fatal(err)
+			}
+			crt, err := pemutil.ReadCertificate(p.intermediate)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if crt.NotBefore.Before(root.NotBefore) || crt.NotAfter.After(root.NotAfter) {
+				t.Errorf("intermediate validity [%s, %s] is not within the root validity [%s, %s]", crt.NotBefore, crt.NotAfter, root.NotBefore, root.NotAfter)
+			}
+			if tt.wantAsRoot {
+				if !crt.NotBefore.Equal(root.NotBefore) || !crt.NotAfter.Equal(root.NotAfter) {
+					t.Errorf("intermediate validity [%s, %s] is not the root validity [%s, %s]", crt.NotBefore, crt.NotAfter, root.NotBefore, root.NotAfter)
+				}
+				return
+			}
+			want := now.Add(tt.lifetime)
+			if want.After(root.NotAfter) {
+				want = root.NotAfter
+			}
+			if d := crt.NotAfter.Sub(want); d < -time.Second || d > time.Second {
+				t.Errorf("intermediate NotAfter = %s, want %s", crt.NotAfter, want)
+			}
+		})
+	}
+}
+
+func TestPKI_SetInsecureNoPassword(t *testing.T) {
+	tests := []struct {
+		name     string
+		insecure bool
+		pass     []byte
+		wantErr  bool
+	}{
+		{"ok password", false, []byte("password"), false},
+		{"ok insecure password", true, []byte("password"), false},
+		{"ok insecure nil", true, nil, false},
+		{"ok insecure empty", true, []byte{}, false},
+		{"fail nil", false, nil, true},
+		{"fail empty", false, []byte{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestPKI(t)
+			p.SetInsecureNoPassword(tt.insecure)
+			key, err := generateDefaultKey()
+			if err != nil {
+				t.Fatal(err)
+			}
+			filename := filepath.Join(tempDir(t), "key")
+			err = p.writeKey(filename, key, tt.pass)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("PKI.writeKey() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				if _, err := os.Stat(filename); !os.IsNotExist(err) {
+					t.Errorf("os.Stat(%s) error = %v, want not exist", filename, err)
+				}
+				return
+			}
+			// Encrypted keys cannot be read without a password.
+			_, err = pemutil.Read(filename)
+			if encrypted := err != nil; encrypted != (len(tt.pass) > 0) {
+				t.Errorf("pemutil.Read(%s) error = %v, want encrypted %v", filename, err, len(tt.pass) > 0)
+			}
+		})
+	}
+}
+
+func TestEncryptKeyFile(t *testing.T) {
+	key, err := generateDefaultKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pass := []byte("password")
+	dir := tempDir(t)
+	writeKey := func(name string, key interface{}, opts ...pemutil.Options) string {
+		t.Helper()
+		block, err := pemutil.Serialize(key, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		filename := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(filename, pem.EncodeToMemory(block), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return filename
+	}
+	notPEM := filepath.Join(dir, "not-pem")
+	if err := ioutil.WriteFile(notPEM, []byte("not a key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		path    string
+		pass    []byte
+		wantErr bool
+	}{
+		{"ok", writeKey("plain", key), pass, false},
+		{"fail encrypted", writeKey("encrypted", key, pemutil.WithPassword([]byte("other"))), pass, true},
+		{"fail empty password", writeKey("empty", key), []byte{}, true},
+		{"fail public key", writeKey("public", key.Public()), pass, true},
+		{"fail not pem", notPEM, pass, true},
+		{"fail missing", filepath.Join(dir, "missing"), pass, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before, _ := ioutil.ReadFile(tt.path)
+			err := EncryptKeyFile(tt.path, tt.pass)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("EncryptKeyFile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				if after, _ := ioutil.ReadFile(tt.path); !bytes.Equal(before, after) {
+					t.Errorf("EncryptKeyFile() modified %s", tt.path)
+				}
+				return
+			}
+
+			if _, err := pemutil.Read(tt.path); err == nil {
+				t.Errorf("pemutil.Read(%s) without password did not fail", tt.path)
+			}
+			got, err := pemutil.Read(tt.path, pemutil.WithPassword(tt.pass))
+			if err != nil {
+				t.Fatalf("pemutil.Read(%s) error = %v", tt.path, err)
+			}
+			if !reflect.DeepEqual(got, key) {
+				t.Errorf("pemutil.Read(%s) = %v, want %v", tt.path, got, key)
+			}
+		})
+	}
+}
+
+func TestPKI_WriteOpenSSLConfig(t *testing.T) {
+	setForce(t)
+	pass := []byte("password")
+	tests := []struct {
+		name     string
+		kms      bool
+		ra       bool
+		wantRoot bool
+		wantErr  bool
+	}{
+		{"ok", false, false, true, false},
+		{"ok kms", true, false, false, false},
+		{"fail ra", false, true, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestPKI(t)
+			if tt.kms {
+				p.SetKeyManager(&fakeKeyManager{}, "projects/p/locations/l/keyRings/r/cryptoKeys/root")
+			}
+			if tt.ra {
+				p.SetAuthorityOptions(&apiv1.Options{Type: "cloudcas", CertificateAuthority: "projects/p/locations/l/certificateAuthorities/ca"})
+			}
+			if !tt.kms && !tt.ra {
+				root, rootKey, err := p.GenerateRootCertificate("Test Root", pass)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := p.GenerateIntermediateCertificate("Test Intermediate", root, rootKey, pass); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			dir := filepath.Join(tempDir(t), "openssl")
+			if err := os.Mkdir(dir, 0700); err != nil {
+				t.Fatal(err)
+			}
+			filename := filepath.Join(dir, "openssl.cnf")
+			if err := p.WriteOpenSSLConfig(filename); (err != nil) != tt.wantErr {
+				t.Fatalf("PKI.WriteOpenSSLConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				if _, err := os.Stat(filename); !os.IsNotExist(err) {
+					t.Errorf("%s exists, error = %v", filename, err)
+				}
+				return
+			}
+
+			b, err := ioutil.ReadFile(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cnf := string(b)
+			for _, want := range []string{
+				"dir             = " + dir + "\n",
+				"certificate     = " + p.intermediate + "\n",
+				"private_key     = " + p.intermediateKey + "\n",
+				"keyUsage               = critical, digitalSignature\n",
+			} {
+				if !strings.Contains(cnf, want) {
+					t.Errorf("openssl.cnf does not contain %q:\n%s", want, cnf)
+				}
+			}
+			// The intermediate keys are EC keys, key encipherment is only valid
+			// for RSA.
+			if strings.Contains(cnf, "keyEncipherment") {
+				t.Errorf("openssl.cnf contains keyEncipherment:\n%s", cnf)
+			}
+			for _, want := range []string{
+				"[ root_ca ]",
+				"certificate     = " + p.root + "\n",
+				"private_key     = " + p.rootKey + "\n",
+			} {
+				if got := strings.Contains(cnf, want); got != tt.wantRoot {
+					t.Errorf("openssl.cnf contains %q = %v, want %v", want, got, tt.wantRoot)
+				}
+			}
+			if fi, err := os.Stat(filepath.Join(dir, "newcerts")); err != nil || !fi.IsDir() {
+				t.Errorf("newcerts directory was not created: %v", err)
+			}
+			if _, err := os.Stat(filepath.Join(dir, "index.txt")); err != nil {
+				t.Errorf("index.txt was not created: %v", err)
+			}
+		})
+	}
+}
+
+func TestPKI_Provenance(t *testing.T) {
+	setForce(t)
+	pass := []byte("password")
+	p := newTestPKI(t)
+	root, rootKey, err := p.GenerateRootCertificate("Test Root", pass)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.GenerateIntermediateCertificate("Test Intermediate", root, rootKey, pass); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.GenerateSSHSigningKeys(pass); err != nil {
+		t.Fatal(err)
+	}
+	p.SetWriteProvenance(true)
+	if err := p.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(p.base, configPath, "provenance.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got provenance
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+
+	if got.Root == nil || got.Root.Fingerprint != Fingerprint(root) {
+		t.Errorf("provenance root = %+v, want fingerprint %s", got.Root, Fingerprint(root))
+	}
+	if got.Root.KeyType != "EC P-256" || got.Root.Subject != "CN=Test Root" || !got.Root.NotAfter.Equal(root.NotAfter) {
+		t.Errorf("provenance root = %+v", got.Root)
+	}
+	if got.Intermediate == nil || got.Intermediate.KeyType != "EC P-256" || got.Intermediate.Path != p.intermediate {
+		t.Errorf("provenance intermediate = %+v", got.Intermediate)
+	}
+	for _, key := range []*provenanceSSHKey{got.SSHHostKey, got.SSHUserKey} {
+		if key == nil || key.KeyType != "ecdsa-sha2-nistp256" || !strings.HasPrefix(key.Fingerprint, "SHA256:") {
+			t.Errorf("provenance ssh key = %+v", key)
+		}
+	}
+	if got.Version == "" || got.CreatedAt.IsZero() {
+		t.Errorf("provenance version = %q, createdAt = %v", got.Version, got.CreatedAt)
+	}
+
+	// The digest covers the record without the digest.
+	digest := got.Digest
+	got.Digest = ""
+	b, err = json.Marshal(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(b)
+	if want := "sha256:" + hex.EncodeToString(sum[:]); digest != want {
+		t.Errorf("provenance digest = %s, want %s", digest, want)
+	}
+
+	t.Run("fail missing root", func(t *testing.T) {
+		p := newTestPKI(t)
+		if _, err := p.Provenance(); err == nil {
+			t.Error("PKI.Provenance() error = nil, wantErr true")
+		}
+	})
+}
+
+func TestPKI_SaveWithResult(t *testing.T) {
+	setForce(t)
+	pass := []byte("password")
+	tests := []struct {
+		name         string
+		skipDefaults bool
+		enableSSH    bool
+		provenance   bool
+		wantCAURL    string
+	}{
+		{"ok", false, false, false, "https://127.0.0.1:9000"},
+		{"ok ssh and provenance", false, true, true, "https://127.0.0.1:9000"},
+		{"ok skip defaults", true, false, false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestPKI(t)
+			p.SetSkipDefaults(tt.skipDefaults)
+			p.SetWriteProvenance(tt.provenance)
+			root, rootKey, err := p.GenerateRootCertificate("Test Root", pass)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := p.GenerateIntermediateCertificate("Test Intermediate", root, rootKey, pass); err != nil {
+				t.Fatal(err)
+			}
+			if tt.enableSSH {
+				if err := p.GenerateSSHSigningKeys(pass); err != nil {
+					t.Fatal(err)
+				}
+			}
+			got, err := p.SaveWithResult()
+			if err != nil {
+				t.Fatalf("PKI.SaveWithResult() error = %v", err)
+			}
+
+			if got.Fingerprint != Fingerprint(root) {
+				t.Errorf("SaveResult.Fingerprint = %s, want %s", got.Fingerprint, Fingerprint(root))
+			}
+			if got.CAURL != tt.wantCAURL {
+				t.Errorf("SaveResult.CAURL = %s, want %s", got.CAURL, tt.wantCAURL)
+			}
+			files := []string{got.Root, got.RootKey, got.Intermediate, got.IntermediateKey, got.Config}
+			if tt.enableSSH {
+				files = append(files, got.SSHHostPublicKey, got.SSHHostKey, got.SSHUserPublicKey, got.SSHUserKey)
+			} else if got.SSHHostKey != "" || got.SSHUserKey != "" {
+				t.Errorf("SaveResult ssh keys = %s, %s, want empty", got.SSHHostKey, got.SSHUserKey)
+			}
+			if tt.provenance {
+				files = append(files, got.Provenance)
+			} else if got.Provenance != "" {
+				t.Errorf("SaveResult.Provenance = %s, want empty", got.Provenance)
+			}
+			for _, name := range files {
+				if name == "" || !strings.HasPrefix(name, p.base) {
+					t.Errorf("SaveResult file %q is not in %s", name, p.base)
+				} else if _, err := os.Stat(name); err != nil {
+					t.Errorf("os.Stat(%s) error = %v", name, err)
+				}
+			}
+
+			// The root and intermediate in the result are the ones in ca.json.
+			b, err := ioutil.ReadFile(got.Config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var config authority.Config
+			if err := json.Unmarshal(b, &config); err != nil {
+				t.Fatal(err)
+			}
+			if len(config.Root) != 1 || config.Root[0] != got.Root || config.IntermediateCert != got.Intermediate || config.IntermediateKey != got.IntermediateKey {
+				t.Errorf("ca.json root = %v, intermediate = %s, %s, want %s, %s, %s", config.Root, config.IntermediateCert, config.IntermediateKey, got.Root, got.Intermediate, got.IntermediateKey)
+			}
+
+			if tt.skipDefaults {
+				if got.Defaults != "" {
+					t.Errorf("SaveResult.Defaults = %s, want empty", got.Defaults)
+				}
+				return
+			}
+			b, err = ioutil.ReadFile(got.Defaults)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var defaults caDefaults
+			if err := json.Unmarshal(b, &defaults); err != nil {
+				t.Fatal(err)
+			}
+			if defaults.Fingerprint != got.Fingerprint || defaults.CAUrl != got.CAURL || defaults.Root != got.Root || defaults.CAConfig != got.Config {
+				t.Errorf("defaults = %+v, want %+v", defaults, got)
+			}
+		})
+	}
+}
+
+func TestPKI_SetHooks(t *testing.T) {
+	setForce(t)
+	pass := []byte("password")
+	var events []string
+	var root, intermediate *x509.Certificate
+	var hostKey, userKey ssh.PublicKey
+	var saved *authority.Config
+
+	p := newTestPKI(t)
+	p.SetHooks(Hooks{
+		OnRootGenerated: func(crt *x509.Certificate) {
+			events = append(events, "root")
+			root = crt
+		},
+		OnIntermediateGenerated: func(crt *x509.Certificate) {
+			events = append(events, "intermediate")
+			intermediate = crt
+		},
+		OnSSHKeysGenerated: func(host, user ssh.PublicKey) {
+			events = append(events, "ssh")
+			hostKey, userKey = host, user
+		},
+		OnSaved: func(config *authority.Config) {
+			events = append(events, "saved")
+			saved = config
+		},
+	})
+
+	rootCrt, rootKey, err := p.GenerateRootCertificate("Test Root", pass)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.GenerateIntermediateCertificate("Test Intermediate", rootCrt, rootKey, pass); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.GenerateSSHSigningKeys(pass); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []string{"root", "intermediate", "ssh", "saved"}; !reflect.DeepEqual(events, want) {
+		t.Errorf("events = %v, want %v", events, want)
+	}
+	if crt, err := pemutil.ReadCertificate(p.root); err != nil || root == nil || !crt.Equal(root) {
+		t.Errorf("OnRootGenerated certificate does not match %s: %v", p.root, err)
+	}
+	if crt, err := pemutil.ReadCertificate(p.intermediate); err != nil || intermediate == nil || !crt.Equal(intermediate) {
+		t.Errorf("OnIntermediateGenerated certificate does not match %s: %v", p.intermediate, err)
+	}
+	for filename, key := range map[string]ssh.PublicKey{p.sshHostPubKey: hostKey, p.sshUserPubKey: userKey} {
+		b, err := ioutil.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pub, _, _, _, err := ssh.ParseAuthorizedKey(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key == nil || !bytes.Equal(pub.Marshal(), key.Marshal()) {
+			t.Errorf("OnSSHKeysGenerated key does not match %s", filename)
+		}
+	}
+	if saved == nil || saved.IntermediateCert != p.intermediate || saved.SSH == nil {
+		t.Errorf("OnSaved config = %+v", saved)
+	}
+}
+
+func TestPKI_SetIssuingCertificateURL(t *testing.T) {
+	pass := []byte("password")
+	tests := []struct {
+		name    string
+		urls    []string
+		wantErr bool
+	}{
+		{"ok", []string{"http://ca.example.com/root_ca.crt"}, false},
+		{"ok multiple", []string{"http://ca.example.com/root_ca.crt", "https://ca.example.org/root_ca.crt"}, false},
+		{"ok empty", nil, false},
+		{"fail scheme", []string{"ldap://ca.example.com/root_ca.crt"}, true},
+		{"fail host", []string{"http:///root_ca.crt"}, true},
+		{"fail parse", []string{"http://ca.example.com/%zz"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestPKI(t)
+			if err := p.SetIssuingCertificateURL(tt.urls); (err != nil) != tt.wantErr {
+				t.Fatalf("PKI.SetIssuingCertificateURL() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			root, rootKey, err := p.GenerateRootCertificate("Test Root", pass)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := p.GenerateIntermediateCertificate("Test Intermediate", root, rootKey, pass); err != nil {
+				t.Fatal(err)
+			}
+			crt, err := pemutil.ReadCertificate(p.intermediate)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(crt.IssuingCertificateURL, tt.urls) {
+				t.Errorf("IssuingCertificateURL = %v, want %v", crt.IssuingCertificateURL, tt.urls)
+			}
+
+			// Check the encoding of the extension
+			type accessDescription struct {
+				Method   asn1.ObjectIdentifier
+				Location asn1.RawValue
+			}
+			var ext *pkix.Extension
+			for i := range crt.Extensions {
+				if crt.Extensions[i].Id.Equal(asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 1}) {
+					ext = &crt.Extensions[i]
+				}
+			}
+			if len(tt.urls) == 0 {
+				if ext != nil {
+					t.Errorf("authority information access extension = %v, want nil", ext)
+				}
+				return
+			}
+			if ext == nil {
+				t.Fatal("authority information access extension was not found")
+			}
+			if ext.Critical {
+				t.Error("authority information access extension is critical")
+			}
+			var aia []accessDescription
+			if rest, err := asn1.Unmarshal(ext.Value, &aia); err != nil || len(rest) != 0 {
+				t.Fatalf("asn1.Unmarshal() error = %v, rest = %x", err, rest)
+			}
+			if len(aia) != len(tt.urls) {
+				t.Fatalf("access descriptions = %d, want %d", len(aia), len(tt.urls))
+			}
+			for i, ad := range aia {
+				if !ad.Method.Equal(asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 2}) {
+					t.Errorf("access method = %v, want id-ad-caIssuers", ad.Method)
+				}
+				if ad.Location.Class != asn1.ClassContextSpecific || ad.Location.Tag != 6 || string(ad.Location.Bytes) != tt.urls[i] {
+					t.Errorf("access location = %+v, want uniformResourceIdentifier %s", ad.Location, tt.urls[i])
+				}
+			}
+		})
+	}
+}
+
+func TestPKI_SetCertificatePolicies(t *testing.T) {
+	oids := []asn1.ObjectIdentifier{{1, 3, 6, 1, 4, 1, 37476, 9000, 1}, {2, 23, 140, 1, 2, 1}}
+	type args struct {
+		oids   []asn1.ObjectIdentifier
+		cpsURI string
+	}
+	tests := []struct {
+		name    string
+		args    args
+		want    []policyInformation
+		wantErr bool
+	}{
+		{"ok", args{oids, "https://ca.smallstep.com/cps"}, []policyInformation{
+			{oids[0], []policyQualifierInfo{{oidPolicyQualifierCPS, "https://ca.smallstep.com/cps"}}},
+			{oids[1], []policyQualifierInfo{{oidPolicyQualifierCPS, "https://ca.smallstep.com/cps"}}},
+		}, false},
+		{"ok no cps", args{oids[:1], ""}, []policyInformation{
+			{oids[0], nil},
+		}, false},
+		{"fail no oids", args{nil, "https://ca.smallstep.com/cps"}, nil, true},
+		{"fail cps", args{oids, "not a url"}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestPKI(t)
+			if err := p.SetCertificatePolicies(tt.args.oids, tt.args.cpsURI); (err != nil) != tt.wantErr {
+				t.Fatalf("PKI.SetCertificatePolicies() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			pass := []byte("password")
+			root, rootKey, err := p.GenerateRootCertificate("Test Root", pass)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := p.GenerateIntermediateCertificate("Test Intermediate", root, rootKey, pass); err != nil {
+				t.Fatal(err)
+			}
+			intermediate, err := pemutil.ReadCertificate(p.intermediate)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(intermediate.PolicyIdentifiers, tt.args.oids) {
+				t.Errorf("PolicyIdentifiers = %v, want %v", intermediate.PolicyIdentifiers, tt.args.oids)
+			}
+			for _, ext := range intermediate.Extensions {
+				if ext.Id.Equal(oidExtensionCertificatePolicies) {
+					var got []policyInformation
+					if _, err := asn1.Unmarshal(ext.Value, &got); err != nil {
+						t.Fatal(err)
+					}
+					if !reflect.DeepEqual(got, tt.want) {
+						t.Errorf("certificate policies = %v, want %v", got, tt.want)
+					}
+				}
+			}
+			if len(root.PolicyIdentifiers) != 0 {
+				t.Errorf("root PolicyIdentifiers = %v, want none", root.PolicyIdentifiers)
+			}
+		})
+	}
+}
+
+type fakeKeyManager struct {
+	signer    crypto.Signer
+	createErr error
+}
+
+func (k *fakeKeyManager) GetPublicKey(req *kmsapi.GetPublicKeyRequest) (crypto.PublicKey, error) {
+	return k.signer.Public(), nil
+}
+
+func (k *fakeKeyManager) CreateKey(req *kmsapi.CreateKeyRequest) (*kmsapi.CreateKeyResponse, error) {
+	if k.createErr != nil {
+		return nil, k.createErr
+	}
+	return &kmsapi.CreateKeyResponse{
+		Name:      "fakekms:" + req.Name,
+		PublicKey: k.signer.Public(),
+		CreateSignerRequest: kmsapi.CreateSignerRequest{
+			SigningKey: "fakekms:" + req.Name,
+		},
+	}, nil
+}
+
+func (k *fakeKeyManager) CreateSigner(req *kmsapi.CreateSignerRequest) (crypto.Signer, error) {
+	return k.signer, nil
+}
+
+func (k *fakeKeyManager) Close() error {
+	return nil
+}
+
+func TestPKI_SetKeyManager(t *testing.T) {
+	signer, err := generateDefaultKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("ok", func(t *testing.T) {
+		p := newTestPKI(t)
+		p.SetKeyManager(&fakeKeyManager{signer: signer}, "root-key")
+
+		pass := []byte("password")
+		root, rootSigner, err := p.GenerateRootCertificate("Test Root", pass)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rootSigner != signer {
+			t.Errorf("GenerateRootCertificate() signer = %v, want %v", rootSigner, signer)
+		}
+		if err := root.CheckSignatureFrom(root); err != nil {
+			t.Errorf("root is not self-signed: %v", err)
+		}
+		if !reflect.DeepEqual(root.PublicKey, signer.Public()) {
+			t.Errorf("root public key does not match the KMS key")
+		}
+		if _, err := pemutil.ReadCertificate(p.root); err != nil {
+			t.Errorf("root certificate not written: %v", err)
+		}
+		if p.rootKeyURI != "fakekms:root-key" {
+			t.Errorf("PKI.rootKeyURI = %s, want fakekms:root-key", p.rootKeyURI)
+		}
+		if _, err := os.Stat(filepath.Join(p.base, "secrets", "root_ca_key")); !os.IsNotExist(err) {
+			t.Errorf("root key file should not exist, stat error = %v", err)
+		}
+		if err := p.GenerateIntermediateCertificate("Test Intermediate", root, rootSigner, pass); err != nil {
+			t.Fatal(err)
+		}
+
+		config, err := p.GenerateConfig()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if config.KMS != nil {
+			t.Errorf("Config.KMS = %v, want nil", config.KMS)
+		}
+
+		// The CA signs with the intermediate key on disk.
+		config.Password = string(pass)
+		a, err := authority.New(config)
+		if err != nil {
+			t.Fatalf("authority.New() error = %v", err)
+		}
+		if err := a.Shutdown(); err != nil {
+			t.Errorf("Authority.Shutdown() error = %v", err)
+		}
+
+		// The key URI is in the result and the provenance.
+		p.SetWriteProvenance(true)
+		res, err := p.SaveWithResult()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.RootKey != "" || res.RootKeyURI != "fakekms:root-key" {
+			t.Errorf("SaveResult root key = %q, uri = %q, want empty and fakekms:root-key", res.RootKey, res.RootKeyURI)
+		}
+		b, err := ioutil.ReadFile(res.Provenance)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var prov provenance
+		if err := json.Unmarshal(b, &prov); err != nil {
+			t.Fatal(err)
+		}
+		if prov.Root.KeyURI != "fakekms:root-key" {
+			t.Errorf("provenance root keyUri = %q, want fakekms:root-key", prov.Root.KeyURI)
+		}
+	})
+
+	t.Run("fail create key", func(t *testing.T) {
+		p := newTestPKI(t)
+		p.SetKeyManager(&fakeKeyManager{signer: signer, createErr: errors.New("an error")}, "root-key")
+		if _, _, err := p.GenerateRootCertificate("Test Root", []byte("password")); err == nil {
+			t.Error("GenerateRootCertificate() error = nil, wantErr true")
+		}
+	})
+}
+
+func TestPKI_Reconfigure(t *testing.T) {
+	tests := []struct {
+		name         string
+		setup        func(p *PKI)
+		opts         []ReconfigureOption
+		wantAddress  string
+		wantDNS      []string
+		wantURL      string
+		wantDefaults bool
+		wantErr      bool
+	}{
+		{"ok dns names", nil, []ReconfigureOption{WithDNSNames([]string{"ca.smallstep.com", "127.0.0.1"})},
+			"127.0.0.1:9000", []string{"ca.smallstep.com", "127.0.0.1"}, "https://ca.smallstep.com:9000", true, false},
+		{"ok address", nil, []ReconfigureOption{WithAddress(":443")},
+			":443", []string{"127.0.0.1"}, "https://127.0.0.1", true, false},
+		{"ok both", nil, []ReconfigureOption{WithAddress("0.0.0.0:8443"), WithDNSNames([]string{"ca.local"})},
+			"0.0.0.0:8443", []string{"ca.local"}, "https://ca.local:8443", true, false},
+		{"ok ca url", func(p *PKI) { p.SetCAURL("https://ca.example.com") }, []ReconfigureOption{WithDNSNames([]string{"ca.local"})},
+			"127.0.0.1:9000", []string{"ca.local"}, "https://ca.example.com", true, false},
+		{"ok primary dns name", func(p *PKI) {
+			p.SetDNSNames([]string{"127.0.0.1", "ca.local"})
+			if err := p.SetPrimaryDNSName("ca.local"); err != nil {
+				t.Fatal(err)
+			}
+		}, []ReconfigureOption{WithDNSNames([]string{"ca.internal", "ca.local"})},
+			"127.0.0.1:9000", []string{"ca.internal", "ca.local"}, "https://ca.local:9000", true, false},
+		{"ok ip addresses", func(p *PKI) {
+			p.SetDNSNames(nil)
+			if err := p.SetIPAddresses([]net.IP{net.ParseIP("10.0.0.1")}); err != nil {
+				t.Fatal(err)
+			}
+		}, []ReconfigureOption{WithAddress(":8443")},
+			":8443", []string{"10.0.0.1"}, "https://10.0.0.1:8443", true, false},
+		{"ok skip defaults", func(p *PKI) { p.SetSkipDefaults(true) }, []ReconfigureOption{WithAddress(":8443")},
+			":8443", []string{"127.0.0.1"}, "", false, false},
+		{"fail primary dns name", func(p *PKI) {
+			p.SetDNSNames([]string{"127.0.0.1", "ca.local"})
+			if err := p.SetPrimaryDNSName("ca.local"); err != nil {
+				t.Fatal(err)
+			}
+		}, []ReconfigureOption{WithDNSNames([]string{"ca.internal"})}, "", nil, "", true, true},
+		{"fail address", nil, []ReconfigureOption{WithAddress("127.0.0.1")}, "", nil, "", true, true},
+		{"fail no dns names", nil, []ReconfigureOption{WithDNSNames(nil)}, "", nil, "", true, true},
+		{"fail empty dns name", nil, []ReconfigureOption{WithDNSNames([]string{"ca.local", " "})}, "", nil, "", true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestPKI(t)
+			if tt.setup != nil {
+				tt.setup(p)
+			}
+			if err := p.Save(); err != nil {
+				t.Fatal(err)
+			}
+			addUnknownConfigFields(t, p.config)
+			if tt.wantDefaults {
+				defaults, err := readRawJSON(p.defaults)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defaults["futureField"] = json.RawMessage(`"value"`)
+				if err := updateJSONFile(p.defaults, defaults); err != nil {
+					t.Fatal(err)
+				}
+			}
+			before, err := ioutil.ReadFile(p.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			beforeDefaults, _ := ioutil.ReadFile(p.defaults)
+
+			// Reconfigure never asks for confirmation, it fails if it does
+			// because stdin is not a terminal.
+			if err := p.Reconfigure(tt.opts...); (err != nil) != tt.wantErr {
+				t.Fatalf("PKI.Reconfigure() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				after, err := ioutil.ReadFile(p.config)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(before, after) {
+					t.Error("PKI.Reconfigure() modified ca.json on error")
+				}
+				if after, _ := ioutil.ReadFile(p.defaults); !reflect.DeepEqual(beforeDefaults, after) {
+					t.Error("PKI.Reconfigure() modified defaults.json on error")
+				}
+				return
+			}
+
+			config := checkUnknownConfigFields(t, p.config)
+			if config.Address != tt.wantAddress {
+				t.Errorf("ca.json address = %s, want %s", config.Address, tt.wantAddress)
+			}
+			if !reflect.DeepEqual(config.DNSNames, tt.wantDNS) {
+				t.Errorf("ca.json dnsNames = %v, want %v", config.DNSNames, tt.wantDNS)
+			}
+			if config.IntermediateKey != p.intermediateKey {
+				t.Errorf("ca.json key = %s, want %s", config.IntermediateKey, p.intermediateKey)
+			}
+			if got, err := p.CAURL(); tt.wantURL != "" && (err != nil || got != tt.wantURL) {
+				t.Errorf("PKI.CAURL() = %s, %v, want %s", got, err, tt.wantURL)
+			}
+
+			b, err := ioutil.ReadFile(p.defaults)
+			if !tt.wantDefaults {
+				if !os.IsNotExist(err) {
+					t.Errorf("ioutil.ReadFile(%s) error = %v, want not exist", p.defaults, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var defaults struct {
+				caDefaults
+				FutureField string `json:"futureField"`
+			}
+			if err := json.Unmarshal(b, &defaults); err != nil {
+				t.Fatal(err)
+			}
+			if defaults.FutureField != "value" {
+				t.Errorf("defaults.json futureField = %q, want \"value\"", defaults.FutureField)
+			}
+			if defaults.CAUrl != tt.wantURL {
+				t.Errorf("defaults.json ca-url = %s, want %s", defaults.CAUrl, tt.wantURL)
+			}
+			if defaults.Root != p.root {
+				t.Errorf("defaults.json root = %s, want %s", defaults.Root, p.root)
+			}
+		})
+	}
+}
+
+func TestGetProvisioners(t *testing.T) {
+	all := []string{
+		`{"type":"ACME","name":"acme-1"}`,
+		`{"type":"X5C","name":"x5c-1"}`,
+		`{"type":"ACME","name":"acme-2"}`,
+		`{"type":"ACME","name":"acme-3"}`,
+		`{"type":"X5C","name":"x5c-2"}`,
+	}
+	var requests []string
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.RawQuery)
+		start, _ := strconv.Atoi(r.URL.Query().Get("cursor"))
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+		end, next := start+limit, ""
+		if end < len(all) {
+			next = strconv.Itoa(end)
+		} else {
+			end = len(all)
+		}
+		fmt.Fprintf(w, `{"provisioners":[%s],"nextCursor":"%s"}`, strings.Join(all[start:end], ","), next)
+	}))
+	defer srv.Close()
+
+	rootFile := filepath.Join(tempDir(t), "root_ca.crt")
+	if err := ioutil.WriteFile(rootFile, pem.EncodeToMemory(&pem.Block{
+		Type: "CERTIFICATE", Bytes: srv.Certificate().Raw,
+	}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		opts         []ListOption
+		want         []string
+		wantRequests int
+		wantErr      bool
+	}{
+		{"ok", nil, []string{"acme-1", "x5c-1", "acme-2", "acme-3", "x5c-2"}, 1, false},
+		{"ok limit", []ListOption{WithListLimit(2)}, []string{"acme-1", "x5c-1", "acme-2", "acme-3", "x5c-2"}, 3, false},
+		{"ok max results", []ListOption{WithListLimit(2), WithMaxResults(3)}, []string{"acme-1", "x5c-1", "acme-2"}, 2, false},
+		{"ok type filter", []ListOption{WithListLimit(2), WithTypeFilter(provisioner.TypeX5C)}, []string{"x5c-1", "x5c-2"}, 3, false},
+		{"ok type filter max results", []ListOption{WithListLimit(2), WithTypeFilter(provisioner.TypeACME), WithMaxResults(2)}, []string{"acme-1", "acme-2"}, 2, false},
+		{"ok name filter", []ListOption{WithNameFilter("acme-3", "x5c-1")}, []string{"x5c-1", "acme-3"}, 1, false},
+		{"ok no match", []ListOption{WithTypeFilter(provisioner.TypeJWK)}, []string{}, 1, false},
+		{"fail limit", []ListOption{WithListLimit(0)}, nil, 0, true},
+		{"fail max results", []ListOption{WithMaxResults(-1)}, nil, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests = nil
+			got, err := GetProvisioners(srv.URL, rootFile, tt.opts...)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("GetProvisioners() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(requests) != tt.wantRequests {
+				t.Errorf("GetProvisioners() requests = %v, want %d", requests, tt.wantRequests)
+			}
+			if tt.wantErr {
+				return
+			}
+			names := []string{}
+			for _, p := range got {
+				names = append(names, p.GetName())
+			}
+			if !reflect.DeepEqual(names, tt.want) {
+				t.Errorf("GetProvisioners() = %v, want %v", names, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetProvisioners_retry(t *testing.T) {
+	tmp := listBackoff
+	listBackoff = time.Millisecond
+	t.Cleanup(func() {
+		listBackoff = tmp
+	})
+
+	all := []string{
+		`{"type":"ACME","name":"acme-1"}`,
+		`{"type":"X5C","name":"x5c-1"}`,
+		`{"type":"ACME","name":"acme-2"}`,
+	}
+	// failures is the number of times the page with cursor 1 fails with the
+	// given status.
+	var failures, status int
+	var requests []string
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cursor := r.URL.Query().Get("cursor")
+		requests = append(requests, cursor)
+		start, _ := strconv.Atoi(cursor)
+		if start == 1 && failures > 0 {
+			failures--
+			w.WriteHeader(status)
+			fmt.Fprintf(w, `{"status":%d,"message":"%s"}`, status, http.StatusText(status))
+			return
+		}
+		next := ""
+		if start+1 < len(all) {
+			next = strconv.Itoa(start + 1)
+		}
+		fmt.Fprintf(w, `{"provisioners":[%s],"nextCursor":"%s"}`, all[start], next)
+	}))
+	defer srv.Close()
+
+	rootFile := filepath.Join(tempDir(t), "root_ca.crt")
+	if err := ioutil.WriteFile(rootFile, pem.EncodeToMemory(&pem.Block{
+		Type: "CERTIFICATE", Bytes: srv.Certificate().Raw,
+	}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		failures     int
+		status       int
+		opts         []ListOption
+		wantRequests []string
+		wantErr      bool
+	}{
+		{"ok", 0, 0, nil, []string{"", "1", "2"}, false},
+		{"ok retry 503", 1, http.StatusServiceUnavailable, nil, []string{"", "1", "1", "2"}, false},
+		{"ok retry 429", 2, http.StatusTooManyRequests, nil, []string{"", "1", "1", "1", "2"}, false},
+		{"ok attempts", 3, http.StatusBadGateway, []ListOption{WithListAttempts(4)}, []string{"", "1", "1", "1", "1", "2"}, false},
+		{"fail attempts", 3, http.StatusInternalServerError, nil, []string{"", "1", "1", "1"}, true},
+		{"fail no retries", 1, http.StatusInternalServerError, []ListOption{WithListAttempts(1)}, []string{"", "1"}, true},
+		{"fail not transient", 1, http.StatusNotFound, nil, []string{"", "1"}, true},
+		{"fail invalid attempts", 0, 0, []ListOption{WithListAttempts(0)}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			failures, status, requests = tt.failures, tt.status, nil
+			got, err := GetProvisioners(srv.URL, rootFile, append([]ListOption{WithListLimit(1)}, tt.opts...)...)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("GetProvisioners() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(requests, tt.wantRequests) {
+				t.Errorf("GetProvisioners() cursors = %q, want %q", requests, tt.wantRequests)
+			}
+			if tt.wantErr {
+				return
+			}
+			if len(got) != len(all) {
+				t.Errorf("GetProvisioners() = %d provisioners, want %d", len(got), len(all))
+			}
+		})
+	}
+}
+
+func Test_isTransientError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"network", fmt.Errorf("client GET failed: %w", &url.Error{Op: "Get", URL: "https://ca.example.com", Err: syscall.ECONNREFUSED}), true},
+		{"500", &apierrs.Error{Status: 500, Err: errors.New("internal")}, true},
+		{"503", &apierrs.Error{Status: 503, Err: errors.New("unavailable")}, true},
+		{"429", &apierrs.Error{Status: 429, Err: errors.New("too many requests")}, true},
+		{"400", &apierrs.Error{Status: 400, Err: errors.New("bad request")}, false},
+		{"404", &apierrs.Error{Status: 404, Err: errors.New("not found")}, false},
+		{"other", errors.New("error reading response"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isTransientError(tt.err); got != tt.want {
+				t.Errorf("isTransientError() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPKI_WriteRootCertificateTo(t *testing.T) {
+	p := newTestPKI(t)
+	pass := []byte("password")
+	root, rootKey, err := p.GenerateRootCertificate("Test Root", pass)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := p.WriteRootCertificateTo(&buf, root); err != nil {
+		t.Fatalf("PKI.WriteRootCertificateTo() error = %v", err)
+	}
+	certs, keys := decodePEM(t, buf.Bytes(), pass)
+	if len(certs) != 1 || !certs[0].Equal(root) {
+		t.Errorf("PKI.WriteRootCertificateTo() certificates = %v, want %v", certs, root)
+	}
+	if len(keys) != 0 {
+		t.Errorf("PKI.WriteRootCertificateTo() keys = %d, want 0", len(keys))
+	}
+	if p.rootFingerprint != Fingerprint(root) {
+		t.Errorf("PKI.rootFingerprint = %s, want %s", p.rootFingerprint, Fingerprint(root))
+	}
+
+	buf.Reset()
+	if err := p.WriteRootKeyTo(&buf, rootKey, pass); err != nil {
+		t.Fatalf("PKI.WriteRootKeyTo() error = %v", err)
+	}
+	certs, keys = decodePEM(t, buf.Bytes(), pass)
+	if len(certs) != 0 {
+		t.Errorf("PKI.WriteRootKeyTo() certificates = %d, want 0", len(certs))
+	}
+	if len(keys) != 1 || !reflect.DeepEqual(keys[0].(crypto.Signer).Public(), root.PublicKey) {
+		t.Error("PKI.WriteRootKeyTo() key does not match the certificate")
+	}
+
+	if err := p.WriteRootCertificateTo(errWriter{}, root); err == nil {
+		t.Error("PKI.WriteRootCertificateTo() error = nil, wantErr true")
+	}
+	if err := p.WriteRootKeyTo(errWriter{}, rootKey, pass); err == nil {
+		t.Error("PKI.WriteRootKeyTo() error = nil, wantErr true")
+	}
+}
+
+func TestPKI_WriteIntermediateCertificateTo(t *testing.T) {
+	p := newTestPKI(t)
+	pass := []byte("password")
+	root, rootKey, err := p.GenerateRootCertificate("Test Root", pass)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.GenerateIntermediateCertificate("Test Intermediate", root, rootKey, pass); err != nil {
+		t.Fatal(err)
+	}
+	crt, err := pemutil.ReadCertificate(p.intermediate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := pemutil.Read(p.intermediateKey, pemutil.WithPassword(pass))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := p.WriteIntermediateCertificateTo(&buf, crt); err != nil {
+		t.Fatalf("PKI.WriteIntermediateCertificateTo() error = %v", err)
+	}
+	certs, keys := decodePEM(t, buf.Bytes(), pass)
+	if len(certs) != 1 || !certs[0].Equal(crt) {
+		t.Errorf("PKI.WriteIntermediateCertificateTo() certificates = %v, want %v", certs, crt)
+	}
+	if len(keys) != 0 {
+		t.Errorf("PKI.WriteIntermediateCertificateTo() keys = %d, want 0", len(keys))
+	}
+	if err := certs[0].CheckSignatureFrom(root); err != nil {
+		t.Errorf("intermediate not signed by root: %v", err)
+	}
+
+	buf.Reset()
+	if err := p.WriteIntermediateKeyTo(&buf, key, pass); err != nil {
+		t.Fatalf("PKI.WriteIntermediateKeyTo() error = %v", err)
+	}
+	certs, keys = decodePEM(t, buf.Bytes(), pass)
+	if len(certs) != 0 {
+		t.Errorf("PKI.WriteIntermediateKeyTo() certificates = %d, want 0", len(certs))
+	}
+	if len(keys) != 1 || !reflect.DeepEqual(keys[0], key) {
+		t.Errorf("PKI.WriteIntermediateKeyTo() keys = %v, want %v", keys, key)
+	}
+
+	// The files written by WriteIntermediateCertificate match the writers.
+	setForce(t)
+	if err := p.WriteIntermediateCertificate(crt, key, pass); err != nil {
+		t.Fatalf("PKI.WriteIntermediateCertificate() error = %v", err)
+	}
+	if b, err := ioutil.ReadFile(p.intermediateKey); err != nil {
+		t.Fatal(err)
+	} else if _, keys := decodePEM(t, b, pass); len(keys) != 1 || !reflect.DeepEqual(keys[0], key) {
+		t.Errorf("%s keys = %v, want %v", p.intermediateKey, keys, key)
+	}
+
+	if err := p.WriteIntermediateCertificateTo(errWriter{}, crt); err == nil {
+		t.Error("PKI.WriteIntermediateCertificateTo() error = nil, wantErr true")
+	}
+	if err := p.WriteIntermediateKeyTo(errWriter{}, key, pass); err == nil {
+		t.Error("PKI.WriteIntermediateKeyTo() error = nil, wantErr true")
+	}
+}
+
+func TestPKI_WriteIntermediatePKCS12(t *testing.T) {
+	p := newTestPKI(t)
+	pass := []byte("password")
+	root, rootKey, err := p.GenerateRootCertificate("Test Root", pass)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.GenerateIntermediateCertificate("Test Intermediate", root, rootKey, pass); err != nil {
+		t.Fatal(err)
+	}
+	crt, err := pemutil.ReadCertificate(p.intermediate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := pemutil.Read(p.intermediateKey, pemutil.WithPassword(pass))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(tempDir(t), "intermediate_ca.p12")
+	if err := p.WriteIntermediatePKCS12(path, pass); err != nil {
+		t.Fatalf("PKI.WriteIntermediatePKCS12() error = %v", err)
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := pkcs12.DecodeChain(b, "wrong"); err == nil {
+		t.Error("pkcs12.DecodeChain() with wrong password error = nil, wantErr true")
+	}
+	gotKey, gotCrt, gotCAs, err := pkcs12.DecodeChain(b, string(pass))
+	if err != nil {
+		t.Fatalf("pkcs12.DecodeChain() error = %v", err)
+	}
+	if !reflect.DeepEqual(gotKey, key) {
+		t.Errorf("pkcs12.DecodeChain() key = %v, want %v", gotKey, key)
+	}
+	if !gotCrt.Equal(crt) {
+		t.Errorf("pkcs12.DecodeChain() certificate = %v, want %v", gotCrt.Subject, crt.Subject)
+	}
+	if len(gotCAs) != 1 || !gotCAs[0].Equal(root) {
+		t.Errorf("pkcs12.DecodeChain() caCerts = %v, want [%v]", gotCAs, root.Subject)
+	}
+
+	t.Run("fail wrong password", func(t *testing.T) {
+		path := filepath.Join(tempDir(t), "intermediate_ca.p12")
+		if err := p.WriteIntermediatePKCS12(path, []byte("wrong")); err == nil {
+			t.Error("PKI.WriteIntermediatePKCS12() error = nil, wantErr true")
+		}
+	})
+}
+
+func TestPKI_WriteCertificateDER(t *testing.T) {
+	p := newTestPKI(t)
+	pass := []byte("password")
+	root, rootKey, err := p.GenerateRootCertificate("Test Root", pass)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.GenerateIntermediateCertificate("Test Intermediate", root, rootKey, pass); err != nil {
+		t.Fatal(err)
+	}
+	intermediate, err := pemutil.ReadCertificate(p.intermediate)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := tempDir(t)
+	tests := []struct {
+		name  string
+		write func(path string) error
+		want  *x509.Certificate
+	}{
+		{"root", p.WriteRootCertificateDER, root},
+		{"intermediate", p.WriteIntermediateCertificateDER, intermediate},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, tt.name+".der")
+			if err := tt.write(path); err != nil {
+				t.Fatalf("write error = %v", err)
+			}
+			b, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			crt, err := x509.ParseCertificate(b)
+			if err != nil {
+				t.Fatalf("x509.ParseCertificate() error = %v", err)
+			}
+			if !crt.Equal(tt.want) {
+				t.Errorf("certificate = %v, want %v", crt.Subject, tt.want.Subject)
+			}
+		})
+	}
+
+	t.Run("fail missing", func(t *testing.T) {
+		p := newTestPKI(t)
+		if err := p.WriteRootCertificateDER(filepath.Join(dir, "missing.der")); err == nil {
+			t.Error("PKI.WriteRootCertificateDER() error = nil, wantErr true")
+		}
+	})
+}
+
+type errWriter struct{}
+
+func (errWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("write error")
+}
+
+// decodePEM returns the certificates and the decrypted keys in the given PEM
+// data.
+func decodePEM(t *testing.T, data, pass []byte) ([]*x509.Certificate, []interface{}) {
+	t.Helper()
+	var certs []*x509.Certificate
+	var keys []interface{}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type == "CERTIFICATE" {
+			crt, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			certs = append(certs, crt)
+			continue
+		}
+		key, err := pemutil.ParseKey(pem.EncodeToMemory(block), pemutil.WithPassword(pass))
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	return certs, keys
+}
+
+func TestWithDisableRenewal(t *testing.T) {
+	withoutProvisioners := func(c *authority.Config) error {
+		c.AuthorityConfig.Provisioners = nil
+		return nil
+	}
+	tests := []struct {
+		name      string
+		enableSSH bool
+		opts      []Option
+		wantErr   bool
+	}{
+		{"ok", false, nil, false},
+		{"ok with ssh", true, nil, false},
+		{"fail no provisioners", false, []Option{withoutProvisioners}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestPKI(t)
+			p.enableSSH = tt.enableSSH
+			config, err := p.GenerateConfig(append(tt.opts, WithDisableRenewal())...)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("PKI.GenerateConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			b, err := json.Marshal(config.AuthorityConfig.Provisioners[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			var prov provisioner.JWK
+			if err := json.Unmarshal(b, &prov); err != nil {
+				t.Fatal(err)
+			}
+			if prov.Claims == nil || prov.Claims.DisableRenewal == nil || !*prov.Claims.DisableRenewal {
+				t.Errorf("provisioner %s does not have disableRenewal set: %s", prov.Name, b)
+			}
+			if got := prov.Claims.EnableSSHCA != nil && *prov.Claims.EnableSSHCA; got != tt.enableSSH {
+				t.Errorf("provisioner %s enableSSHCA = %v, want %v", prov.Name, got, tt.enableSSH)
+			}
+		})
+	}
+}
+
+func TestWithProvisionerSSH(t *testing.T) {
+	enableSSHCA := func(t *testing.T, prov provisioner.Interface) *bool {
+		t.Helper()
+		claims, ok := provisionerClaims(prov)
+		if !ok {
+			t.Fatalf("provisionerClaims() ok = false for %T", prov)
+		}
+		if *claims == nil {
+			return nil
+		}
+		return (*claims).EnableSSHCA
+	}
+	isTrue := func(b *bool) bool {
+		return b != nil && *b
+	}
+
+	t.Run("ok", func(t *testing.T) {
+		p := newTestPKI(t)
+		p.enableSSH = true
+		config, err := p.GenerateConfig(
+			WithX5CProvisioner("x5c", mustCertificatePEM(t, "X5C Root", true)),
+			WithDisableRenewal(),
+			WithProvisionerSSH("step-cli", false),
+			WithProvisionerSSH("x5c", true),
+		)
+		if err != nil {
+			t.Fatalf("PKI.GenerateConfig() error = %v", err)
+		}
+
+		got := map[string]*bool{}
+		for _, prov := range config.AuthorityConfig.Provisioners {
+			got[prov.GetName()] = enableSSHCA(t, prov)
+		}
+		if b := got["step-cli"]; b == nil || *b {
+			t.Errorf("step-cli enableSSHCA = %v, want false", b)
+		}
+		if !isTrue(got["x5c"]) {
+			t.Errorf("x5c enableSSHCA = %v, want true", got["x5c"])
+		}
+		// Other provisioners are not modified.
+		if !isTrue(got["sshpop"]) {
+			t.Errorf("sshpop enableSSHCA = %v, want true", got["sshpop"])
+		}
+
+		// Other claims are kept.
+		claims := config.AuthorityConfig.Provisioners[0].(*provisioner.JWK).Claims
+		if !isTrue(claims.DisableRenewal) {
+			t.Errorf("step-cli disableRenewal = %v, want true", claims.DisableRenewal)
+		}
+	})
+
+	t.Run("fail not found", func(t *testing.T) {
+		p := newTestPKI(t)
+		if _, err := p.GenerateConfig(WithProvisionerSSH("foo", true)); err == nil {
+			t.Error("PKI.GenerateConfig() error = nil, wantErr true")
+		}
+	})
+}
+
+func TestWithTLSCertDurations(t *testing.T) {
+	type durations struct {
+		min, max, def time.Duration
+	}
+	tests := []struct {
+		name      string
+		enableSSH bool
+		durations durations
+		backdate  time.Duration
+		wantErr   bool
+	}{
+		{"ok", false, durations{time.Minute, 48 * time.Hour, 12 * time.Hour}, 30 * time.Second, false},
+		{"ok with ssh", true, durations{time.Minute, 48 * time.Hour, 12 * time.Hour}, 30 * time.Second, false},
+		{"ok equal", false, durations{time.Hour, time.Hour, time.Hour}, 0, false},
+		{"fail min", false, durations{0, time.Hour, time.Hour}, time.Minute, true},
+		{"fail max", false, durations{time.Minute, -time.Hour, time.Hour}, time.Minute, true},
+		{"fail default", false, durations{time.Minute, time.Hour, 0}, time.Minute, true},
+		{"fail max less than min", false, durations{time.Hour, time.Minute, time.Hour}, time.Minute, true},
+		{"fail default less than min", false, durations{time.Hour, 2 * time.Hour, time.Minute}, time.Minute, true},
+		{"fail default greater than max", false, durations{time.Minute, time.Hour, 2 * time.Hour}, time.Minute, true},
+		{"fail backdate", false, durations{time.Minute, time.Hour, time.Hour}, -time.Minute, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestPKI(t)
+			p.enableSSH = tt.enableSSH
+			config, err := p.GenerateConfig(
+				WithTLSCertDurations(tt.durations.min, tt.durations.max, tt.durations.def),
+				WithBackdate(tt.backdate),
+			)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("PKI.GenerateConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			b, err := json.Marshal(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got authority.Config
+			if err := json.Unmarshal(b, &got); err != nil {
+				t.Fatal(err)
+			}
+			if d := got.AuthorityConfig.Backdate; d == nil || d.Duration != tt.backdate {
+				t.Errorf("backdate = %v, want %v", d, tt.backdate)
+			}
+			claims := got.AuthorityConfig.Provisioners[0].(*provisioner.JWK).Claims
+			if claims == nil || claims.MinTLSDur == nil || claims.MaxTLSDur == nil || claims.DefaultTLSDur == nil {
+				t.Fatalf("claims = %+v, want TLS durations", claims)
+			}
+			if g := (durations{claims.MinTLSDur.Duration, claims.MaxTLSDur.Duration, claims.DefaultTLSDur.Duration}); g != tt.durations {
+				t.Errorf("TLS durations = %+v, want %+v", g, tt.durations)
+			}
+			if enabled := claims.EnableSSHCA != nil && *claims.EnableSSHCA; enabled != tt.enableSSH {
+				t.Errorf("enableSSHCA = %v, want %v", enabled, tt.enableSSH)
+			}
+		})
+	}
+}
+
+func TestWithBackdate(t *testing.T) {
+	tests := []struct {
+		name     string
+		backdate time.Duration
+		want     string
+		wantErr  bool
+	}{
+		{"ok", 90 * time.Second, `"backdate":"1m30s"`, false},
+		{"ok zero", 0, `"backdate":"0s"`, false},
+		{"ok max", time.Hour, `"backdate":"1h0m0s"`, false},
+		{"fail negative", -time.Second, "", true},
+		{"fail too large", time.Hour + time.Second, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestPKI(t)
+			config, err := p.GenerateConfig(WithBackdate(tt.backdate))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("PKI.GenerateConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			b, err := json.Marshal(config.AuthorityConfig)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Contains(b, []byte(tt.want)) {
+				t.Errorf("authority = %s, want %s", b, tt.want)
+			}
+		})
+	}
+}
+
+func TestWithDefaultKeyUsages(t *testing.T) {
+	signer, err := generateDefaultKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509util.CreateCertificateRequest("test.smallstep.com", []string{"test.smallstep.com"}, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		ekus    []x509.ExtKeyUsage
+		wantErr bool
+	}{
+		{"ok server", []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}, false},
+		{"ok client", []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}, false},
+		{"ok multiple", []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageCodeSigning}, false},
+		{"fail empty", nil, true},
+		{"fail unknown", []x509.ExtKeyUsage{x509.ExtKeyUsage(1000)}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestPKI(t)
+			config, err := p.GenerateConfig(WithDefaultKeyUsages(tt.ekus))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("PKI.GenerateConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			prov := config.AuthorityConfig.Provisioners[0].(*provisioner.JWK)
+			if !prov.Options.GetX509Options().HasTemplate() {
+				t.Fatal("default provisioner does not have a template")
+			}
+			data := x509util.NewTemplateData()
+			data.SetSubject(x509util.Subject{CommonName: "test.smallstep.com"})
+			data.SetSANs([]string{"test.smallstep.com"})
+			opts, err := provisioner.TemplateOptions(prov.Options, data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cert, err := x509util.NewCertificate(csr, opts.Options(provisioner.SignOptions{})...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := cert.GetCertificate().ExtKeyUsage; !reflect.DeepEqual(got, tt.ekus) {
+				t.Errorf("ExtKeyUsage = %v, want %v", got, tt.ekus)
+			}
+		})
+	}
+}
+
+// mustCA creates a CA certificate signed by parent, or a self-signed one if
+// parent is nil.
+func mustCA(t *testing.T, name string, parent *x509.Certificate, parentKey crypto.Signer, maxPathLen int) (*x509.Certificate, crypto.Signer) {
+	t.Helper()
+	signer, err := generateDefaultKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLen:            maxPathLen,
+	}
+	if parent == nil {
+		parent, parentKey = template, signer
+	}
+	crt, err := x509util.CreateCertificate(template, parent, signer.Public(), parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return crt, signer
+}
+
+func TestPKI_VerifyChain(t *testing.T) {
+	setForce(t)
+	pass := []byte("password")
+	writeRoot := func(t *testing.T, p *PKI, crt *x509.Certificate) {
+		t.Helper()
+		if err := p.WriteRootCertificate(crt, nil, pass); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		setup   func(t *testing.T, p *PKI)
+		wantErr bool
+	}{
+		{"ok", func(t *testing.T, p *PKI) {
+			root, rootKey, err := p.GenerateRootCertificate("Test Root", pass)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := p.GenerateIntermediateCertificate("Test Intermediate", root, rootKey, pass); err != nil {
+				t.Fatal(err)
+			}
+		}, false},
+		{"ok with intermediates", func(t *testing.T, p *PKI) {
+			root, rootKey := mustCA(t, "Test Root", nil, nil, 2)
+			mid, midKey := mustCA(t, "Test Intermediate", root, rootKey, 1)
+			writeRoot(t, p, root)
+			if err := p.AddIntermediate(mid); err != nil {
+				t.Fatal(err)
+			}
+			if err := p.GenerateIntermediateCertificate("Test Issuer", mid, midKey, pass); err != nil {
+				t.Fatal(err)
+			}
+		}, false},
+		{"fail mismatched root", func(t *testing.T, p *PKI) {
+			root, rootKey, err := p.GenerateRootCertificate("Test Root", pass)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := p.GenerateIntermediateCertificate("Test Intermediate", root, rootKey, pass); err != nil {
+				t.Fatal(err)
+			}
+			other, _ := mustCA(t, "Test Root", nil, nil, 1)
+			writeRoot(t, p, other)
+		}, true},
+		{"fail root not self-signed", func(t *testing.T, p *PKI) {
+			root, rootKey := mustCA(t, "Test Root", nil, nil, 2)
+			mid, midKey := mustCA(t, "Test Intermediate", root, rootKey, 1)
+			writeRoot(t, p, mid)
+			if err := p.GenerateIntermediateCertificate("Test Issuer", mid, midKey, pass); err != nil {
+				t.Fatal(err)
+			}
+		}, true},
+		{"fail path length", func(t *testing.T, p *PKI) {
+			root, rootKey := mustCA(t, "Test Root", nil, nil, 1)
+			mid1, mid1Key := mustCA(t, "Test Intermediate 1", root, rootKey, 0)
+			mid2, mid2Key := mustCA(t, "Test Intermediate 2", mid1, mid1Key, 0)
+			writeRoot(t, p, root)
+			if err := p.AddIntermediate(mid1); err != nil {
+				t.Fatal(err)
+			}
+			if err := p.AddIntermediate(mid2); err != nil {
+				t.Fatal(err)
+			}
+			if err := p.GenerateIntermediateCertificate("Test Issuer", mid2, mid2Key, pass); err != nil {
+				t.Fatal(err)
+			}
+		}, true},
+		{"fail not a ca", func(t *testing.T, p *PKI) {
+			root, rootKey := mustCA(t, "Test Root", nil, nil, 1)
+			signer, err := generateDefaultKey()
+			if err != nil {
+				t.Fatal(err)
+			}
+			leaf, err := x509util.CreateCertificate(&x509.Certificate{
+				Subject:   pkix.Name{CommonName: "leaf"},
+				NotBefore: time.Now(),
+				NotAfter:  time.Now().Add(time.Hour),
+			}, root, signer.Public(), rootKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			writeRoot(t, p, root)
+			if err := p.WriteIntermediateCertificate(leaf, signer, pass); err != nil {
+				t.Fatal(err)
+			}
+		}, true},
+		{"fail missing files", func(t *testing.T, p *PKI) {}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestPKI(t)
+			tt.setup(t, p)
+			if err := p.VerifyChain(); (err != nil) != tt.wantErr {
+				t.Errorf("PKI.VerifyChain() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPKI_AddIntermediate(t *testing.T) {
+	p := newTestPKI(t)
+	pass := []byte("password")
+	root, rootKey := mustCA(t, "Test Root", nil, nil, 3)
+	mid1, mid1Key := mustCA(t, "Test Intermediate 1", root, rootKey, 2)
+	mid2, mid2Key := mustCA(t, "Test Intermediate 2", mid1, mid1Key, 1)
+	leaf := mustParsePEM(t, mustCertificatePEM(t, "leaf", false))
+
+	t.Run("ok", func(t *testing.T) {
+		if err := p.AddIntermediate(mid1); err != nil {
+			t.Fatal(err)
+		}
+		if err := p.AddIntermediate(mid2); err != nil {
+			t.Fatal(err)
+		}
+		if err := p.GenerateIntermediateCertificate("Test Issuer", mid2, mid2Key, pass); err != nil {
+			t.Fatal(err)
+		}
+
+		bundle, err := pemutil.ReadCertificateBundle(p.intermediate)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(bundle) != 3 {
+			t.Fatalf("bundle has %d certificates, want 3", len(bundle))
+		}
+		if bundle[0].Subject.CommonName != "Test Issuer" || !bundle[1].Equal(mid2) || !bundle[2].Equal(mid1) {
+			t.Errorf("bundle order = [%s %s %s], want [Test Issuer %s %s]",
+				bundle[0].Subject, bundle[1].Subject, bundle[2].Subject, mid2.Subject, mid1.Subject)
+		}
+
+		roots, intermediates := x509.NewCertPool(), x509.NewCertPool()
+		roots.AddCert(root)
+		for _, crt := range bundle[1:] {
+			intermediates.AddCert(crt)
+		}
+		if _, err := bundle[0].Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates}); err != nil {
+			t.Errorf("bundle does not verify: %v", err)
+		}
+
+		config, err := p.GenerateConfig()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if config.IntermediateCert != p.intermediate {
+			t.Errorf("Config.IntermediateCert = %s, want %s", config.IntermediateCert, p.intermediate)
+		}
+	})
+
+	t.Run("fail not a ca", func(t *testing.T) {
+		if err := newTestPKI(t).AddIntermediate(leaf); err == nil {
+			t.Error("PKI.AddIntermediate() error = nil, wantErr true")
+		}
+	})
+
+	t.Run("fail wrong order", func(t *testing.T) {
+		p := newTestPKI(t)
+		if err := p.AddIntermediate(mid2); err != nil {
+			t.Fatal(err)
+		}
+		if err := p.AddIntermediate(mid1); err == nil {
+			t.Error("PKI.AddIntermediate() error = nil, wantErr true")
+		}
+	})
+
+	t.Run("fail wrong issuer", func(t *testing.T) {
+		p := newTestPKI(t)
+		if err := p.AddIntermediate(mid1); err != nil {
+			t.Fatal(err)
+		}
+		if err := p.GenerateIntermediateCertificate("Test Issuer", root, rootKey, pass); err == nil {
+			t.Error("PKI.GenerateIntermediateCertificate() error = nil, wantErr true")
+		}
+	})
+}
+
+func TestPKI_AddFederatedRootFromFile(t *testing.T) {
+	dir := tempDir(t)
+	writePEM := func(t *testing.T, name string, data []byte) string {
+		t.Helper()
+		filename := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(filename, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		return filename
+	}
+	rootPEM := mustCertificatePEM(t, "Federated Root", true)
+	otherPEM := mustCertificatePEM(t, "Other Root", true)
+	root := writePEM(t, "root.crt", rootPEM)
+	rootCopy := writePEM(t, "root_copy.crt", rootPEM)
+	other := writePEM(t, "other.crt", otherPEM)
+	bundle := writePEM(t, "bundle.crt", append(append([]byte{}, rootPEM...), otherPEM...))
+	leaf := writePEM(t, "leaf.crt", mustCertificatePEM(t, "leaf", false))
+	mixed := writePEM(t, "mixed.crt", append(append([]byte{}, rootPEM...), mustCertificatePEM(t, "leaf", false)...))
+	notPEM := writePEM(t, "not_pem.crt", []byte("not a pem"))
+
+	tests := []struct {
+		name    string
+		paths   []string
+		want    []string
+		wantErr bool
+	}{
+		{"ok", []string{root}, []string{root}, false},
+		{"ok multiple", []string{root, other}, []string{root, other}, false},
+		{"ok bundle", []string{bundle}, []string{bundle}, false},
+		{"ok duplicated", []string{root, root}, []string{root}, false},
+		{"ok duplicated content", []string{root, rootCopy}, []string{root}, false},
+		{"ok duplicated bundle", []string{root, other, bundle}, []string{root, other}, false},
+		{"fail not a ca", []string{leaf}, []string{}, true},
+		{"fail bundle not a ca", []string{mixed}, []string{}, true},
+		{"fail not pem", []string{notPEM}, []string{}, true},
+		{"fail missing", []string{filepath.Join(dir, "missing.crt")}, []string{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestPKI(t)
+			var err error
+			for _, path := range tt.paths {
+				if err = p.AddFederatedRootFromFile(path); err != nil {
+					break
+				}
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("PKI.AddFederatedRootFromFile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			config, err := p.GenerateConfig()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(config.FederatedRoots, tt.want) {
+				t.Errorf("Config.FederatedRoots = %v, want %v", config.FederatedRoots, tt.want)
+			}
+		})
+	}
+}
+
+func mustParsePEM(t *testing.T, b []byte) *x509.Certificate {
+	t.Helper()
+	block, _ := pem.Decode(b)
+	if block == nil {
+		t.Fatal("error decoding PEM")
+	}
+	crt, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return crt
+}
+
+func TestPKI_RotateProvisionerKey(t *testing.T) {
+	withJWK := func(name string) Option {
+		return func(c *authority.Config) error {
+			pub, _, err := jose.GenerateDefaultKeyPair([]byte("password"))
+			if err != nil {
+				return err
+			}
+			c.AuthorityConfig.Provisioners = append(c.AuthorityConfig.Provisioners, &provisioner.JWK{
+				Type: "JWK",
+				Name: name,
+				Key:  pub,
+			})
+			return nil
+		}
+	}
+	loadProvisioners := func(t *testing.T, p *PKI) provisioner.List {
+		t.Helper()
+		config, err := authority.LoadConfiguration(p.config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return config.AuthorityConfig.Provisioners
+	}
+
+	tests := []struct {
+		name    string
+		opts    []Option
+		rotate  string
+		rotated int
+		wantErr bool
+	}{
+		{"ok default", []Option{withJWK("other")}, "step-cli", 0, false},
+		{"ok other", []Option{withJWK("other")}, "other", 1, false},
+		{"fail not found", []Option{withJWK("other")}, "missing", -1, true},
+		{"fail not jwk", []Option{WithX5CProvisioner("x5c", mustCertificatePEM(t, "root", true))}, "x5c", -1, true},
+		{"fail multiple", []Option{withJWK("other")}, "other", -1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestPKI(t)
+			if err := p.Save(tt.opts...); err != nil {
+				t.Fatal(err)
+			}
+			// GenerateConfig rejects duplicated names, but ca.json can be
+			// edited by hand.
+			if tt.name == "fail multiple" {
+				config, err := readRawJSON(p.config)
+				if err != nil {
+					t.Fatal(err)
+				}
+				auth, provs, err := p.rawProvisioners(config)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := p.setRawProvisioners(config, auth, append(provs, provs[len(provs)-1])); err != nil {
+					t.Fatal(err)
+				}
+				if err := updateJSONFile(p.config, config); err != nil {
+					t.Fatal(err)
+				}
+			}
+			addUnknownConfigFields(t, p.config)
+			before := loadProvisioners(t, p)
+
+			// The existing ca.json is replaced without asking for
+			// confirmation, and it's not removed by Cleanup.
+			pass := []byte("new-password")
+			if err := p.RotateProvisionerKey(tt.rotate, pass); (err != nil) != tt.wantErr {
+				t.Fatalf("PKI.RotateProvisionerKey() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err := p.Cleanup(); err != nil {
+				t.Fatal(err)
+			}
+
+			checkUnknownConfigFields(t, p.config)
+			after := loadProvisioners(t, p)
+			if len(after) != len(before) {
+				t.Fatalf("provisioners = %d, want %d", len(after), len(before))
+			}
+			for i := range after {
+				if i != tt.rotated {
+					if !reflect.DeepEqual(after[i], before[i]) {
+						t.Errorf("provisioner %s was modified", after[i].GetName())
+					}
+					continue
+				}
+				got, want := after[i].(*provisioner.JWK), before[i].(*provisioner.JWK)
+				if got.Key.KeyID == want.Key.KeyID {
+					t.Errorf("provisioner %s kid was not rotated", got.Name)
+				}
+				if got.Name != want.Name {
+					t.Errorf("provisioner name = %s, want %s", got.Name, want.Name)
+				}
+				b, err := jose.Decrypt([]byte(got.EncryptedKey), jose.WithPassword(pass))
+				if err != nil {
+					t.Fatalf("error decrypting new key: %v", err)
+				}
+				key, err := jose.ParseKey(b)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if key.KeyID != got.Key.KeyID {
+					t.Errorf("encrypted key kid = %s, want %s", key.KeyID, got.Key.KeyID)
+				}
+			}
+		})
+	}
+}
+
+func TestPKI_AddProvisioner(t *testing.T) {
+	pub, _, err := jose.GenerateDefaultKeyPair([]byte("password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwk := &provisioner.JWK{Type: "JWK", Name: "jwk", Key: pub}
+	acme := &provisioner.ACME{Type: "ACME", Name: "acme"}
+
+	p := newTestPKI(t)
+	if err := p.Save(); err != nil {
+		t.Fatal(err)
+	}
+	config, err := authority.LoadConfiguration(p.config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := config.AuthorityConfig.Provisioners
+
+	tests := []struct {
+		name    string
+		prov    provisioner.Interface
+		wantErr bool
+	}{
+		{"ok jwk", jwk, false},
+		{"ok acme", acme, false},
+		{"fail duplicate jwk", &provisioner.JWK{Type: "JWK", Name: "jwk", Key: pub}, true},
+		{"fail duplicate acme", &provisioner.ACME{Type: "ACME", Name: "acme"}, true},
+		{"fail duplicate default", &provisioner.ACME{Type: "ACME", Name: "step-cli"}, true},
+		{"fail no type", &provisioner.ACME{Name: "no-type"}, true},
+		{"fail no name", &provisioner.ACME{Type: "ACME"}, true},
+		{"fail nil", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := p.AddProvisioner(tt.prov); (err != nil) != tt.wantErr {
+				t.Errorf("PKI.AddProvisioner() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	config, err = authority.LoadConfiguration(p.config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := json.Marshal(config.AuthorityConfig.Provisioners)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := json.Marshal(append(before, jwk, acme))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("provisioners = %s, want %s", got, want)
+	}
+
+	t.Run("unknown fields", func(t *testing.T) {
+		p := newTestPKI(t)
+		if err := p.Save(); err != nil {
+			t.Fatal(err)
+		}
+		addUnknownConfigFields(t, p.config)
+		if err := p.AddProvisioner(jwk); err != nil {
+			t.Fatalf("PKI.AddProvisioner() error = %v", err)
+		}
+		if err := p.AddProvisioner(&provisioner.ACME{Type: "ACME", Name: "scep"}); err == nil {
+			t.Error("PKI.AddProvisioner() error = nil, wantErr true")
+		}
+		config := checkUnknownConfigFields(t, p.config)
+		if n := len(config.AuthorityConfig.Provisioners); n != 2 {
+			t.Errorf("provisioners = %d, want 2", n)
+		}
+	})
+}
+
+// addUnknownConfigFields adds to the ca.json in filename a field and a
+// provisioner unknown to this version.
+func addUnknownConfigFields(t *testing.T, filename string) {
+	t.Helper()
+	config, err := readRawJSON(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var auth map[string]interface{}
+	if err := json.Unmarshal(config["authority"], &auth); err != nil {
+		t.Fatal(err)
+	}
+	auth["provisioners"] = append(auth["provisioners"].([]interface{}), map[string]interface{}{
+		"type": "SCEP",
+		"name": "scep",
+	})
+	if err := config.set("authority", auth); err != nil {
+		t.Fatal(err)
+	}
+	config["futureField"] = json.RawMessage(`{"enabled":true}`)
+	if err := updateJSONFile(filename, config); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// checkUnknownConfigFields checks that the fields added by
+// addUnknownConfigFields are still in the ca.json in filename, and that the
+// typed configuration does not add new ones. It returns the configuration.
+func checkUnknownConfigFields(t *testing.T, filename string) *authority.Config {
+	t.Helper()
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var config struct {
+		FutureField *struct {
+			Enabled bool `json:"enabled"`
+		} `json:"futureField"`
+		Authority struct {
+			Provisioners []map[string]interface{} `json:"provisioners"`
+		} `json:"authority"`
+	}
+	if err := json.Unmarshal(b, &config); err != nil {
+		t.Fatal(err)
+	}
+	if config.FutureField == nil || !config.FutureField.Enabled {
+		t.Errorf("ca.json futureField = %v, want {\"enabled\": true}", config.FutureField)
+	}
+	var found bool
+	for _, prov := range config.Authority.Provisioners {
+		if prov["type"] == "SCEP" && prov["name"] == "scep" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("ca.json SCEP provisioner not found in %v", config.Authority.Provisioners)
+	}
+	for _, key := range []string{`"federatedRoots": null`, `"crt": ""`} {
+		if bytes.Contains(b, []byte(key)) {
+			t.Errorf("ca.json contains %s:\n%s", key, b)
+		}
+	}
+
+	c, err := authority.LoadConfiguration(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestPKI_SetIPAddresses(t *testing.T) {
+	setForce(t)
+	tests := []struct {
+		name    string
+		ips     []net.IP
+		want    []string
+		wantErr bool
+	}{
+		{"ok", []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("::1")}, []string{"127.0.0.1", "10.0.0.1", "::1"}, false},
+		{"ok ipv4", []net.IP{net.IPv4(192, 168, 0, 1).To4()}, []string{"127.0.0.1", "192.168.0.1"}, false},
+		{"ok duplicated", []net.IP{net.ParseIP("127.0.0.1")}, []string{"127.0.0.1"}, false},
+		{"ok empty", nil, []string{"127.0.0.1"}, false},
+		{"fail nil", []net.IP{net.ParseIP("not an ip")}, nil, true},
+		{"fail bad length", []net.IP{{1, 2, 3}}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestPKI(t)
+			if err := p.SetIPAddresses(tt.ips); (err != nil) != tt.wantErr {
+				t.Fatalf("PKI.SetIPAddresses() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if err := p.Save(); err != nil {
+				t.Fatal(err)
+			}
+			config, err := authority.LoadConfiguration(p.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(config.DNSNames, tt.want) {
+				t.Errorf("ca.json dnsNames = %v, want %v", config.DNSNames, tt.want)
+			}
+		})
+	}
+}
+
+func TestPKI_checkAddress(t *testing.T) {
+	tests := []struct {
+		name     string
+		address  string
+		dnsNames []string
+		ips      []net.IP
+		wantErr  bool
+	}{
+		{"ok dns name", "ca.example.com:9000", []string{"ca.example.com"}, nil, false},
+		{"ok dns name case", "CA.example.com:9000", []string{"ca.example.com"}, nil, false},
+		{"ok ip in dns names", "10.0.0.1:9000", []string{"ca.example.com", "10.0.0.1"}, nil, false},
+		{"ok ip address", "10.0.0.1:9000", []string{"ca.example.com"}, []net.IP{net.ParseIP("10.0.0.1")}, false},
+		{"ok ipv6", "[::1]:9000", []string{"ca.example.com", "0:0:0:0:0:0:0:1"}, nil, false},
+		{"ok wildcard", ":9000", []string{"ca.example.com"}, nil, false},
+		{"ok wildcard ipv4", "0.0.0.0:9000", []string{"ca.example.com"}, nil, false},
+		{"ok wildcard ipv6", "[::]:9000", []string{"ca.example.com"}, nil, false},
+		{"fail dns name", "ca.example.org:9000", []string{"ca.example.com"}, nil, true},
+		{"fail ip", "10.0.0.2:9000", []string{"ca.example.com", "10.0.0.1"}, nil, true},
+		{"fail address", "ca.example.com", []string{"ca.example.com"}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &PKI{address: tt.address, dnsNames: tt.dnsNames, ipAddresses: tt.ips}
+			if err := p.checkAddress(); (err != nil) != tt.wantErr {
+				t.Errorf("PKI.checkAddress() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPKI_Save_strict(t *testing.T) {
+	setForce(t)
+	tests := []struct {
+		name    string
+		address string
+		strict  bool
+		wantErr bool
+	}{
+		{"ok covered", "ca.example.com:9000", true, false},
+		{"ok wildcard", "0.0.0.0:9000", true, false},
+		{"ok uncovered not strict", "10.0.0.1:9000", false, false},
+		{"fail uncovered strict", "10.0.0.1:9000", true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestPKI(t)
+			p.SetAddress(tt.address)
+			p.SetDNSNames([]string{"ca.example.com"})
+			p.SetStrict(tt.strict)
+			if err := p.Save(); (err != nil) != tt.wantErr {
+				t.Fatalf("PKI.Save() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			_, err := os.Stat(p.config)
+			if exists := err == nil; exists == tt.wantErr {
+				t.Errorf("ca.json exists = %v, want %v", exists, !tt.wantErr)
+			}
+		})
+	}
+}
+
+type testSerialNumbers []*big.Int
+
+func (s *testSerialNumbers) SerialNumber() (*big.Int, error) {
+	if len(*s) == 0 {
+		return nil, errors.New("no more serial numbers")
+	}
+	sn := (*s)[0]
+	*s = (*s)[1:]
+	return sn, nil
+}
+
+func TestPKI_SetSerialNumberGenerator(t *testing.T) {
+	pass := []byte("password")
+	tooLong := new(big.Int).Lsh(big.NewInt(1), 160)
+	tests := []struct {
+		name                string
+		serials             testSerialNumbers
+		wantRootErr         bool
+		wantIntermediateErr bool
+	}{
+		{"ok", testSerialNumbers{big.NewInt(1), big.NewInt(2)}, false, false},
+		{"ok 20 octets", testSerialNumbers{new(big.Int).Sub(tooLong, big.NewInt(1)), big.NewInt(2)}, false, false},
+		{"fail root zero", testSerialNumbers{big.NewInt(0)}, true, false},
+		{"fail root negative", testSerialNumbers{big.NewInt(-1)}, true, false},
+		{"fail root nil", testSerialNumbers{nil}, true, false},
+		{"fail root too long", testSerialNumbers{tooLong}, true, false},
+		{"fail root generator", testSerialNumbers{}, true, false},
+		{"fail intermediate duplicated", testSerialNumbers{big.NewInt(1), big.NewInt(1)}, false, true},
+		{"fail intermediate generator", testSerialNumbers{big.NewInt(1)}, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestPKI(t)
+			serials := tt.serials
+			want := append(testSerialNumbers{}, serials...)
+			p.SetSerialNumberGenerator(&serials)
+
+			root, rootKey, err := p.GenerateRootCertificate("Test Root", pass)
+			if (err != nil) != tt.wantRootErr {
+				t.Fatalf("PKI.GenerateRootCertificate() error = %v, wantErr %v", err, tt.wantRootErr)
+			}
+			if tt.wantRootErr {
+				return
+			}
+			if root.SerialNumber.Cmp(want[0]) != 0 {
+				t.Errorf("root serial number = %v, want %v", root.SerialNumber, want[0])
+			}
+
+			err = p.GenerateIntermediateCertificate("Test Intermediate", root, rootKey, pass)
+			if (err != nil) != tt.wantIntermediateErr {
+				t.Fatalf("PKI.GenerateIntermediateCertificate() error = %v, wantErr %v", err, tt.wantIntermediateErr)
+			}
+			if tt.wantIntermediateErr {
+				return
+			}
+			crt, err := pemutil.ReadCertificate(p.intermediate)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if crt.SerialNumber.Cmp(want[1]) != 0 {
+				t.Errorf("intermediate serial number = %v, want %v", crt.SerialNumber, want[1])
+			}
+		})
+	}
+}
+
+func TestVerifyFingerprint(t *testing.T) {
+	crt := mustParsePEM(t, mustCertificatePEM(t, "root", true))
+	other := mustParsePEM(t, mustCertificatePEM(t, "other", true))
+	sum := sha256.Sum256(crt.Raw)
+	hexFP := hex.EncodeToString(sum[:])
+
+	if got := Fingerprint(crt); got != hexFP {
+		t.Errorf("Fingerprint() = %s, want %s", got, hexFP)
+	}
+
+	type args struct {
+		cert     *x509.Certificate
+		expected string
+		encoding x509util.FingerprintEncoding
+	}
+	tests := []struct {
+		name string
+		args args
+		want bool
+	}{
+		{"ok hex", args{crt, hexFP, x509util.HexFingerprint}, true},
+		{"ok hex uppercase", args{crt, strings.ToUpper(hexFP), x509util.HexFingerprint}, true},
+		{"ok base64", args{crt, base64.StdEncoding.EncodeToString(sum[:]), x509util.Base64Fingerprint}, true},
+		{"ok base64url", args{crt, base64.URLEncoding.EncodeToString(sum[:]), x509util.Base64UrlFingerprint}, true},
+		{"fail mismatch", args{other, hexFP, x509util.HexFingerprint}, false},
+		{"fail base64url mismatch", args{other, base64.URLEncoding.EncodeToString(sum[:]), x509util.Base64UrlFingerprint}, false},
+		{"fail wrong encoding", args{crt, hexFP, x509util.Base64UrlFingerprint}, false},
+		{"fail empty", args{crt, "", x509util.HexFingerprint}, false},
+		{"fail unknown encoding", args{crt, "", x509util.FingerprintEncoding(100)}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := VerifyFingerprint(tt.args.cert, tt.args.expected, tt.args.encoding); got != tt.want {
+				t.Errorf("VerifyFingerprint() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPKI_CAURL(t *testing.T) {
+	setForce(t)
+	tests := []struct {
+		name     string
+		address  string
+		dnsNames []string
+		primary  string
+		caURL    string
+		want     string
+		wantErr  bool
+	}{
+		{"ok default", "127.0.0.1:9000", []string{"127.0.0.1"}, "", "", "https://127.0.0.1:9000", false},
+		{"ok 443", ":443", []string{"ca.example.com", "127.0.0.1"}, "", "", "https://ca.example.com", false},
+		{"ok other port", "0.0.0.0:8443", []string{"ca.example.com"}, "", "", "https://ca.example.com:8443", false},
+		{"ok primary", ":443", []string{"ca.internal", "ca.example.com"}, "ca.example.com", "", "https://ca.example.com", false},
+		{"ok primary other port", ":8443", []string{"127.0.0.1", "ca.example.com"}, "ca.example.com", "", "https://ca.example.com:8443", false},
+		{"ok SetCAURL", ":443", []string{"ca.example.com"}, "", "https://ca.example.org:9443", "https://ca.example.org:9443", false},
+		{"ok SetCAURL with primary", ":443", []string{"ca.internal", "ca.example.com"}, "ca.example.com", "https://ca.example.org:9443", "https://ca.example.org:9443", false},
+		{"fail address", "127.0.0.1", []string{"127.0.0.1"}, "", "", "", true},
+		{"fail dns names", ":443", nil, "", "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestPKI(t)
+			p.SetAddress(tt.address)
+			p.dnsNames = tt.dnsNames
+			if err := p.SetPrimaryDNSName(tt.primary); err != nil {
+				t.Fatal(err)
+			}
+			p.SetCAURL(tt.caURL)
+			got, err := p.CAURL()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("PKI.CAURL() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("PKI.CAURL() = %s, want %s", got, tt.want)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			// Save writes the same URL.
+			if err := p.Save(); err != nil {
+				t.Fatal(err)
+			}
+			b, err := ioutil.ReadFile(p.defaults)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var defaults caDefaults
+			if err := json.Unmarshal(b, &defaults); err != nil {
+				t.Fatal(err)
+			}
+			if defaults.CAUrl != tt.want {
+				t.Errorf("defaults.json ca-url = %s, want %s", defaults.CAUrl, tt.want)
+			}
+		})
+	}
+}
+
+func TestPKI_SetPrimaryDNSName(t *testing.T) {
+	p := newTestPKI(t)
+	p.SetDNSNames([]string{"ca.internal", "ca.example.com"})
+	if err := p.SetIPAddresses([]net.IP{net.ParseIP("10.0.0.1")}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.SetPrimaryDNSName("ca.example.org"); err == nil {
+		t.Error("PKI.SetPrimaryDNSName() error = nil, wantErr true")
+	}
+	if err := p.SetPrimaryDNSName("10.0.0.1"); err != nil {
+		t.Errorf("PKI.SetPrimaryDNSName() error = %v", err)
+	}
+	if err := p.SetPrimaryDNSName("ca.example.com"); err != nil {
+		t.Errorf("PKI.SetPrimaryDNSName() error = %v", err)
+	}
+
+	// The primary name must still be a dns name when the URL is generated.
+	p.SetDNSNames([]string{"ca.internal"})
+	if _, err := p.CAURL(); err == nil {
+		t.Error("PKI.CAURL() error = nil, wantErr true")
+	}
+	if err := p.SetPrimaryDNSName(""); err != nil {
+		t.Errorf("PKI.SetPrimaryDNSName() error = %v", err)
+	}
+	if got, err := p.CAURL(); err != nil || got != "https://ca.internal:9000" {
+		t.Errorf("PKI.CAURL() = %s, %v, want https://ca.internal:9000", got, err)
+	}
+}
+
+func TestPKI_SetSkipDefaults(t *testing.T) {
+	setForce(t)
+	tests := []struct {
+		name    string
+		profile string
+	}{
+		{"ok", ""},
+		{"ok with profile", "prod"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestPKI(t)
+			if err := p.SetDefaultsProfile(tt.profile); err != nil {
+				t.Fatal(err)
+			}
+			p.SetSkipDefaults(true)
+			if err := p.Save(); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := os.Stat(p.config); err != nil {
+				t.Errorf("ca.json was not written: %v", err)
+			}
+			for _, name := range []string{"defaults.json", "defaults.prod.json"} {
+				if _, err := os.Stat(filepath.Join(p.base, "config", name)); !os.IsNotExist(err) {
+					t.Errorf("%s exists, error = %v", name, err)
+				}
+			}
+			if p.caURL != "" {
+				t.Errorf("PKI.caURL = %s, want empty", p.caURL)
+			}
+			for _, f := range p.plan() {
+				if f.Path == p.defaults {
+					t.Errorf("PKI.plan() contains %s", f.Path)
+				}
+			}
+		})
+	}
+}
+
+func TestPKI_SetDefaultsProfile(t *testing.T) {
+	setForce(t)
+	readDefaults := func(t *testing.T, filename string) caDefaults {
+		t.Helper()
+		b, err := ioutil.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var defaults caDefaults
+		if err := json.Unmarshal(b, &defaults); err != nil {
+			t.Fatal(err)
+		}
+		return defaults
+	}
+
+	t.Run("ok", func(t *testing.T) {
+		p := newTestPKI(t)
+		configDir := filepath.Join(p.base, "config")
+
+		// First profile also creates the unnamed defaults.json
+		if err := p.SetDefaultsProfile("prod"); err != nil {
+			t.Fatal(err)
+		}
+		p.SetCAURL("https://ca.example.com")
+		if err := p.Save(); err != nil {
+			t.Fatal(err)
+		}
+		if want := filepath.Join(configDir, "defaults.prod.json"); p.defaults != want {
+			t.Errorf("PKI.defaults = %s, want %s", p.defaults, want)
+		}
+		prod := readDefaults(t, filepath.Join(configDir, "defaults.prod.json"))
+		if prod.Profile != "prod" || prod.CAUrl != "https://ca.example.com" || prod.CAConfig != p.config {
+			t.Errorf("defaults.prod.json = %+v", prod)
+		}
+		unnamed := readDefaults(t, filepath.Join(configDir, "defaults.json"))
+		if unnamed.Profile != "" || unnamed.CAUrl != "https://ca.example.com" {
+			t.Errorf("defaults.json = %+v", unnamed)
+		}
+
+		// Other profiles do not modify the unnamed defaults.json
+		if err := p.SetDefaultsProfile("dev"); err != nil {
+			t.Fatal(err)
+		}
+		p.SetCAURL("https://localhost:9000")
+		if err := p.Save(); err != nil {
+			t.Fatal(err)
+		}
+		dev := readDefaults(t, filepath.Join(configDir, "defaults.dev.json"))
+		if dev.Profile != "dev" || dev.CAUrl != "https://localhost:9000" {
+			t.Errorf("defaults.dev.json = %+v", dev)
+		}
+		if got := readDefaults(t, filepath.Join(configDir, "defaults.json")); !reflect.DeepEqual(got, unnamed) {
+			t.Errorf("defaults.json = %+v, want %+v", got, unnamed)
+		}
+
+		// Reset the profile
+		if err := p.SetDefaultsProfile(""); err != nil {
+			t.Fatal(err)
+		}
+		if want := filepath.Join(configDir, "defaults.json"); p.defaults != want {
+			t.Errorf("PKI.defaults = %s, want %s", p.defaults, want)
+		}
+	})
+
+	t.Run("ok set base dir", func(t *testing.T) {
+		p := newTestPKI(t)
+		if err := p.SetDefaultsProfile("staging"); err != nil {
+			t.Fatal(err)
+		}
+		dir := tempDir(t)
+		if err := p.SetBaseDir(dir); err != nil {
+			t.Fatal(err)
+		}
+		if want := filepath.Join(dir, "config", "defaults.staging.json"); p.defaults != want {
+			t.Errorf("PKI.defaults = %s, want %s", p.defaults, want)
+		}
+	})
+
+	for _, name := range []string{"../prod", "prod.json", "pro d", "prod/"} {
+		t.Run("fail "+name, func(t *testing.T) {
+			p := newTestPKI(t)
+			defaults := p.defaults
+			if err := p.SetDefaultsProfile(name); err == nil {
+				t.Error("PKI.SetDefaultsProfile() error = nil, wantErr true")
+			}
+			if p.defaults != defaults {
+				t.Errorf("PKI.defaults = %s, want %s", p.defaults, defaults)
+			}
+		})
+	}
+}
+
+func TestWithOIDCProvisioner(t *testing.T) {
+	endpoint := "https://accounts.google.com/.well-known/openid-configuration"
+	admins := []string{"admin@smallstep.com", "mariano@smallstep.com"}
+	type args struct {
+		name, clientID, clientSecret, configurationEndpoint string
+		admins                                              []string
+	}
+	tests := []struct {
+		name    string
+		args    args
+		wantErr bool
+	}{
+		{"ok", args{"Google", "client-id", "client-secret", endpoint, admins}, false},
+		{"ok no admins", args{"Google", "client-id", "", endpoint, nil}, false},
+		{"fail name", args{"", "client-id", "client-secret", endpoint, admins}, true},
+		{"fail clientID", args{"Google", "", "client-secret", endpoint, admins}, true},
+		{"fail empty endpoint", args{"Google", "client-id", "client-secret", "", admins}, true},
+		{"fail endpoint not url", args{"Google", "client-id", "client-secret", "not a url", admins}, true},
+		{"fail endpoint scheme", args{"Google", "client-id", "client-secret", "ftp://accounts.google.com/", admins}, true},
+		{"fail endpoint parse", args{"Google", "client-id", "client-secret", "https://%zz", admins}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestPKI(t)
+			config, err := p.GenerateConfig(WithOIDCProvisioner(tt.args.name, tt.args.clientID, tt.args.clientSecret, tt.args.configurationEndpoint, tt.args.admins))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("GenerateConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			provs := config.AuthorityConfig.Provisioners
+			if len(provs) != 2 {
+				t.Fatalf("GenerateConfig() provisioners = %d, want 2", len(provs))
+			}
+			b, err := json.Marshal(provs[1])
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got map[string]interface{}
+			if err := json.Unmarshal(b, &got); err != nil {
+				t.Fatal(err)
+			}
+			want := map[string]interface{}{
+				"type":                  "OIDC",
+				"name":                  tt.args.name,
+				"clientID":              tt.args.clientID,
+				"clientSecret":          tt.args.clientSecret,
+				"configurationEndpoint": tt.args.configurationEndpoint,
+			}
+			if len(tt.args.admins) > 0 {
+				var admins []interface{}
+				for _, a := range tt.args.admins {
+					admins = append(admins, a)
+				}
+				want["admins"] = admins
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("json.Marshal() = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestBootstrapRoot(t *testing.T) {
+	setForce(t)
+	rootPEM := mustCertificatePEM(t, "Test Root", true)
+	root := mustParsePEM(t, rootPEM)
+	fp := Fingerprint(root)
+	otherFP := Fingerprint(mustParsePEM(t, mustCertificatePEM(t, "Other Root", true)))
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/root/"+fp && r.URL.Path != "/root/"+otherFP {
+			http.NotFound(w, r)
+			return
+		}
+		b, _ := json.Marshal(map[string]string{"ca": string(rootPEM)})
+		w.Write(b)
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name        string
+		caURL       string
+		fingerprint string
+		wantErr     bool
+	}{
+		{"ok", srv.URL, fp, false},
+		{"ok uppercase", srv.URL, strings.ToUpper(fp), false},
+		{"fail mismatch", srv.URL, otherFP, true},
+		{"fail not found", srv.URL, strings.Repeat("0", 64), true},
+		{"fail empty fingerprint", srv.URL, "", true},
+		{"fail url", "https://127.0.0.1:0", fp, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rootFile := filepath.Join(tempDir(t), "certs", "root_ca.crt")
+			got, err := bootstrapRoot(tt.caURL, tt.fingerprint, rootFile)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("bootstrapRoot() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				if _, err := os.Stat(rootFile); !os.IsNotExist(err) {
+					t.Errorf("root file should not exist, stat error = %v", err)
+				}
+				return
+			}
+			if !got.Equal(root) {
+				t.Errorf("bootstrapRoot() = %v, want %v", got.Subject, root.Subject)
+			}
+			written, err := pemutil.ReadCertificate(rootFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !written.Equal(root) {
+				t.Errorf("written root = %v, want %v", written.Subject, root.Subject)
+			}
+		})
+	}
+}
+
+func mockTrustStore(t *testing.T, goos string, root bool, stores []linuxTrustStore) {
+	t.Helper()
+	oldOS, oldStores, oldIsRoot := trustStoreOS, linuxTrustStores, isRootUser
+	trustStoreOS, linuxTrustStores = goos, stores
+	isRootUser = func() bool { return root }
+	t.Cleanup(func() {
+		trustStoreOS, linuxTrustStores, isRootUser = oldOS, oldStores, oldIsRoot
+	})
+}
+
+func TestPKI_InstallRootPlan(t *testing.T) {
+	pass := []byte("password")
+	p := newTestPKI(t)
+	crt, _, err := p.GenerateRootCertificate("Test Root", pass)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, serial := p.root, crt.SerialNumber.Text(16)
+
+	anchors := filepath.Join(tempDir(t), "anchors")
+	if err := os.Mkdir(anchors, 0700); err != nil {
+		t.Fatal(err)
+	}
+	stores := []linuxTrustStore{
+		{filepath.Join(anchors, "missing"), []string{"missing"}},
+		{anchors, []string{"update-ca-certificates"}},
+	}
+	linuxPath := filepath.Join(anchors, "step-root-ca-"+Fingerprint(crt)[:16]+".crt")
+
+	tests := []struct {
+		name          string
+		goos          string
+		root          bool
+		stores        []linuxTrustStore
+		wantPath      string
+		wantInstall   [][]string
+		wantUninstall [][]string
+		wantErr       bool
+	}{
+		{"ok linux", "linux", false, stores, linuxPath,
+			[][]string{{"sudo", "cp", root, linuxPath}, {"sudo", "update-ca-certificates"}},
+			[][]string{{"sudo", "rm", "-f", linuxPath}, {"sudo", "update-ca-certificates"}}, false},
+		{"ok linux root", "linux", true, stores, linuxPath,
+			[][]string{{"cp", root, linuxPath}, {"update-ca-certificates"}},
+			[][]string{{"rm", "-f", linuxPath}, {"update-ca-certificates"}}, false},
+		{"ok darwin", "darwin", false, nil, "/Library/Keychains/System.keychain",
+			[][]string{{"sudo", "security", "add-trusted-cert", "-d", "-k", "/Library/Keychains/System.keychain", root}},
+			[][]string{{"sudo", "security", "remove-trusted-cert", "-d", root}}, false},
+		{"ok windows", "windows", false, nil, "ROOT",
+			[][]string{{"certutil", "-addstore", "-f", "ROOT", root}},
+			[][]string{{"certutil", "-delstore", "ROOT", serial}}, false},
+		{"fail linux no trust store", "linux", false, stores[:1], "", nil, nil, true},
+		{"fail os", "plan9", false, nil, "", nil, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockTrustStore(t, tt.goos, tt.root, tt.stores)
+			install, err := p.InstallRootPlan()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("PKI.InstallRootPlan() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			uninstall, err := p.UninstallRootPlan()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("PKI.UninstallRootPlan() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if install.Path != tt.wantPath || uninstall.Path != tt.wantPath {
+				t.Errorf("TrustStorePlan.Path = %s and %s, want %s", install.Path, uninstall.Path, tt.wantPath)
+			}
+			if !reflect.DeepEqual(install.Commands, tt.wantInstall) {
+				t.Errorf("PKI.InstallRootPlan() commands = %q, want %q", install.Commands, tt.wantInstall)
+			}
+			if !reflect.DeepEqual(uninstall.Commands, tt.wantUninstall) {
+				t.Errorf("PKI.UninstallRootPlan() commands = %q, want %q", uninstall.Commands, tt.wantUninstall)
+			}
+		})
+	}
+
+	t.Run("fail missing root", func(t *testing.T) {
+		mockTrustStore(t, "darwin", false, nil)
+		p := newTestPKI(t)
+		if _, err := p.InstallRootPlan(); err == nil {
+			t.Error("PKI.InstallRootPlan() error = nil, wantErr true")
+		}
+	})
+}
+
+func TestPKI_InstallRoot(t *testing.T) {
+	p := newTestPKI(t)
+	if _, _, err := p.GenerateRootCertificate("Test Root", []byte("password")); err != nil {
+		t.Fatal(err)
+	}
+	anchors := tempDir(t)
+	mockTrustStore(t, "linux", true, []linuxTrustStore{{anchors, []string{"update-ca-certificates"}}})
+
+	var commands [][]string
+	var runErr error
+	oldRunCommand := runCommand
+	runCommand = func(args []string) error {
+		commands = append(commands, args)
+		return runErr
+	}
+	t.Cleanup(func() { runCommand = oldRunCommand })
+
+	tests := []struct {
+		name    string
+		fn      func() error
+		plan    func() (*TrustStorePlan, error)
+		err     error
+		wantRun int
+		wantErr bool
+	}{
+		{"ok install", p.InstallRoot, p.InstallRootPlan, nil, 2, false},
+		{"ok uninstall", p.UninstallRoot, p.UninstallRootPlan, nil, 2, false},
+		{"fail install", p.InstallRoot, p.InstallRootPlan, errors.New("an error"), 1, true},
+		{"fail uninstall", p.UninstallRoot, p.UninstallRootPlan, errors.New("an error"), 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			commands, runErr = nil, tt.err
+			if err := tt.fn(); (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+			plan, err := tt.plan()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(commands, plan.Commands[:tt.wantRun]) {
+				t.Errorf("commands run = %q, want %q", commands, plan.Commands[:tt.wantRun])
+			}
+		})
+	}
+}
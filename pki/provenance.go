@@ -0,0 +1,159 @@
+package pki
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.step.sm/cli-utils/config"
+	"go.step.sm/cli-utils/errs"
+	"go.step.sm/crypto/pemutil"
+	"golang.org/x/crypto/ssh"
+)
+
+// provenanceCertificate describes a certificate in the provenance record.
+type provenanceCertificate struct {
+	Path               string    `json:"path"`
+	Subject            string    `json:"subject"`
+	SerialNumber       string    `json:"serialNumber"`
+	Fingerprint        string    `json:"fingerprint"`
+	KeyType            string    `json:"keyType"`
+	SignatureAlgorithm string    `json:"signatureAlgorithm"`
+	NotBefore          time.Time `json:"notBefore"`
+	NotAfter           time.Time `json:"notAfter"`
+	KeyURI             string    `json:"keyUri,omitempty"`
+}
+
+// provenanceSSHKey describes an SSH CA key in the provenance record.
+type provenanceSSHKey struct {
+	Path        string `json:"path"`
+	KeyType     string `json:"keyType"`
+	Fingerprint string `json:"fingerprint"`
+}
+
+// provenance is the record of how a PKI was created. Digest is the SHA-256
+// of the compact JSON encoding of the record without the digest. It's an
+// unkeyed checksum, it only detects accidental corruption.
+type provenance struct {
+	Version      string                 `json:"version"`
+	CreatedAt    time.Time              `json:"createdAt"`
+	Root         *provenanceCertificate `json:"root"`
+	Intermediate *provenanceCertificate `json:"intermediate,omitempty"`
+	SSHHostKey   *provenanceSSHKey      `json:"sshHostKey,omitempty"`
+	SSHUserKey   *provenanceSSHKey      `json:"sshUserKey,omitempty"`
+	Digest       string                 `json:"digest,omitempty"`
+}
+
+// SetWriteProvenance enables or disables writing the provenance record
+// returned by Provenance to provenance.json, in the configuration directory,
+// when the PKI is saved.
+func (p *PKI) SetWriteProvenance(value bool) {
+	p.writeProvenance = value
+}
+
+// Provenance returns a JSON record of the PKI for audit purposes. It contains
+// the version of the tool, the creation time and, for the root, intermediate
+// and SSH keys on disk, their key types, fingerprints and, for certificates,
+// their validity, and the URI of a root key created in a KMS. The record
+// includes a SHA-256 digest of its content, without the digest field, as an
+// integrity checksum against accidental corruption. The digest is not keyed,
+// anyone editing the record can recompute it, so it does not prove the record
+// was not tampered with.
+func (p *PKI) Provenance() ([]byte, error) {
+	root, err := provenanceCertificateFor(p.root)
+	if err != nil {
+		return nil, err
+	}
+	root.KeyURI = p.rootKeyURI
+	doc := &provenance{
+		Version:   config.Version(),
+		CreatedAt: time.Now().UTC().Truncate(time.Second),
+		Root:      root,
+	}
+	if p.intermediate != "" {
+		if doc.Intermediate, err = provenanceCertificateFor(p.intermediate); err != nil {
+			return nil, err
+		}
+	}
+	if p.enableSSH {
+		if doc.SSHHostKey, err = provenanceSSHKeyFor(p.sshHostPubKey); err != nil {
+			return nil, err
+		}
+		if doc.SSHUserKey, err = provenanceSSHKeyFor(p.sshUserPubKey); err != nil {
+			return nil, err
+		}
+	}
+
+	b, err := json.Marshal(doc)
+	if err != nil {
+		return nil, errors.Wrap(err, "error marshaling provenance")
+	}
+	sum := sha256.Sum256(b)
+	doc.Digest = "sha256:" + hex.EncodeToString(sum[:])
+
+	b, err = json.MarshalIndent(doc, "", "\t")
+	if err != nil {
+		return nil, errors.Wrap(err, "error marshaling provenance")
+	}
+	return b, nil
+}
+
+// provenanceCertificateFor returns the provenance of the first certificate
+// in the given file.
+func provenanceCertificateFor(filename string) (*provenanceCertificate, error) {
+	crt, err := pemutil.ReadCertificate(filename)
+	if err != nil {
+		return nil, err
+	}
+	return &provenanceCertificate{
+		Path:               filename,
+		Subject:            crt.Subject.String(),
+		SerialNumber:       crt.SerialNumber.String(),
+		Fingerprint:        Fingerprint(crt),
+		KeyType:            keyType(crt),
+		SignatureAlgorithm: crt.SignatureAlgorithm.String(),
+		NotBefore:          crt.NotBefore.UTC(),
+		NotAfter:           crt.NotAfter.UTC(),
+	}, nil
+}
+
+// provenanceSSHKeyFor returns the provenance of the SSH public key in the
+// given file.
+func provenanceSSHKeyFor(filename string) (*provenanceSSHKey, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, errs.FileError(err, filename)
+	}
+	key, _, _, _, err := ssh.ParseAuthorizedKey(b)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error parsing %s", filename)
+	}
+	return &provenanceSSHKey{
+		Path:        filename,
+		KeyType:     key.Type(),
+		Fingerprint: ssh.FingerprintSHA256(key),
+	}, nil
+}
+
+// keyType returns a description of the public key of the certificate, like
+// "EC P-256" or "RSA 2048".
+func keyType(crt *x509.Certificate) string {
+	switch k := crt.PublicKey.(type) {
+	case *ecdsa.PublicKey:
+		return "EC " + k.Curve.Params().Name
+	case *rsa.PublicKey:
+		return fmt.Sprintf("RSA %d", k.N.BitLen())
+	case ed25519.PublicKey:
+		return "OKP Ed25519"
+	default:
+		return crt.PublicKeyAlgorithm.String()
+	}
+}
@@ -1,59 +1,96 @@
 package pki
 
 import (
+	"encoding/json"
 	"os"
 	"path/filepath"
 
 	"github.com/pkg/errors"
+	"github.com/smallstep/certificates/authority"
 	"github.com/smallstep/certificates/templates"
 	"go.step.sm/cli-utils/config"
 	"go.step.sm/cli-utils/errs"
-	"go.step.sm/cli-utils/fileutil"
 )
 
+// SetTemplateData sets the custom variables written in the data section of the
+// templates. The variables must be serializable to JSON, and they cannot use
+// the reserved names "Step" and "User".
+func (p *PKI) SetTemplateData(data map[string]interface{}) error {
+	if _, err := json.Marshal(data); err != nil {
+		return errors.Wrap(err, "error marshaling template data")
+	}
+	if err := (&templates.Templates{Data: data}).Validate(); err != nil {
+		return err
+	}
+	p.templateData = data
+	return nil
+}
+
 // getTemplates returns all the templates enabled
 func (p *PKI) getTemplates() *templates.Templates {
 	if !p.enableSSH {
-		return nil
+		if len(p.templateData) == 0 {
+			return nil
+		}
+		return &templates.Templates{
+			Data: p.getTemplateData(),
+		}
+	}
+
+	// Default templates are relative to the STEPPATH, use absolute paths if
+	// the PKI is using a different base directory.
+	sshTemplates := &templates.DefaultSSHTemplates
+	if p.base != "" && p.base != config.StepPath() {
+		sshTemplates = &templates.SSHTemplates{
+			User: p.getTemplatesWithBaseDir(templates.DefaultSSHTemplates.User),
+			Host: p.getTemplatesWithBaseDir(templates.DefaultSSHTemplates.Host),
+		}
 	}
+
 	return &templates.Templates{
-		SSH:  &templates.DefaultSSHTemplates,
-		Data: map[string]interface{}{},
+		SSH:  sshTemplates,
+		Data: p.getTemplateData(),
+	}
+}
+
+// getTemplateData returns a copy of the custom template variables.
+func (p *PKI) getTemplateData() map[string]interface{} {
+	data := make(map[string]interface{}, len(p.templateData))
+	for k, v := range p.templateData {
+		data[k] = v
+	}
+	return data
+}
+
+// getTemplatesWithBaseDir returns a copy of the given templates with the
+// template paths relative to the base directory of the PKI.
+func (p *PKI) getTemplatesWithBaseDir(tpls []templates.Template) []templates.Template {
+	ret := make([]templates.Template, len(tpls))
+	for i, t := range tpls {
+		ret[i] = t
+		if !filepath.IsAbs(t.TemplatePath) {
+			ret[i].TemplatePath = filepath.Join(p.base, t.TemplatePath)
+		}
 	}
+	return ret
 }
 
 // generateTemplates generates given templates.
-func generateTemplates(t *templates.Templates) error {
+func (p *PKI) generateTemplates(t *templates.Templates) error {
 	if t == nil {
 		return nil
 	}
 
-	base := GetTemplatesPath()
 	// Generate SSH templates
 	if t.SSH != nil {
-		// all ssh templates are under ssh:
-		sshDir := filepath.Join(base, "ssh")
-		if _, err := os.Stat(sshDir); os.IsNotExist(err) {
-			if err = os.MkdirAll(sshDir, 0700); err != nil {
-				return errs.FileError(err, sshDir)
-			}
-		}
 		// Create all templates
 		for _, t := range t.SSH.User {
-			data, ok := templates.DefaultSSHTemplateData[t.Name]
-			if !ok {
-				return errors.Errorf("template %s does not exists", t.Name)
-			}
-			if err := fileutil.WriteFile(config.StepAbs(t.TemplatePath), []byte(data), 0644); err != nil {
+			if err := p.writeTemplate(t); err != nil {
 				return err
 			}
 		}
 		for _, t := range t.SSH.Host {
-			data, ok := templates.DefaultSSHTemplateData[t.Name]
-			if !ok {
-				return errors.Errorf("template %s does not exists", t.Name)
-			}
-			if err := fileutil.WriteFile(config.StepAbs(t.TemplatePath), []byte(data), 0644); err != nil {
+			if err := p.writeTemplate(t); err != nil {
 				return err
 			}
 		}
@@ -61,3 +98,56 @@ func generateTemplates(t *templates.Templates) error {
 
 	return nil
 }
+
+// writeTemplate writes the default data of the given template, creating the
+// template directory if necessary.
+func (p *PKI) writeTemplate(t templates.Template) error {
+	data, ok := templates.DefaultSSHTemplateData[t.Name]
+	if !ok {
+		return errors.Errorf("template %s does not exists", t.Name)
+	}
+	filename := config.StepAbs(t.TemplatePath)
+	dir := filepath.Dir(filename)
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		if err = os.MkdirAll(dir, 0700); err != nil {
+			return errs.FileError(err, dir)
+		}
+	}
+	return p.writeFile(filename, []byte(data), 0644)
+}
+
+// RegenerateTemplates writes the default data of the templates configured in
+// ca.json, so the templates can be refreshed without rewriting the
+// configuration. Existing templates are kept unless force is true. Templates
+// without default data are ignored.
+func (p *PKI) RegenerateTemplates(force bool) error {
+	cfg, err := authority.LoadConfiguration(p.config)
+	if err != nil {
+		return err
+	}
+	if cfg.Templates == nil || cfg.Templates.SSH == nil {
+		return nil
+	}
+
+	tpls := append(append([]templates.Template{}, cfg.Templates.SSH.User...), cfg.Templates.SSH.Host...)
+	for _, t := range tpls {
+		data, ok := templates.DefaultSSHTemplateData[t.Name]
+		if !ok {
+			continue
+		}
+		filename := config.StepAbs(t.TemplatePath)
+		if _, err := os.Stat(filename); err == nil && !force {
+			continue
+		}
+		dir := filepath.Dir(filename)
+		if _, err := os.Stat(dir); os.IsNotExist(err) {
+			if err = os.MkdirAll(dir, 0700); err != nil {
+				return errs.FileError(err, dir)
+			}
+		}
+		if err := writeFileAtomic(filename, []byte(data), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
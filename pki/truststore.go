@@ -0,0 +1,172 @@
+package pki
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.step.sm/crypto/pemutil"
+)
+
+// TrustStorePlan contains the commands that InstallRoot or UninstallRoot run
+// to modify the system trust store. It can be used to show the changes before
+// applying them.
+type TrustStorePlan struct {
+	// Path is the location of the root certificate in the trust store, a
+	// file on Linux, the keychain on macOS and the certificate store on
+	// Windows.
+	Path string
+	// Commands are the commands to run in order, the first element of each
+	// one is the program.
+	Commands [][]string
+}
+
+// linuxTrustStore is the directory of the certificates trusted by a Linux
+// distribution and the command that updates the system trust store.
+type linuxTrustStore struct {
+	dir    string
+	update []string
+}
+
+// linuxTrustStores are the known trust stores, the first one that exists is
+// used. This variable is used for testing purposes.
+var linuxTrustStores = []linuxTrustStore{
+	{"/etc/pki/ca-trust/source/anchors", []string{"update-ca-trust", "extract"}},
+	{"/usr/local/share/ca-certificates", []string{"update-ca-certificates"}},
+	{"/etc/ca-certificates/trust-source/anchors", []string{"trust", "extract-compat"}},
+	{"/usr/share/pki/trust/anchors", []string{"update-ca-certificates"}},
+}
+
+// trustStoreOS is the operating system of the trust store. This variable is
+// used for testing purposes.
+var trustStoreOS = runtime.GOOS
+
+// isRootUser returns true if the process runs as root, otherwise the commands
+// that modify the trust store on Linux and macOS are run with sudo. This
+// variable is used for testing purposes.
+var isRootUser = func() bool {
+	return os.Geteuid() == 0
+}
+
+// runCommand runs the given command connected to the standard streams, so
+// sudo can ask for a password. This variable is used for testing purposes.
+var runCommand = func(args []string) error {
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return errors.Wrapf(err, "error running %s", strings.Join(args, " "))
+	}
+	return nil
+}
+
+// InstallRoot adds the root certificate of the PKI to the system trust store,
+// so local clients trust the certificates issued by the CA. It's meant for
+// development environments and it's never done automatically. The commands
+// run are the ones returned by InstallRootPlan.
+func (p *PKI) InstallRoot() error {
+	plan, err := p.InstallRootPlan()
+	if err != nil {
+		return err
+	}
+	return runTrustStorePlan(plan)
+}
+
+// UninstallRoot removes the root certificate of the PKI from the system trust
+// store. The commands run are the ones returned by UninstallRootPlan.
+func (p *PKI) UninstallRoot() error {
+	plan, err := p.UninstallRootPlan()
+	if err != nil {
+		return err
+	}
+	return runTrustStorePlan(plan)
+}
+
+// InstallRootPlan returns the commands that InstallRoot would run, without
+// running them.
+func (p *PKI) InstallRootPlan() (*TrustStorePlan, error) {
+	return p.trustStorePlan(true)
+}
+
+// UninstallRootPlan returns the commands that UninstallRoot would run, without
+// running them.
+func (p *PKI) UninstallRootPlan() (*TrustStorePlan, error) {
+	return p.trustStorePlan(false)
+}
+
+func (p *PKI) trustStorePlan(install bool) (*TrustStorePlan, error) {
+	root, err := filepath.Abs(p.root)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error getting absolute path for %s", p.root)
+	}
+	crt, err := pemutil.ReadCertificate(root)
+	if err != nil {
+		return nil, err
+	}
+
+	plan := new(TrustStorePlan)
+	switch trustStoreOS {
+	case "linux":
+		store, err := findLinuxTrustStore()
+		if err != nil {
+			return nil, err
+		}
+		// The name is unique for each root, so it can be removed later.
+		plan.Path = filepath.Join(store.dir, "step-root-ca-"+Fingerprint(crt)[:16]+".crt")
+		if install {
+			plan.Commands = append(plan.Commands, withSudo("cp", root, plan.Path))
+		} else {
+			plan.Commands = append(plan.Commands, withSudo("rm", "-f", plan.Path))
+		}
+		plan.Commands = append(plan.Commands, withSudo(store.update...))
+	case "darwin":
+		plan.Path = "/Library/Keychains/System.keychain"
+		if install {
+			plan.Commands = append(plan.Commands, withSudo("security", "add-trusted-cert", "-d", "-k", plan.Path, root))
+		} else {
+			plan.Commands = append(plan.Commands, withSudo("security", "remove-trusted-cert", "-d", root))
+		}
+	case "windows":
+		plan.Path = "ROOT"
+		if install {
+			plan.Commands = append(plan.Commands, []string{"certutil", "-addstore", "-f", plan.Path, root})
+		} else {
+			plan.Commands = append(plan.Commands, []string{"certutil", "-delstore", plan.Path, crt.SerialNumber.Text(16)})
+		}
+	default:
+		return nil, errors.Errorf("error modifying the system trust store: %s is not supported", trustStoreOS)
+	}
+	return plan, nil
+}
+
+// findLinuxTrustStore returns the first known trust store in the system.
+func findLinuxTrustStore() (*linuxTrustStore, error) {
+	for i := range linuxTrustStores {
+		if fi, err := os.Stat(linuxTrustStores[i].dir); err == nil && fi.IsDir() {
+			return &linuxTrustStores[i], nil
+		}
+	}
+	return nil, errors.New("error modifying the system trust store: no supported trust store was found")
+}
+
+// withSudo returns the given command run with sudo, unless the process already
+// runs as root.
+func withSudo(args ...string) []string {
+	if isRootUser() {
+		return args
+	}
+	return append([]string{"sudo"}, args...)
+}
+
+// runTrustStorePlan runs the commands in the given plan, stopping at the first
+// error.
+func runTrustStorePlan(plan *TrustStorePlan) error {
+	for _, args := range plan.Commands {
+		if err := runCommand(args); err != nil {
+			return err
+		}
+	}
+	return nil
+}